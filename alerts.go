@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+const defaultAlertInterval = 30
+
+type AlertState string
+
+const (
+	AlertInactive AlertState = "inactive"
+	AlertPending  AlertState = "pending"
+	AlertFiring   AlertState = "firing"
+	AlertResolved AlertState = "resolved"
+)
+
+var alertExprRegex = regexp.MustCompile(`^\s*(\w+)\s*\(\s*([a-zA-Z_:][a-zA-Z0-9_:]*)\s*(\{[^}]*\})?\s*\)\s+over\s+(\S+)\s*(>=|<=|==|!=|>|<)\s*(\S+)\s*$`)
+
+var alertAggregations = map[string]func([]float64) float64{
+	"avg": func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	},
+	"min": func(values []float64) float64 { return slices.Min(values) },
+	"max": func(values []float64) float64 { return slices.Max(values) },
+	"sum": func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+	"count": func(values []float64) float64 { return float64(len(values)) },
+	"last":  func(values []float64) float64 { return values[len(values)-1] },
+}
+
+var alertComparisons = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// Parsed form of expressions like "avg(cpu_loadavg{span=1m}) over 5m > 4"
+type AlertExpr struct {
+	Raw         string
+	Aggregation string
+	Metric      string
+	// Matched against sample labels first, then entity ID labels
+	Selector  map[string]string
+	Window    time.Duration
+	Operator  string
+	Threshold float64
+}
+
+func ParseAlertExpr(expr string) (*AlertExpr, error) {
+	m := alertExprRegex.FindStringSubmatch(expr)
+	if m == nil {
+		return nil, fmt.Errorf("expression should look like 'avg(metric{label=value}) over 5m > 4'")
+	}
+
+	if _, ok := alertAggregations[m[1]]; !ok {
+		return nil, fmt.Errorf("unknown aggregation '%s', should be one of avg, min, max, sum, count, last", m[1])
+	}
+
+	selector, err := parseAlertSelector(m[3])
+	if err != nil {
+		return nil, err
+	}
+
+	window, err := time.ParseDuration(m[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid window: %w", err)
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("window should be more than zero")
+	}
+
+	threshold, err := strconv.ParseFloat(m[6], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid threshold: %w", err)
+	}
+
+	return &AlertExpr{
+		Raw:         strings.TrimSpace(expr),
+		Aggregation: m[1],
+		Metric:      m[2],
+		Selector:    selector,
+		Window:      window,
+		Operator:    m[5],
+		Threshold:   threshold,
+	}, nil
+}
+
+func parseAlertSelector(s string) (map[string]string, error) {
+	selector := make(map[string]string)
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	if len(strings.TrimSpace(s)) == 0 {
+		return selector, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || len(key) == 0 {
+			return nil, fmt.Errorf("invalid label matcher '%s'", strings.TrimSpace(pair))
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		selector[key] = value
+	}
+	return selector, nil
+}
+
+func (e *AlertExpr) Matches(sample MetricsSample) bool {
+	return MatchLabels(e.Selector, sample)
+}
+
+type AlertRuleConfig struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+	// How long the expression has to hold before the alert fires, like "10m"
+	For string `json:"for"`
+	// Seconds between evaluations, defaults to 30
+	Interval int `json:"interval"`
+}
+
+func (c *AlertRuleConfig) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string)
+
+	err := utils.CheckName(c.Name)
+	if err != nil {
+		problems["name"] = err.Error()
+	}
+
+	_, err = ParseAlertExpr(c.Expr)
+	if err != nil {
+		problems["expr"] = err.Error()
+	}
+
+	if len(c.For) > 0 {
+		d, err := time.ParseDuration(c.For)
+		if err != nil {
+			problems["for"] = fmt.Sprint("invalid duration: ", err)
+		} else if d < 0 {
+			problems["for"] = "cannot be less than zero"
+		}
+	}
+
+	if c.Interval < 0 {
+		problems["interval"] = "cannot be less than zero"
+	}
+
+	return problems
+}
+
+// Samples of one entity with the same sample labels, like the usage of one
+// mount
+type alertSeries struct {
+	id          utils.EntityID
+	labels      map[string]string
+	state       AlertState
+	activeSince time.Time
+}
+
+// Identifies the series of a sample by its entity ID and sample labels
+func alertSeriesKey(sample MetricsSample) string {
+	return sample.ID.Canonical() + formatLabels(sample.Labels)
+}
+
+// Formats labels sorted by key like {mountpoint=/,unit=bytes}, empty when
+// there are none
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type AlertRule struct {
+	Instance string
+	cfg      AlertRuleConfig
+	expr     *AlertExpr
+	forDur   time.Duration
+
+	// Series key to the state of the alert for it
+	series map[string]*alertSeries
+}
+
+func NewAlertRule(instance string, rawCfg []byte) (*AlertRule, error) {
+	resolved, err := ResolveConfig(rawCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg AlertRuleConfig
+	err = json.Unmarshal(resolved.JSON, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := cfg.Valid(context.TODO())
+	if valErr := resolved.ValidationError(problems, instance, "alerts", cfg.Name); valErr != nil {
+		return nil, valErr
+	}
+
+	expr, _ := ParseAlertExpr(cfg.Expr)
+	// Rules only see the entities of their own instance
+	expr.Selector["instance"] = instance
+
+	var forDur time.Duration
+	if len(cfg.For) > 0 {
+		forDur, _ = time.ParseDuration(cfg.For)
+	}
+
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultAlertInterval
+	}
+
+	return &AlertRule{
+		Instance: instance,
+		cfg:      cfg,
+		expr:     expr,
+		forDur:   forDur,
+		series:   make(map[string]*alertSeries),
+	}, nil
+}
+
+// Evaluates the rule against the samples and returns events for every series
+// that changed its state
+func (r *AlertRule) Evaluate(now time.Time, samples []MetricsSample) []Event {
+	values := make(map[string][]float64)
+	matched := make(map[string]MetricsSample)
+	for _, sample := range samples {
+		if !r.expr.Matches(sample) {
+			continue
+		}
+		key := alertSeriesKey(sample)
+		values[key] = append(values[key], sample.Value)
+		matched[key] = sample
+	}
+
+	aggregate := alertAggregations[r.expr.Aggregation]
+	compare := alertComparisons[r.expr.Operator]
+
+	var events []Event
+	active := make(map[string]bool, len(values))
+	for key, vals := range values {
+		value := aggregate(vals)
+		if !compare(value, r.expr.Threshold) {
+			continue
+		}
+		active[key] = true
+
+		series, ok := r.series[key]
+		if !ok {
+			sample := matched[key]
+			series = &alertSeries{id: sample.ID, labels: sample.Labels, state: AlertInactive}
+			r.series[key] = series
+		}
+
+		message := fmt.Sprintf("%s(%s%s) over %s is %g, threshold %s %g",
+			r.expr.Aggregation, r.expr.Metric, formatLabels(series.labels), r.expr.Window, value, r.expr.Operator, r.expr.Threshold)
+
+		if series.state == AlertInactive {
+			series.activeSince = now
+			series.state = AlertPending
+			events = append(events, r.event(series, AlertInactive, AlertPending, message, now))
+		}
+
+		if series.state == AlertPending && now.Sub(series.activeSince) >= r.forDur {
+			series.state = AlertFiring
+			events = append(events, r.event(series, AlertPending, AlertFiring, message, now))
+		}
+	}
+
+	// Series that stopped matching, or have no samples in the window anymore
+	for key, series := range r.series {
+		if active[key] {
+			continue
+		}
+
+		if series.state == AlertFiring {
+			events = append(events, r.event(series, AlertFiring, AlertResolved, "", now))
+		}
+		delete(r.series, key)
+	}
+
+	return events
+}
+
+// Events carry the sample labels next to the entity ID ones, which win on
+// conflicts since notifiers are routed by instance and service
+func (r *AlertRule) event(series *alertSeries, from AlertState, to AlertState, message string, now time.Time) Event {
+	if len(message) == 0 {
+		message = r.expr.Raw
+		if len(series.labels) > 0 {
+			message += " for " + formatLabels(series.labels)
+		}
+	}
+	labels := maps.Clone(series.labels)
+	if labels == nil {
+		labels = make(map[string]string, len(series.id.Labels))
+	}
+	maps.Copy(labels, series.id.Labels)
+	return Event{
+		Kind:      "alert",
+		EntityID:  series.id.Canonical(),
+		Labels:    labels,
+		Name:      r.cfg.Name,
+		From:      string(from),
+		To:        string(to),
+		Message:   message,
+		Timestamp: now,
+	}
+}
+
+type AlertService struct {
+	logger        *utils.Logger
+	metricsRepo   MetricsRepo
+	notifications *NotificationService
+
+	mu sync.Mutex
+	// Instance name to its running rules by name
+	instances map[string]map[string]*runningRule
+
+	wg sync.WaitGroup
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewAlertService(metricsRepo MetricsRepo, notifications *NotificationService) *AlertService {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &AlertService{
+		logger:        utils.DefaultLogger(),
+		metricsRepo:   metricsRepo,
+		notifications: notifications,
+		instances:     make(map[string]map[string]*runningRule),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+type runningRule struct {
+	rule   *AlertRule
+	cancel context.CancelFunc
+}
+
+// Validates and builds the rules of an instance without running them yet
+func (s *AlertService) PrepareInstance(instance string, rawRules []json.RawMessage) ([]*AlertRule, error) {
+	var errs []error
+	rules := make([]*AlertRule, 0, len(rawRules))
+	names := make(map[string]struct{}, len(rawRules))
+	for i, raw := range rawRules {
+		rule, err := NewAlertRule(instance, raw)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if _, exists := names[rule.cfg.Name]; exists {
+			err := NewDuplicateFoundError(instance, "alerts")
+			err.SetIndex(i)
+			errs = append(errs, err)
+			continue
+		}
+		names[rule.cfg.Name] = struct{}{}
+
+		rules = append(rules, rule)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return rules, nil
+}
+
+// Replaces the running rules of the instance. Rules with the same name and
+// config keep running, so their pending and firing alerts aren't lost
+func (s *AlertService) ApplyInstance(instance string, rules []*AlertRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.instances[instance]
+	running := make(map[string]*runningRule, len(rules))
+	for _, rule := range rules {
+		if prev, ok := old[rule.cfg.Name]; ok && prev.rule.cfg == rule.cfg {
+			running[rule.cfg.Name] = prev
+			delete(old, rule.cfg.Name)
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		running[rule.cfg.Name] = &runningRule{rule: rule, cancel: cancel}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.runRule(ctx, rule)
+		}()
+	}
+
+	for _, prev := range old {
+		prev.cancel()
+	}
+	s.instances[instance] = running
+}
+
+func (s *AlertService) RemoveInstance(instance string) {
+	s.ApplyInstance(instance, nil)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.instances, instance)
+}
+
+func (s *AlertService) runRule(ctx context.Context, rule *AlertRule) {
+	ticker := time.NewTicker(time.Duration(rule.cfg.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			samples, err := s.metricsRepo.ListSamples(ctx, rule.expr.Metric, now.Add(-rule.expr.Window), now)
+			if err != nil {
+				s.logger.Warn("Could not evaluate alert rule", "rule", rule.cfg.Name, "err", err)
+				continue
+			}
+
+			for _, event := range rule.Evaluate(now, samples) {
+				s.logger.Info("Alert state changed", "rule", rule.cfg.Name, "id", event.EntityID, "from", event.From, "to", event.To)
+				s.notifications.Notify(event)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *AlertService) Stop(ctx context.Context) error {
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
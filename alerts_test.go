@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"testing"
+	"time"
+)
+
+func newTestAlertRule(t *testing.T, expr string) *AlertRule {
+	t.Helper()
+	rawCfg, err := json.Marshal(map[string]any{"name": "rule", "expr": expr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule, err := NewAlertRule("home", rawCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rule
+}
+
+func TestAlertRuleSeriesPerLabels(t *testing.T) {
+	id := NewMetricsID("home", "host", "disk", "disks")
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	sample := func(mountpoint string, value float64) MetricsSample {
+		return MetricsSample{
+			ID:        id,
+			Timestamp: now,
+			Type:      MetricGauge,
+			Name:      "disk_used_ratio",
+			Value:     value,
+			Labels:    map[string]string{"mountpoint": mountpoint},
+		}
+	}
+
+	rule := newTestAlertRule(t, "max(disk_used_ratio) over 5m > 0.9")
+
+	// Averaged together the mounts would stay under the threshold
+	events := rule.Evaluate(now, []MetricsSample{sample("/", 0.95), sample("/home", 0.2)})
+	if len(events) != 2 {
+		t.Fatalf("expected pending and firing events for one mount, got %+v", events)
+	}
+	for _, event := range events {
+		if event.EntityID != id.Canonical() {
+			t.Errorf("expected entity %s, got %s", id.Canonical(), event.EntityID)
+		}
+		want := maps.Clone(id.Labels)
+		want["mountpoint"] = "/"
+		if !maps.Equal(event.Labels, want) {
+			t.Errorf("expected labels %v, got %v", want, event.Labels)
+		}
+	}
+	if events[1].To != string(AlertFiring) {
+		t.Errorf("expected the alert to fire, got %s", events[1].To)
+	}
+	if want := "max(disk_used_ratio{mountpoint=/}) over 5m0s is 0.95, threshold > 0.9"; events[1].Message != want {
+		t.Errorf("expected message %q, got %q", want, events[1].Message)
+	}
+
+	// The other mount filling up is a separate alert
+	events = rule.Evaluate(now.Add(time.Minute), []MetricsSample{sample("/", 0.95), sample("/home", 0.99)})
+	if len(events) != 2 || events[0].Labels["mountpoint"] != "/home" {
+		t.Fatalf("expected events for /home only, got %+v", events)
+	}
+
+	events = rule.Evaluate(now.Add(2*time.Minute), []MetricsSample{sample("/", 0.5), sample("/home", 0.99)})
+	if len(events) != 1 {
+		t.Fatalf("expected a single resolved event, got %+v", events)
+	}
+	if events[0].To != string(AlertResolved) || events[0].Labels["mountpoint"] != "/" {
+		t.Errorf("expected / to resolve, got %+v", events[0])
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+const (
+	defaultAPIPageSize = 100
+	maxAPIPageSize     = 1000
+	defaultAPIRange    = 24 * time.Hour
+)
+
+type APIServer struct {
+	logger *utils.Logger
+	server *http.Server
+	mux    *http.ServeMux
+
+	entityRepo    EntityRepo
+	heartbeatRepo HeartbeatRepo
+	metricsRepo   MetricsRepo
+	reports       *UptimeReporter
+}
+
+func NewAPIServer(addr string, entityRepo EntityRepo, heartbeatRepo HeartbeatRepo, metricsRepo MetricsRepo, reports *UptimeReporter) *APIServer {
+	s := &APIServer{
+		logger:        utils.DefaultLogger(),
+		mux:           http.NewServeMux(),
+		entityRepo:    entityRepo,
+		heartbeatRepo: heartbeatRepo,
+		metricsRepo:   metricsRepo,
+		reports:       reports,
+	}
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	s.mux.HandleFunc("GET /api/entities", s.handleEntities)
+	s.mux.HandleFunc("GET /api/entities/{id}/heartbeats", s.handleHeartbeats)
+	s.mux.HandleFunc("GET /api/metrics", s.handleMetrics)
+	s.mux.HandleFunc("GET /api/report", s.handleReport)
+	return s
+}
+
+func (s *APIServer) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Listens in the background until Stop is called
+func (s *APIServer) Start() error {
+	ln, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("API listening", "addr", ln.Addr().String())
+	go func() {
+		err := s.server.Serve(ln)
+		if !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("API server stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+func (s *APIServer) Stop(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...any) {
+	writeJSON(w, status, apiError{Error: fmt.Sprintf(format, args...)})
+}
+
+// Parses from and to as RFC 3339, defaulting to the last day
+func parseTimeRange(r *http.Request) (time.Time, time.Time, error) {
+	to := time.Now()
+	if raw := r.URL.Query().Get("to"); len(raw) > 0 {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid 'to': %w", err)
+		}
+		to = t
+	}
+
+	from := to.Add(-defaultAPIRange)
+	if raw := r.URL.Query().Get("from"); len(raw) > 0 {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid 'from': %w", err)
+		}
+		from = t
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errors.New("'from' should be before 'to'")
+	}
+	return from, to, nil
+}
+
+// Parses limit and the ID to start after for keyset paging
+func parsePage(r *http.Request) (int, int64, error) {
+	limit := defaultAPIPageSize
+	if raw := r.URL.Query().Get("limit"); len(raw) > 0 {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > maxAPIPageSize {
+			return 0, 0, fmt.Errorf("limit should be between 1 and %d", maxAPIPageSize)
+		}
+	}
+
+	var after int64
+	if raw := r.URL.Query().Get("after"); len(raw) > 0 {
+		var err error
+		after, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return 0, 0, errors.New("invalid 'after'")
+		}
+	}
+	return limit, after, nil
+}
+
+type apiEntity struct {
+	ID          int64             `json:"id"`
+	CanonicalID string            `json:"canonical_id"`
+	Kind        string            `json:"kind"`
+	Labels      map[string]string `json:"labels"`
+}
+
+func (s *APIServer) handleEntities(w http.ResponseWriter, r *http.Request) {
+	entities, err := s.entityRepo.ListEntities(r.Context())
+	if err != nil {
+		s.logger.Error("Could not list entities", "err", err)
+		writeError(w, http.StatusInternalServerError, "could not list entities")
+		return
+	}
+
+	kind := r.URL.Query().Get("kind")
+	result := make([]apiEntity, 0, len(entities))
+	for _, e := range entities {
+		if len(kind) > 0 && e.EntityID.Kind != kind {
+			continue
+		}
+		result = append(result, apiEntity{
+			ID:          e.ID,
+			CanonicalID: e.EntityID.Canonical(),
+			Kind:        e.EntityID.Kind,
+			Labels:      e.EntityID.Labels,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+type apiHeartbeat struct {
+	ID          int64     `json:"id"`
+	Timestamp   time.Time `json:"timestamp"`
+	Successful  bool      `json:"successful"`
+	Error       string    `json:"error,omitempty"`
+	LatencyMs   float64   `json:"latency_ms"`
+	DNSMs       float64   `json:"dns_ms,omitempty"`
+	ConnectMs   float64   `json:"connect_ms,omitempty"`
+	TLSMs       float64   `json:"tls_ms,omitempty"`
+	FirstByteMs float64   `json:"first_byte_ms,omitempty"`
+}
+
+type apiHeartbeatPage struct {
+	Heartbeats []apiHeartbeat `json:"heartbeats"`
+	// Pass as 'after' to get the next page, empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (s *APIServer) handleHeartbeats(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid entity id")
+		return
+	}
+
+	canonID, err := s.entityRepo.GetCanonicalID(r.Context(), id)
+	if errors.Is(err, ErrIDNotFound) {
+		writeError(w, http.StatusNotFound, "entity %d not found", id)
+		return
+	} else if err != nil {
+		s.logger.Error("Could not get entity", "id", id, "err", err)
+		writeError(w, http.StatusInternalServerError, "could not get entity")
+		return
+	}
+
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	limit, after, err := parsePage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	heartbeats, err := s.heartbeatRepo.PageHeartbeats(r.Context(), canonID, from, to, after, limit)
+	if err != nil {
+		s.logger.Error("Could not list heartbeats", "id", canonID, "err", err)
+		writeError(w, http.StatusInternalServerError, "could not list heartbeats")
+		return
+	}
+
+	page := apiHeartbeatPage{
+		Heartbeats: make([]apiHeartbeat, len(heartbeats)),
+	}
+	for i, hb := range heartbeats {
+		var errText string
+		if hb.Error != nil {
+			errText = hb.Error.Error()
+		}
+		page.Heartbeats[i] = apiHeartbeat{
+			ID:          hb.ID,
+			Timestamp:   hb.Timestamp,
+			Successful:  hb.Error == nil,
+			Error:       errText,
+			LatencyMs:   durationMs(hb.Latency),
+			DNSMs:       durationMs(hb.Phases.DNS),
+			ConnectMs:   durationMs(hb.Phases.Connect),
+			TLSMs:       durationMs(hb.Phases.TLS),
+			FirstByteMs: durationMs(hb.Phases.FirstByte),
+		}
+	}
+	if len(heartbeats) == limit {
+		page.Next = strconv.FormatInt(heartbeats[len(heartbeats)-1].ID, 10)
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+type apiSample struct {
+	EntityID  string            `json:"entity_id"`
+	Timestamp time.Time         `json:"timestamp"`
+	Type      MetricType        `json:"type"`
+	Name      string            `json:"name"`
+	Value     float64           `json:"value"`
+	Labels    map[string]string `json:"labels"`
+}
+
+type apiSamplePage struct {
+	Samples []apiSample `json:"samples"`
+	// Pass as 'after' to get the next page, empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// Label filters are passed as repeated label=key=value parameters and match
+// sample labels or entity ID labels
+func (s *APIServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 {
+		writeError(w, http.StatusBadRequest, "'name' is required")
+		return
+	}
+
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	selector := make(map[string]string)
+	for _, label := range r.URL.Query()["label"] {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok || len(key) == 0 {
+			writeError(w, http.StatusBadRequest, "label filter '%s' should look like key=value", label)
+			return
+		}
+		selector[key] = value
+	}
+
+	limit, after, err := parsePage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	samples, err := s.metricsRepo.PageSamples(r.Context(), name, selector, from, to, after, limit)
+	if err != nil {
+		s.logger.Error("Could not list metrics", "name", name, "err", err)
+		writeError(w, http.StatusInternalServerError, "could not list metrics")
+		return
+	}
+
+	page := apiSamplePage{
+		Samples: make([]apiSample, len(samples)),
+	}
+	for i, sample := range samples {
+		page.Samples[i] = apiSample{
+			EntityID:  sample.ID.Canonical(),
+			Timestamp: sample.Timestamp,
+			Type:      sample.Type,
+			Name:      sample.Name,
+			Value:     sample.Value,
+			Labels:    sample.Labels,
+		}
+	}
+	if len(samples) == limit {
+		page.Next = strconv.FormatInt(samples[len(samples)-1].RowID, 10)
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// Takes the same window, from, to, instance and format options as the report
+// command
+func (s *APIServer) handleReport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	window := query.Get("window")
+	if len(window) == 0 {
+		window = defaultReportWindow
+	}
+
+	now := time.Now()
+	if raw := query.Get("to"); len(raw) > 0 {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid 'to': %s", err)
+			return
+		}
+		now = t
+	}
+
+	from, to, err := ParseReportWindow(window, now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if raw := query.Get("from"); len(raw) > 0 {
+		from, err = time.Parse(time.RFC3339, raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid 'from': %s", err)
+			return
+		}
+		to = now
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, "'from' should be before 'to'")
+		return
+	}
+
+	format := query.Get("format")
+	if len(format) == 0 {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		writeError(w, http.StatusBadRequest, "unknown format '%s', should be json or csv", format)
+		return
+	}
+
+	report, err := s.reports.Report(r.Context(), from, to, query.Get("instance"))
+	if err != nil {
+		s.logger.Error("Could not build report", "err", err)
+		writeError(w, http.StatusInternalServerError, "could not build report")
+		return
+	}
+
+	// Rendered up front so a failure can still be answered with an error
+	var buf bytes.Buffer
+	err = WriteUptimeReport(&buf, report, format)
+	if err != nil {
+		s.logger.Error("Could not write report", "format", format, "err", err)
+		writeError(w, http.StatusInternalServerError, "could not write report")
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		s.logger.Warn("Could not send report", "err", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"meerkat-v0/db"
+)
+
+func TestAPIReportFormats(t *testing.T) {
+	ctx := context.Background()
+	dbRead, dbWrite, err := openObservations(ctx, filepath.Join(t.TempDir(), "observations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbRead.Close()
+	defer dbWrite.Close()
+
+	readDB, writeDB := db.New(dbRead), db.New(dbWrite)
+	entityRepo := NewSqliteEntityRepo(readDB, dbWrite)
+	heartbeatRepo := NewSqliteHeartbeatRepo(readDB, writeDB, entityRepo)
+	api := NewAPIServer("", entityRepo, heartbeatRepo, nil, NewUptimeReporter(entityRepo, heartbeatRepo))
+
+	tests := []struct {
+		format      string
+		status      int
+		contentType string
+	}{
+		{"", http.StatusOK, "application/json"},
+		{"csv", http.StatusOK, "text/csv"},
+		{"xml", http.StatusBadRequest, "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			api.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/report?format="+tt.format, nil))
+			if rec.Code != tt.status {
+				t.Errorf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("expected content type %q, got %q", tt.contentType, got)
+			}
+			if rec.Body.Len() == 0 {
+				t.Errorf("expected a body")
+			}
+		})
+	}
+}
+
+func TestAPIMetricsPages(t *testing.T) {
+	ctx := context.Background()
+	dbRead, dbWrite, err := openObservations(ctx, filepath.Join(t.TempDir(), "observations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbRead.Close()
+	defer dbWrite.Close()
+
+	box1 := NewMonitorID("home", "host", "cpu", "box1")
+	box2 := NewMonitorID("home", "host", "cpu", "box2")
+	for _, id := range []string{box1.Canonical(), box2.Canonical()} {
+		_, err = dbWrite.ExecContext(ctx, "insert into entities (canonical_id) values (?)", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readDB, writeDB := db.New(dbRead), db.New(dbWrite)
+	entityRepo := NewSqliteEntityRepo(readDB, dbWrite)
+	metricsRepo := NewSqliteMetricsRepo(readDB, writeDB, entityRepo)
+	api := NewAPIServer("", entityRepo, nil, metricsRepo, nil)
+
+	now := time.Now()
+	samples := []MetricsSample{
+		{ID: box1, Name: "cpu_usage", Value: 1, Labels: map[string]string{"cpu": "0"}},
+		{ID: box1, Name: "cpu_usage", Value: 2, Labels: map[string]string{"cpu": "1"}},
+		{ID: box2, Name: "cpu_usage", Value: 3, Labels: map[string]string{"cpu": "0"}},
+		// The sample label hides the entity ID label
+		{ID: box2, Name: "cpu_usage", Value: 4, Labels: map[string]string{"cpu": "0", "name": "override"}},
+		{ID: box1, Name: "load_1", Value: 5, Labels: map[string]string{}},
+	}
+	for i, sample := range samples {
+		sample.Type = MetricGauge
+		sample.Timestamp = now.Add(time.Duration(i-len(samples)) * time.Second)
+		err := metricsRepo.InsertSample(ctx, sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		labels []string
+		want   []float64
+	}{
+		{name: "everything", want: []float64{1, 2, 3, 4}},
+		{name: "sample label", labels: []string{"cpu=0"}, want: []float64{1, 3, 4}},
+		{name: "entity ID label", labels: []string{"name=box2"}, want: []float64{3}},
+		{name: "sample label over entity ID", labels: []string{"name=override"}, want: []float64{4}},
+		{name: "both", labels: []string{"cpu=0", "name=box1"}, want: []float64{1}},
+		{name: "kind is not a label", labels: []string{"kind=monitor"}},
+		{name: "unknown label", labels: []string{"disk=sda"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Pages of two until there's no next one
+			var got []float64
+			var after string
+			for range len(samples) {
+				query := url.Values{"name": {"cpu_usage"}, "label": tt.labels, "limit": {"2"}, "after": {after}}
+				rec := httptest.NewRecorder()
+				api.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/metrics?"+query.Encode(), nil))
+				if rec.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+				}
+
+				var page apiSamplePage
+				err := json.Unmarshal(rec.Body.Bytes(), &page)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, sample := range page.Samples {
+					got = append(got, sample.Value)
+				}
+				if len(page.Next) == 0 {
+					break
+				}
+				after = page.Next
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+)
+
+func runCheck(args []string) error {
+	flags := flag.NewFlagSet("meerkat check", flag.ContinueOnError)
+	dbPath := flags.String("db", "observations.db", "database of a running meerkat to plan against, skipped when it doesn't exist")
+	format := flags.String("format", "text", "how problems are printed, text or json")
+	configFormat := flags.String("config-format", "", "json, yaml or toml, guessed from the config extension when empty")
+	printResolved := flags.Bool("print", false, "print the instances as JSON with defaults and templates merged into their entities")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "./meerkat check [flags] [config file or directory]")
+		fmt.Fprintln(os.Stderr, "Validates the config without starting anything and prints what loading it would change")
+		flags.PrintDefaults()
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return fmt.Errorf("not enough arguments")
+	}
+
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown format '%s', should be text or json", *format)
+	}
+
+	cfgFormat, err := ParseConfigFormat(*configFormat)
+	if err != nil {
+		return err
+	}
+
+	configPath := flags.Arg(0)
+	set, err := ReadConfigSet(configPath, cfgFormat)
+	if err != nil {
+		return printConfigErrors(err, configPath, *format)
+	}
+
+	ctx := context.Background()
+
+	var conn *sql.DB
+	_, err = os.Stat(*dbPath)
+	running := err == nil
+	if running {
+		// Checking only reads, the running meerkat migrates its own database
+		conn, err = connectSqliteDbReadOnly(*dbPath)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+	} else {
+		// Nothing runs yet, so the config is only validated
+		conn, err = connectSqliteDb(":memory:")
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetMaxOpenConns(1)
+
+		_, err = conn.ExecContext(ctx, ddl)
+		if err != nil {
+			return err
+		}
+	}
+
+	meerkat := newApp(conn, conn).meerkat
+	if running {
+		err = meerkat.LoadSaved(ctx)
+		if err != nil {
+			return fmt.Errorf("reading the saved config from '%s': %w", *dbPath, err)
+		}
+	}
+
+	plan, err := meerkat.Plan(set)
+	if err != nil {
+		return printConfigErrors(err, configPath, *format)
+	}
+
+	if *printResolved {
+		return printInstances(os.Stdout, plan)
+	}
+
+	fmt.Printf("%s is valid\n", configPath)
+	if running {
+		printPlan(os.Stdout, plan)
+	}
+	return nil
+}
+
+func printInstances(w io.Writer, plan *ConfigPlan) error {
+	instances := make([]InstanceConfig, 0, len(plan.Instances))
+	for _, name := range slices.Sorted(maps.Keys(plan.Instances)) {
+		instances = append(instances, plan.Instances[name].Config)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(instances)
+}
+
+// Prints the problems of config errors in the format and returns an error
+// with their count, other errors are returned as they are
+func printConfigErrors(err error, configPath string, format string) error {
+	var cfgErrs *ConfigErrors
+	if !errors.As(err, &cfgErrs) {
+		return err
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		err = enc.Encode(cfgErrs.Tree())
+		if err != nil {
+			return err
+		}
+	} else {
+		cfgErrs.Tree().WriteText(os.Stderr, "  ")
+	}
+	return fmt.Errorf("found %d problems in '%s'", cfgErrs.Len(), configPath)
+}
+
+func printPlan(w io.Writer, plan *ConfigPlan) {
+	for _, name := range slices.Sorted(maps.Keys(plan.Entities)) {
+		diff := plan.Entities[name].Diff
+		fmt.Fprintf(w, "\n%s:\n", name)
+		for _, id := range diff.Add {
+			fmt.Fprintf(w, "  + %s\n", id)
+		}
+		for _, id := range diff.Update {
+			fmt.Fprintf(w, "  ~ %s\n", id)
+		}
+		for _, id := range diff.Delete {
+			fmt.Fprintf(w, "  - %s\n", id)
+		}
+		fmt.Fprintf(w, "  %d unchanged\n", len(diff.Unchanged))
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const validCheckConfig = `{
+  "name": "home",
+  "services": [
+    {
+      "name": "web",
+      "defaults": {"interval": 60},
+      "monitor": [
+        {"type": "tcp", "name": "ssh", "hostname": "localhost", "port": "22"}
+      ]
+    }
+  ]
+}`
+
+const invalidCheckConfig = `{
+  "name": "home",
+  "services": [
+    {
+      "name": "web",
+      "monitor": [
+        {"type": "tcp", "name": "ssh", "hostname": "localhost", "port": "22"},
+        {"type": "tcp", "name": "db", "interval": 60, "hostname": "localhost", "port": "70000"}
+      ]
+    }
+  ]
+}`
+
+// Runs main with the arguments in MEERKAT_TEST_ARGS, separated by new
+// lines, when it's set. Commands are run in a subprocess like this so their
+// exit status and output can be checked
+func TestMeerkatMain(t *testing.T) {
+	args := os.Getenv("MEERKAT_TEST_ARGS")
+	if len(args) == 0 {
+		t.Skip("only runs as a subprocess of command tests")
+	}
+	os.Args = append([]string{"meerkat"}, strings.Split(args, "\n")...)
+	main()
+	os.Exit(0)
+}
+
+// Runs meerkat with args in dir and returns its exit code, stdout and stderr
+func runMeerkat(t *testing.T, dir string, args ...string) (int, string, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMeerkatMain$")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "MEERKAT_TEST_ARGS="+strings.Join(args, "\n"))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), stdout.String(), stderr.String()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return 0, stdout.String(), stderr.String()
+}
+
+func TestCheckCommand(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{"valid.json": validCheckConfig, "invalid.json": invalidCheckConfig} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		code, stdout, stderr := runMeerkat(t, dir, "check", "valid.json")
+		if code != 0 {
+			t.Fatalf("expected exit status 0, got %d: %s", code, stderr)
+		}
+		if stdout != "valid.json is valid\n" || len(stderr) > 0 {
+			t.Errorf("unexpected output, stdout %q, stderr %q", stdout, stderr)
+		}
+		// The database is only read when it exists
+		if _, err := os.Stat(filepath.Join(dir, "observations.db")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected no database to be created, got %v", err)
+		}
+	})
+
+	t.Run("valid with the json format", func(t *testing.T) {
+		code, stdout, stderr := runMeerkat(t, dir, "check", "-format", "json", "valid.json")
+		if code != 0 || stdout != "valid.json is valid\n" || len(stderr) > 0 {
+			t.Errorf("unexpected result, exit status %d, stdout %q, stderr %q", code, stdout, stderr)
+		}
+	})
+
+	t.Run("print", func(t *testing.T) {
+		code, stdout, stderr := runMeerkat(t, dir, "check", "-print", "valid.json")
+		if code != 0 {
+			t.Fatalf("expected exit status 0, got %d: %s", code, stderr)
+		}
+
+		var instances []struct {
+			Name     string `json:"name"`
+			Services []struct {
+				Monitor []map[string]any `json:"monitor"`
+			} `json:"services"`
+		}
+		err := json.Unmarshal([]byte(stdout), &instances)
+		if err != nil {
+			t.Fatalf("expected instances as json on stdout, got %q: %v", stdout, err)
+		}
+		if len(instances) != 1 || instances[0].Services[0].Monitor[0]["interval"] != 60.0 {
+			t.Errorf("expected the defaults to be merged, got %s", stdout)
+		}
+	})
+
+	t.Run("invalid as text", func(t *testing.T) {
+		code, stdout, stderr := runMeerkat(t, dir, "check", "invalid.json")
+		if code != 1 {
+			t.Fatalf("expected exit status 1, got %d", code)
+		}
+		if len(stdout) > 0 {
+			t.Errorf("expected nothing on stdout, got %q", stdout)
+		}
+		for _, want := range []string{
+			"home (invalid.json:1):\n",
+			"    db (invalid.json:8):\n      port: ",
+			"    ssh (invalid.json:7):\n      interval: ",
+			"error: found 2 problems in 'invalid.json'\n",
+		} {
+			if !strings.Contains(stderr, want) {
+				t.Errorf("expected %q on stderr, got:\n%s", want, stderr)
+			}
+		}
+	})
+
+	t.Run("invalid as json", func(t *testing.T) {
+		code, stdout, stderr := runMeerkat(t, dir, "check", "-format", "json", "invalid.json")
+		if code != 1 {
+			t.Fatalf("expected exit status 1, got %d", code)
+		}
+		if stderr != "error: found 2 problems in 'invalid.json'\n" {
+			t.Errorf("expected only the error on stderr, got %q", stderr)
+		}
+
+		var tree ErrorTree
+		err := json.Unmarshal([]byte(stdout), &tree)
+		if err != nil {
+			t.Fatalf("expected the problems as json on stdout, got %q: %v", stdout, err)
+		}
+		web := tree.Children["home"].Children["web"]
+		if web == nil {
+			t.Fatalf("expected problems of the web service, got %s", stdout)
+		}
+		for name, want := range map[string]struct{ location, field string }{
+			"ssh": {"invalid.json:7", "interval"},
+			"db":  {"invalid.json:8", "port"},
+		} {
+			node := web.Children[name]
+			if node == nil || node.Location != want.location {
+				t.Errorf("expected the problems of %s at %s, got %s", name, want.location, stdout)
+				continue
+			}
+			if _, ok := node.Problems[want.field]; !ok {
+				t.Errorf("expected a %s problem of %s, got %v", want.field, name, node.Problems)
+			}
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		code, stdout, stderr := runMeerkat(t, dir, "check", "-format", "xml", "valid.json")
+		if code != 1 || len(stdout) > 0 || !strings.Contains(stderr, "unknown format 'xml'") {
+			t.Errorf("unexpected result, exit status %d, stdout %q, stderr %q", code, stdout, stderr)
+		}
+	})
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type ConfigFormat string
+
+const (
+	ConfigJSON ConfigFormat = "json"
+	ConfigYAML ConfigFormat = "yaml"
+	ConfigTOML ConfigFormat = "toml"
+)
+
+// Accepts an empty string for formats guessed from the file extension
+func ParseConfigFormat(format string) (ConfigFormat, error) {
+	switch format {
+	case "", "json", "yaml", "toml":
+		return ConfigFormat(format), nil
+	case "yml":
+		return ConfigYAML, nil
+	}
+	return "", fmt.Errorf("unknown config format '%s', should be json, yaml or toml", format)
+}
+
+// Guesses the format from the file extension, JSON when it's not known
+func ConfigFormatOf(path string) ConfigFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return ConfigYAML
+	case ".toml":
+		return ConfigTOML
+	}
+	return ConfigJSON
+}
+
+// A config file normalised to JSON, which is what everything else decodes,
+// along with where its parts are defined in the file
+type ConfigSource struct {
+	Path   string
+	Format ConfigFormat
+	JSON   []byte
+	// Keys of config error paths, like home.web.keep, to their line in the
+	// file
+	lines map[string]int
+}
+
+// Reads the config at path, the format is guessed from the extension when
+// it's empty
+func ReadConfig(path string, format ConfigFormat) (*ConfigSource, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(format) == 0 {
+		format = ConfigFormatOf(path)
+	}
+	return ParseConfig(path, format, contents)
+}
+
+func ParseConfig(path string, format ConfigFormat, contents []byte) (*ConfigSource, error) {
+	src := &ConfigSource{
+		Path:   path,
+		Format: format,
+		lines:  make(map[string]int),
+	}
+
+	var value any
+	var lines map[string]int
+	switch format {
+	case ConfigJSON:
+		var err error
+		lines, err = jsonLines(contents)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		src.JSON = contents
+	case ConfigYAML:
+		var doc yaml.Node
+		err := yaml.Unmarshal(contents, &doc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		err = doc.Decode(&value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		value = normaliseYAML(value)
+		lines = make(map[string]int)
+		yamlLines(&doc, "", 1, lines)
+	case ConfigTOML:
+		var table map[string]any
+		_, err := toml.Decode(string(contents), &table)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		value = table
+		lines = make(map[string]int)
+		textLines := strings.Split(string(contents), "\n")
+		tomlLines(textLines, table, "", nil, 1, len(textLines)+1, lines)
+	default:
+		return nil, fmt.Errorf("unknown config format '%s'", format)
+	}
+
+	if src.JSON == nil {
+		var err error
+		src.JSON, err = json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	// Decoded back, so every format is indexed with the same types
+	var root map[string]any
+	err := json.Unmarshal(src.JSON, &root)
+	if err != nil {
+		return nil, fmt.Errorf("%s: config should be an object", path)
+	}
+	// Files adding services to an instance defined elsewhere are indexed as
+	// that instance
+	name, _ := root["name"].(string)
+	if len(name) == 0 {
+		name, _ = root["instance"].(string)
+	}
+	var rootPath ConfigPath
+	if len(name) > 0 {
+		rootPath = NewConfigPath(name)
+	}
+	src.addLine(rootPath, lines[""])
+	src.index(root, "", rootPath, lines)
+
+	return src, nil
+}
+
+func (s *ConfigSource) Locate(path ConfigPath) (string, bool) {
+	line, ok := s.lines[path.key()]
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%s:%d", s.Path, line), true
+}
+
+func (s *ConfigSource) addLine(path ConfigPath, line int) {
+	if line <= 0 {
+		return
+	}
+	key := path.key()
+	if _, exists := s.lines[key]; !exists {
+		s.lines[key] = line
+	}
+}
+
+// Registers the lines of every object in obj under the paths config errors
+// use for them. Named objects are known by their name, like "home.web.keep",
+// and by the key they are in, like "home.alerts.high_load", the rest by their
+// index
+func (s *ConfigSource) index(obj map[string]any, jsonPath string, path ConfigPath, lines map[string]int) {
+	for _, key := range slices.Sorted(maps.Keys(obj)) {
+		keyJSONPath := joinJSONPath(jsonPath, key)
+		keyPath := path.Child(key)
+		switch value := obj[key].(type) {
+		case map[string]any:
+			s.addLine(keyPath, lines[keyJSONPath])
+			s.index(value, keyJSONPath, keyPath, lines)
+		case []any:
+			s.addLine(keyPath, lines[keyJSONPath])
+			for i, item := range value {
+				itemObj, ok := item.(map[string]any)
+				if !ok {
+					continue
+				}
+				itemJSONPath := fmt.Sprintf("%s[%d]", keyJSONPath, i)
+				line := lines[itemJSONPath]
+				itemPath := keyPath.WithIndex(i)
+				s.addLine(itemPath, line)
+				s.addLine(path.WithIndex(i), line)
+				if name, ok := itemObj["name"].(string); ok && len(name) > 0 {
+					itemPath = path.Child(name)
+					s.addLine(itemPath, line)
+					s.addLine(keyPath.Child(name), line)
+				}
+				s.index(itemObj, itemJSONPath, itemPath, lines)
+			}
+		}
+	}
+}
+
+func joinJSONPath(path, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+func lineAt(contents []byte, offset int64) int {
+	offset = min(offset, int64(len(contents)))
+	return bytes.Count(contents[:offset], []byte("\n")) + 1
+}
+
+// Returns the line of every object and array in a JSON document, keyed by
+// paths like "services[0].monitor"
+func jsonLines(contents []byte) (map[string]int, error) {
+	lines := make(map[string]int)
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	err := walkJSON(dec, contents, "", lines)
+	if err == nil {
+		_, err = dec.Token()
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err == nil {
+			err = errors.New("unexpected data after the config")
+		}
+	}
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return nil, fmt.Errorf("line %d: %w", lineAt(contents, syntaxErr.Offset), err)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, fmt.Errorf("line %d: %w", lineAt(contents, dec.InputOffset()), err)
+}
+
+func walkJSON(dec *json.Decoder, contents []byte, path string, lines map[string]int) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return nil
+	}
+	lines[path] = lineAt(contents, dec.InputOffset())
+
+	switch delim {
+	case '{':
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			err = walkJSON(dec, contents, joinJSONPath(path, tok.(string)), lines)
+			if err != nil {
+				return err
+			}
+		}
+	case '[':
+		for i := 0; dec.More(); i++ {
+			err := walkJSON(dec, contents, fmt.Sprintf("%s[%d]", path, i), lines)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// The closing delimiter
+	_, err = dec.Token()
+	return err
+}
+
+// Same as jsonLines, mappings under a key start at the key
+func yamlLines(node *yaml.Node, path string, line int, lines map[string]int) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			yamlLines(child, path, child.Line, lines)
+		}
+	case yaml.MappingNode:
+		lines[path] = line
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			yamlLines(value, joinJSONPath(path, key.Value), key.Line, lines)
+		}
+	case yaml.SequenceNode:
+		lines[path] = line
+		for i, child := range node.Content {
+			yamlLines(child, fmt.Sprintf("%s[%d]", path, i), child.Line, lines)
+		}
+	case yaml.AliasNode:
+		lines[path] = line
+	}
+}
+
+// TOML doesn't keep positions of keys, so tables are found by their header,
+// looked for between the line of the table they are in and its end. Inline
+// tables are found by the line defining their name. Items of an array end
+// where the next one starts, so a search never runs into a sibling
+func tomlLines(textLines []string, table map[string]any, path string, keys []string, line int, end int, lines map[string]int) {
+	if len(path) == 0 {
+		lines[path] = line
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(table)) {
+		keyPath := joinJSONPath(path, key)
+		keyKeys := append(slices.Clone(keys), key)
+		switch value := table[key].(type) {
+		case map[string]any:
+			keyLine, ok := findTOMLLine(textLines, line, end, tomlHeaderRegex(keyKeys, false), 0)
+			if !ok {
+				keyLine, ok = findTOMLName(textLines, line, end, value)
+			}
+			if ok {
+				lines[keyPath] = keyLine
+			} else {
+				keyLine = line
+			}
+			tomlLines(textLines, value, keyPath, keyKeys, keyLine, end, lines)
+		case []map[string]any, []any:
+			items := tomlTables(value)
+			itemLines := make([]int, len(items))
+			from := line
+			for i, item := range items {
+				if item == nil {
+					itemLines[i] = line
+					continue
+				}
+				itemLine, ok := findTOMLLine(textLines, line, end, tomlHeaderRegex(keyKeys, true), i)
+				if !ok {
+					itemLine, ok = findTOMLName(textLines, from, end, item)
+				}
+				if ok {
+					lines[fmt.Sprintf("%s[%d]", keyPath, i)] = itemLine
+					from = itemLine + 1
+				} else {
+					itemLine = line
+				}
+				itemLines[i] = itemLine
+			}
+
+			for i, item := range items {
+				if item == nil {
+					continue
+				}
+				itemEnd := end
+				if i+1 < len(items) && itemLines[i+1] > itemLines[i] {
+					itemEnd = itemLines[i+1]
+				}
+				tomlLines(textLines, item, fmt.Sprintf("%s[%d]", keyPath, i), keyKeys, itemLines[i], itemEnd, lines)
+			}
+		}
+	}
+}
+
+// Arrays of tables decode as []map[string]any, inline ones as []any. Items
+// that aren't tables are nil
+func tomlTables(value any) []map[string]any {
+	switch value := value.(type) {
+	case []map[string]any:
+		return value
+	case []any:
+		tables := make([]map[string]any, len(value))
+		for i, item := range value {
+			tables[i], _ = item.(map[string]any)
+		}
+		return tables
+	}
+	return nil
+}
+
+func tomlHeaderRegex(keys []string, array bool) *regexp.Regexp {
+	quoted := make([]string, len(keys))
+	for i, key := range keys {
+		quoted[i] = `["']?` + regexp.QuoteMeta(key) + `["']?`
+	}
+	header := strings.Join(quoted, `\s*\.\s*`)
+	if array {
+		return regexp.MustCompile(`^\s*\[\[\s*` + header + `\s*\]\]`)
+	}
+	return regexp.MustCompile(`^\s*\[\s*` + header + `\s*\]`)
+}
+
+func findTOMLName(textLines []string, from int, to int, table map[string]any) (int, bool) {
+	name, ok := table["name"].(string)
+	if !ok {
+		return 0, false
+	}
+	nameRegex := regexp.MustCompile(`(^|[\s{,])name\s*=\s*["']` + regexp.QuoteMeta(name) + `["']`)
+	return findTOMLLine(textLines, from, to, nameRegex, 0)
+}
+
+// Returns the line of the nth match in the lines [from, to)
+func findTOMLLine(textLines []string, from int, to int, regex *regexp.Regexp, nth int) (int, bool) {
+	for i := from - 1; i < min(to-1, len(textLines)); i++ {
+		if !regex.MatchString(textLines[i]) {
+			continue
+		}
+		if nth == 0 {
+			return i + 1, true
+		}
+		nth--
+	}
+	return 0, false
+}
+
+// YAML allows keys that aren't strings, JSON doesn't
+func normaliseYAML(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, item := range value {
+			value[key] = normaliseYAML(item)
+		}
+	case map[any]any:
+		obj := make(map[string]any, len(value))
+		for key, item := range value {
+			obj[fmt.Sprint(key)] = normaliseYAML(item)
+		}
+		return obj
+	case []any:
+		for i, item := range value {
+			value[i] = normaliseYAML(item)
+		}
+	}
+	return value
+}
+
+// What a config file can define. A file with a name is an instance itself,
+// the rest can list instances, add services to an instance defined in
+// another file, or only include other files
+type ConfigFile struct {
+	// Globs of more config files, relative to the file
+	Include   []string          `json:"include"`
+	Name      string            `json:"name"`
+	Instances []json.RawMessage `json:"instances"`
+	// Instance the services are added to
+	Instance string            `json:"instance"`
+	Services []json.RawMessage `json:"services"`
+}
+
+// Config files read from a file or a directory with their includes followed,
+// merged into instances
+type ConfigSet struct {
+	Path      string
+	Sources   []*ConfigSource
+	Instances []InstanceConfig
+	// Every file read or tried to be read, to watch for changes
+	Files []string
+}
+
+// Reads the config file at path, or every config file in the directory at
+// path, and the files they include. format is only used for path itself,
+// the rest are guessed from their extension. The set is returned even when
+// reading fails, for the files it tried to read
+func ReadConfigSet(path string, format ConfigFormat) (*ConfigSet, error) {
+	set := &ConfigSet{Path: path}
+	loader := &configLoader{
+		set:  set,
+		seen: make(map[string]struct{}),
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return set, err
+	}
+	if info.IsDir() {
+		loader.loadDir(path)
+		if len(loader.errs) == 0 && len(set.Sources) == 0 {
+			return set, fmt.Errorf("no config files found in '%s'", path)
+		}
+	} else {
+		loader.load(path, format)
+	}
+
+	if len(loader.errs) == 0 {
+		loader.merge()
+	}
+	if len(loader.errs) > 0 {
+		return set, NewConfigErrors(set, loader.errs...)
+	}
+	return set, nil
+}
+
+// Looks in every file, in the order they were read
+func (s *ConfigSet) Locate(path ConfigPath) (string, bool) {
+	for _, src := range s.Sources {
+		location, ok := src.Locate(path)
+		if ok {
+			return location, true
+		}
+	}
+	return "", false
+}
+
+type configLoader struct {
+	set   *ConfigSet
+	seen  map[string]struct{}
+	files []ConfigFile
+	errs  []error
+}
+
+func isConfigFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".yaml", ".yml", ".toml":
+		return true
+	}
+	return false
+}
+
+// Loads the config files directly in dir, sorted by name
+func (l *configLoader) loadDir(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		l.errs = append(l.errs, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !isConfigFile(entry.Name()) {
+			continue
+		}
+		l.load(filepath.Join(dir, entry.Name()), "")
+	}
+}
+
+func (l *configLoader) load(path string, format ConfigFormat) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		l.errs = append(l.errs, err)
+		return
+	}
+	if _, ok := l.seen[abs]; ok {
+		return
+	}
+	l.seen[abs] = struct{}{}
+	l.set.Files = append(l.set.Files, path)
+
+	src, err := ReadConfig(path, format)
+	if err != nil {
+		l.errs = append(l.errs, err)
+		return
+	}
+
+	var file ConfigFile
+	err = json.Unmarshal(src.JSON, &file)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %w", path, err))
+		return
+	}
+	l.set.Sources = append(l.set.Sources, src)
+	l.files = append(l.files, file)
+
+	for _, pattern := range file.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			l.errs = append(l.errs, fmt.Errorf("%s: include '%s': %w", path, pattern, err))
+			continue
+		}
+
+		found := false
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				l.errs = append(l.errs, err)
+				continue
+			}
+			if info.IsDir() {
+				found = true
+				l.loadDir(match)
+			} else if isConfigFile(match) {
+				found = true
+				l.load(match, "")
+			}
+		}
+		if !found {
+			l.errs = append(l.errs, fmt.Errorf("%s: include '%s' matches no config files", path, pattern))
+		}
+	}
+}
+
+// Collects the instances of every file, then adds the services of files that
+// only add services to them
+func (l *configLoader) merge() {
+	instances := make(map[string]int)
+	instanceLocations := make(map[string]string)
+	// Instance and service name to where the service is defined
+	serviceLocations := make(map[[2]string]string)
+
+	addServices := func(src *ConfigSource, instance string, rawServices []json.RawMessage, ownServices bool) {
+		for _, raw := range rawServices {
+			var service ServiceConfig
+			// Services without a name are reported when planning
+			if json.Unmarshal(raw, &service) == nil && len(service.Name) > 0 {
+				key := [2]string{instance, service.Name}
+				location, _ := src.Locate(NewConfigPath(instance, service.Name))
+				first, exists := serviceLocations[key]
+				// Duplicates within an instance are reported when planning too
+				if exists && !ownServices {
+					err := NewDuplicateFoundError(instance, service.Name)
+					err.Locations = []string{first, location}
+					l.errs = append(l.errs, err)
+					continue
+				}
+				if !exists {
+					serviceLocations[key] = location
+				}
+			}
+
+			if !ownServices {
+				cfg := &l.set.Instances[instances[instance]]
+				cfg.Services = append(cfg.Services, raw)
+			}
+		}
+	}
+
+	addInstance := func(src *ConfigSource, raw json.RawMessage, path string) {
+		var cfg InstanceConfig
+		err := json.Unmarshal(raw, &cfg)
+		if err != nil {
+			l.errs = append(l.errs, fmt.Errorf("%s: %s: %w", src.Path, path, err))
+			return
+		}
+
+		location, _ := src.Locate(NewConfigPath(cfg.Name))
+		if _, exists := instances[cfg.Name]; exists {
+			err := NewDuplicateFoundError(cfg.Name)
+			err.Locations = []string{instanceLocations[cfg.Name], location}
+			l.errs = append(l.errs, err)
+			return
+		}
+
+		instances[cfg.Name] = len(l.set.Instances)
+		instanceLocations[cfg.Name] = location
+		l.set.Instances = append(l.set.Instances, cfg)
+		addServices(src, cfg.Name, cfg.Services, true)
+	}
+
+	for i, file := range l.files {
+		src := l.set.Sources[i]
+		if len(file.Name) > 0 {
+			if len(file.Instances) > 0 || len(file.Instance) > 0 {
+				l.errs = append(l.errs, fmt.Errorf("%s: a file with a name is an instance, it can't have 'instances' or 'instance'", src.Path))
+				continue
+			}
+			addInstance(src, src.JSON, "instance")
+			continue
+		}
+
+		for j, raw := range file.Instances {
+			var cfg InstanceConfig
+			err := json.Unmarshal(raw, &cfg)
+			if err == nil && len(cfg.Name) == 0 {
+				err := NewNoNameError("instances")
+				err.SetIndex(j)
+				l.errs = append(l.errs, err)
+				continue
+			}
+			addInstance(src, raw, fmt.Sprintf("instances[%d]", j))
+		}
+	}
+
+	for i, file := range l.files {
+		src := l.set.Sources[i]
+		if len(file.Name) > 0 {
+			continue
+		}
+
+		if len(file.Services) > 0 && len(file.Instance) == 0 {
+			l.errs = append(l.errs, fmt.Errorf("%s: services need the 'instance' they are added to", src.Path))
+			continue
+		}
+		if len(file.Instance) == 0 {
+			continue
+		}
+		if _, exists := instances[file.Instance]; !exists {
+			l.errs = append(l.errs, fmt.Errorf("%s: instance '%s' isn't defined in any config file", src.Path, file.Instance))
+			continue
+		}
+		addServices(src, file.Instance, file.Services, false)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestConfigLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   ConfigFormat
+		contents string
+		// Location of the service and entity paths
+		want map[string]string
+	}{
+		{
+			name:   "yaml",
+			format: ConfigYAML,
+			contents: `name: home
+services:
+  - name: web
+    monitor:
+      - name: site
+        type: http
+        url: ftp://example.com
+  - name: db
+    labels:
+      1: one
+    monitor:
+      - {name: primary, type: tcp}
+      - name: site
+        type: tcp
+        port: "0"
+`,
+			want: map[string]string{
+				"web":        "home.yaml:3",
+				"web.site":   "home.yaml:5",
+				"db":         "home.yaml:8",
+				"db.primary": "home.yaml:12",
+				"db.site":    "home.yaml:13",
+				"db.labels":  "home.yaml:9",
+			},
+		},
+		{
+			// The first service lists its monitors inline, so the headers
+			// of the second one's have to be skipped
+			name:   "toml",
+			format: ConfigTOML,
+			contents: `name = "home"
+
+[[services]]
+name = "web"
+monitor = [
+  { name = "site", type = "http", url = "ftp://example.com" },
+]
+
+[[services]]
+name = "db"
+
+[services.labels]
+1 = "one"
+
+[[services.monitor]]
+name = "primary"
+type = "tcp"
+
+[[services.monitor]]
+name = "site"
+type = "tcp"
+port = "0"
+`,
+			want: map[string]string{
+				"web":        "home.toml:3",
+				"web.site":   "home.toml:6",
+				"db":         "home.toml:9",
+				"db.labels":  "home.toml:12",
+				"db.primary": "home.toml:15",
+				"db.site":    "home.toml:19",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := ParseConfig("home."+string(tt.format), tt.format, []byte(tt.contents))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(src.JSON), `"labels":{"1":"one"}`) {
+				t.Errorf("expected keys to become strings, got %s", src.JSON)
+			}
+
+			for path, want := range tt.want {
+				names := append([]string{"home"}, strings.Split(path, ".")...)
+				errs := NewConfigErrors(src, NewValidationError(map[string]string{"port": "bad"}, names...))
+				var cfgErrs *ConfigErrors
+				if !errors.As(errs, &cfgErrs) {
+					t.Fatalf("expected config errors, got %v", errs)
+				}
+
+				node := cfgErrs.Tree()
+				for _, name := range names {
+					node = node.Children[name]
+					if node == nil {
+						t.Fatalf("%s: missing node %s", path, name)
+					}
+				}
+				if node.Location != want {
+					t.Errorf("%s: expected location %s, got %s", path, want, node.Location)
+				}
+			}
+		})
+	}
+}
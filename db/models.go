@@ -15,12 +15,23 @@ type Entity struct {
 	CanonicalID string
 }
 
+type EntityConfig struct {
+	EntityID int64
+	Kind     string
+	Config   string
+}
+
 type Heartbeat struct {
-	ID         int64
-	EntityID   int64
-	Ts         time.Time
-	Successful bool
-	Error      sql.NullString
+	ID          int64
+	EntityID    int64
+	Ts          time.Time
+	Successful  bool
+	Error       sql.NullString
+	LatencyUs   sql.NullInt64
+	DnsUs       sql.NullInt64
+	ConnectUs   sql.NullInt64
+	TlsUs       sql.NullInt64
+	FirstByteUs sql.NullInt64
 }
 
 type Metric struct {
@@ -32,3 +43,24 @@ type Metric struct {
 	Value    float64
 	Labels   json.RawMessage
 }
+
+type NotificationDelivery struct {
+	ID         int64
+	EntityID   int64
+	Notifier   string
+	Ts         time.Time
+	Event      string
+	Attempt    int64
+	Successful bool
+	StatusCode sql.NullInt64
+	Error      sql.NullString
+}
+
+type StateChange struct {
+	ID        int64
+	EntityID  int64
+	Ts        time.Time
+	FromState string
+	ToState   string
+	Error     sql.NullString
+}
@@ -12,6 +12,85 @@ import (
 	"time"
 )
 
+const countHeartbeats = `-- name: CountHeartbeats :one
+select count(*) as total, cast(coalesce(sum(successful), 0) as integer) as successful from heartbeat
+ where entity_id = ?1
+   and ts >= ?2
+   and ts < ?3
+`
+
+type CountHeartbeatsParams struct {
+	EntityID int64
+	FromTs   time.Time
+	ToTs     time.Time
+}
+
+type CountHeartbeatsRow struct {
+	Total      int64
+	Successful int64
+}
+
+func (q *Queries) CountHeartbeats(ctx context.Context, arg CountHeartbeatsParams) (CountHeartbeatsRow, error) {
+	row := q.db.QueryRowContext(ctx, countHeartbeats, arg.EntityID, arg.FromTs, arg.ToTs)
+	var i CountHeartbeatsRow
+	err := row.Scan(&i.Total, &i.Successful)
+	return i, err
+}
+
+const countHeartbeatsPerQuarterHour = `-- name: CountHeartbeatsPerQuarterHour :many
+select cast(unixepoch(ts) / 900 as integer) as quarter_hour, count(*) as total, cast(coalesce(sum(successful), 0) as integer) as successful from heartbeat
+ where entity_id = ?1
+   and ts >= ?2
+   and ts < ?3
+ group by quarter_hour
+ order by quarter_hour
+`
+
+type CountHeartbeatsPerQuarterHourParams struct {
+	EntityID int64
+	FromTs   time.Time
+	ToTs     time.Time
+}
+
+type CountHeartbeatsPerQuarterHourRow struct {
+	QuarterHour int64
+	Total       int64
+	Successful  int64
+}
+
+func (q *Queries) CountHeartbeatsPerQuarterHour(ctx context.Context, arg CountHeartbeatsPerQuarterHourParams) ([]CountHeartbeatsPerQuarterHourRow, error) {
+	rows, err := q.db.QueryContext(ctx, countHeartbeatsPerQuarterHour, arg.EntityID, arg.FromTs, arg.ToTs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CountHeartbeatsPerQuarterHourRow
+	for rows.Next() {
+		var i CountHeartbeatsPerQuarterHourRow
+		if err := rows.Scan(&i.QuarterHour, &i.Total, &i.Successful); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const deleteEntityConfigs = `-- name: DeleteEntityConfigs :exec
+delete from entity_configs
+ where kind = ?
+`
+
+func (q *Queries) DeleteEntityConfigs(ctx context.Context, kind string) error {
+	_, err := q.db.ExecContext(ctx, deleteEntityConfigs, kind)
+	return err
+}
+
 const getCanonicalID = `-- name: GetCanonicalID :one
 select canonical_id from entities
  where id = ?
@@ -36,6 +115,60 @@ func (q *Queries) GetEntityID(ctx context.Context, canonicalID string) (int64, e
 	return id, err
 }
 
+const getLatestStateChange = `-- name: GetLatestStateChange :one
+select id, entity_id, ts, from_state, to_state, error from state_changes
+ where entity_id = ?
+ order by ts desc
+ limit 1
+`
+
+func (q *Queries) GetLatestStateChange(ctx context.Context, entityID int64) (StateChange, error) {
+	row := q.db.QueryRowContext(ctx, getLatestStateChange, entityID)
+	var i StateChange
+	err := row.Scan(
+		&i.ID,
+		&i.EntityID,
+		&i.Ts,
+		&i.FromState,
+		&i.ToState,
+		&i.Error,
+	)
+	return i, err
+}
+
+const insertDelivery = `-- name: InsertDelivery :one
+insert into notification_deliveries(entity_id, notifier, ts, event, attempt, successful, status_code, error)
+values (?, ?, ?, ?, ?, ?, ?, ?)
+returning id
+`
+
+type InsertDeliveryParams struct {
+	EntityID   int64
+	Notifier   string
+	Ts         time.Time
+	Event      string
+	Attempt    int64
+	Successful bool
+	StatusCode sql.NullInt64
+	Error      sql.NullString
+}
+
+func (q *Queries) InsertDelivery(ctx context.Context, arg InsertDeliveryParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, insertDelivery,
+		arg.EntityID,
+		arg.Notifier,
+		arg.Ts,
+		arg.Event,
+		arg.Attempt,
+		arg.Successful,
+		arg.StatusCode,
+		arg.Error,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
 const insertEntity = `-- name: InsertEntity :one
 insert into entities(canonical_id)
 values (?)
@@ -49,17 +182,38 @@ func (q *Queries) InsertEntity(ctx context.Context, canonicalID string) (int64,
 	return id, err
 }
 
+const insertEntityConfig = `-- name: InsertEntityConfig :exec
+insert into entity_configs(entity_id, kind, config)
+values (?, ?, ?)
+`
+
+type InsertEntityConfigParams struct {
+	EntityID int64
+	Kind     string
+	Config   string
+}
+
+func (q *Queries) InsertEntityConfig(ctx context.Context, arg InsertEntityConfigParams) error {
+	_, err := q.db.ExecContext(ctx, insertEntityConfig, arg.EntityID, arg.Kind, arg.Config)
+	return err
+}
+
 const insertHeartbeat = `-- name: InsertHeartbeat :one
-insert into heartbeat(entity_id, ts, successful, error)
-values (?, ?, ?, ?)
+insert into heartbeat(entity_id, ts, successful, error, latency_us, dns_us, connect_us, tls_us, first_byte_us)
+values (?, ?, ?, ?, ?, ?, ?, ?, ?)
 returning id
 `
 
 type InsertHeartbeatParams struct {
-	EntityID   int64
-	Ts         time.Time
-	Successful bool
-	Error      sql.NullString
+	EntityID    int64
+	Ts          time.Time
+	Successful  bool
+	Error       sql.NullString
+	LatencyUs   sql.NullInt64
+	DnsUs       sql.NullInt64
+	ConnectUs   sql.NullInt64
+	TlsUs       sql.NullInt64
+	FirstByteUs sql.NullInt64
 }
 
 func (q *Queries) InsertHeartbeat(ctx context.Context, arg InsertHeartbeatParams) (int64, error) {
@@ -68,6 +222,11 @@ func (q *Queries) InsertHeartbeat(ctx context.Context, arg InsertHeartbeatParams
 		arg.Ts,
 		arg.Successful,
 		arg.Error,
+		arg.LatencyUs,
+		arg.DnsUs,
+		arg.ConnectUs,
+		arg.TlsUs,
+		arg.FirstByteUs,
 	)
 	var id int64
 	err := row.Scan(&id)
@@ -102,3 +261,381 @@ func (q *Queries) InsertMetrics(ctx context.Context, arg InsertMetricsParams) (i
 	err := row.Scan(&id)
 	return id, err
 }
+
+const insertStateChange = `-- name: InsertStateChange :one
+insert into state_changes(entity_id, ts, from_state, to_state, error)
+values (?, ?, ?, ?, ?)
+returning id
+`
+
+type InsertStateChangeParams struct {
+	EntityID  int64
+	Ts        time.Time
+	FromState string
+	ToState   string
+	Error     sql.NullString
+}
+
+func (q *Queries) InsertStateChange(ctx context.Context, arg InsertStateChangeParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, insertStateChange,
+		arg.EntityID,
+		arg.Ts,
+		arg.FromState,
+		arg.ToState,
+		arg.Error,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const listEntities = `-- name: ListEntities :many
+select id, canonical_id from entities
+ order by id
+`
+
+func (q *Queries) ListEntities(ctx context.Context) ([]Entity, error) {
+	rows, err := q.db.QueryContext(ctx, listEntities)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Entity
+	for rows.Next() {
+		var i Entity
+		if err := rows.Scan(&i.ID, &i.CanonicalID); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listEntityConfigs = `-- name: ListEntityConfigs :many
+select e.canonical_id, c.config
+  from entity_configs c
+  join entities e on e.id = c.entity_id
+ where c.kind = ?
+ order by e.id
+`
+
+type ListEntityConfigsRow struct {
+	CanonicalID string
+	Config      string
+}
+
+func (q *Queries) ListEntityConfigs(ctx context.Context, kind string) ([]ListEntityConfigsRow, error) {
+	rows, err := q.db.QueryContext(ctx, listEntityConfigs, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListEntityConfigsRow
+	for rows.Next() {
+		var i ListEntityConfigsRow
+		if err := rows.Scan(&i.CanonicalID, &i.Config); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listHeartbeats = `-- name: ListHeartbeats :many
+select id, entity_id, ts, successful, error, latency_us, dns_us, connect_us, tls_us, first_byte_us from heartbeat
+ where entity_id = ?1
+   and ts >= ?2
+   and ts < ?3
+ order by ts
+`
+
+type ListHeartbeatsParams struct {
+	EntityID int64
+	FromTs   time.Time
+	ToTs     time.Time
+}
+
+func (q *Queries) ListHeartbeats(ctx context.Context, arg ListHeartbeatsParams) ([]Heartbeat, error) {
+	rows, err := q.db.QueryContext(ctx, listHeartbeats, arg.EntityID, arg.FromTs, arg.ToTs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Heartbeat
+	for rows.Next() {
+		var i Heartbeat
+		if err := rows.Scan(
+			&i.ID,
+			&i.EntityID,
+			&i.Ts,
+			&i.Successful,
+			&i.Error,
+			&i.LatencyUs,
+			&i.DnsUs,
+			&i.ConnectUs,
+			&i.TlsUs,
+			&i.FirstByteUs,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listHeartbeatsPage = `-- name: ListHeartbeatsPage :many
+select id, entity_id, ts, successful, error, latency_us, dns_us, connect_us, tls_us, first_byte_us from heartbeat
+ where entity_id = ?1
+   and ts >= ?2
+   and ts < ?3
+   and id > ?4
+ order by id
+ limit ?5
+`
+
+type ListHeartbeatsPageParams struct {
+	EntityID int64
+	FromTs   time.Time
+	ToTs     time.Time
+	AfterID  int64
+	PageSize int64
+}
+
+func (q *Queries) ListHeartbeatsPage(ctx context.Context, arg ListHeartbeatsPageParams) ([]Heartbeat, error) {
+	rows, err := q.db.QueryContext(ctx, listHeartbeatsPage,
+		arg.EntityID,
+		arg.FromTs,
+		arg.ToTs,
+		arg.AfterID,
+		arg.PageSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Heartbeat
+	for rows.Next() {
+		var i Heartbeat
+		if err := rows.Scan(
+			&i.ID,
+			&i.EntityID,
+			&i.Ts,
+			&i.Successful,
+			&i.Error,
+			&i.LatencyUs,
+			&i.DnsUs,
+			&i.ConnectUs,
+			&i.TlsUs,
+			&i.FirstByteUs,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listMetricSamples = `-- name: ListMetricSamples :many
+select m.id, m.entity_id, e.canonical_id, m.ts, m.name, m.type, m.value, m.labels
+  from metrics m
+  join entities e on e.id = m.entity_id
+ where m.name = ?1
+   and m.ts >= ?2
+   and m.ts < ?3
+ order by m.ts
+`
+
+type ListMetricSamplesParams struct {
+	Name   string
+	FromTs time.Time
+	ToTs   time.Time
+}
+
+type ListMetricSamplesRow struct {
+	ID          int64
+	EntityID    int64
+	CanonicalID string
+	Ts          time.Time
+	Name        string
+	Type        string
+	Value       float64
+	Labels      json.RawMessage
+}
+
+func (q *Queries) ListMetricSamples(ctx context.Context, arg ListMetricSamplesParams) ([]ListMetricSamplesRow, error) {
+	rows, err := q.db.QueryContext(ctx, listMetricSamples, arg.Name, arg.FromTs, arg.ToTs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListMetricSamplesRow
+	for rows.Next() {
+		var i ListMetricSamplesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.EntityID,
+			&i.CanonicalID,
+			&i.Ts,
+			&i.Name,
+			&i.Type,
+			&i.Value,
+			&i.Labels,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listMetricSamplesPage = `-- name: ListMetricSamplesPage :many
+select m.id, m.entity_id, e.canonical_id, m.ts, m.name, m.type, m.value, m.labels
+  from metrics m
+  join entities e on e.id = m.entity_id
+ where m.name = ?1
+   and m.ts >= ?2
+   and m.ts < ?3
+   and m.id > ?4
+   and not exists (
+     select 1 from json_each(?5) s
+      where case
+              when m.labels ->> s.key is not null then m.labels ->> s.key != s.value
+              else s.key = 'kind' or instr('|' || e.canonical_id || '|', '|' || s.key || '=' || s.value || '|') = 0
+            end
+   )
+ order by m.id
+ limit ?6
+`
+
+type ListMetricSamplesPageParams struct {
+	Name     string
+	FromTs   time.Time
+	ToTs     time.Time
+	AfterID  int64
+	Selector string
+	PageSize int64
+}
+
+type ListMetricSamplesPageRow struct {
+	ID          int64
+	EntityID    int64
+	CanonicalID string
+	Ts          time.Time
+	Name        string
+	Type        string
+	Value       float64
+	Labels      json.RawMessage
+}
+
+func (q *Queries) ListMetricSamplesPage(ctx context.Context, arg ListMetricSamplesPageParams) ([]ListMetricSamplesPageRow, error) {
+	rows, err := q.db.QueryContext(ctx, listMetricSamplesPage,
+		arg.Name,
+		arg.FromTs,
+		arg.ToTs,
+		arg.AfterID,
+		arg.Selector,
+		arg.PageSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListMetricSamplesPageRow
+	for rows.Next() {
+		var i ListMetricSamplesPageRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.EntityID,
+			&i.CanonicalID,
+			&i.Ts,
+			&i.Name,
+			&i.Type,
+			&i.Value,
+			&i.Labels,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listStateChanges = `-- name: ListStateChanges :many
+select id, entity_id, ts, from_state, to_state, error from state_changes
+ where entity_id = ?1
+   and ts >= ?2
+   and ts < ?3
+ order by ts
+`
+
+type ListStateChangesParams struct {
+	EntityID int64
+	FromTs   time.Time
+	ToTs     time.Time
+}
+
+func (q *Queries) ListStateChanges(ctx context.Context, arg ListStateChangesParams) ([]StateChange, error) {
+	rows, err := q.db.QueryContext(ctx, listStateChanges, arg.EntityID, arg.FromTs, arg.ToTs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []StateChange
+	for rows.Next() {
+		var i StateChange
+		if err := rows.Scan(
+			&i.ID,
+			&i.EntityID,
+			&i.Ts,
+			&i.FromState,
+			&i.ToState,
+			&i.Error,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
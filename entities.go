@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"maps"
+	"slices"
 	"sync"
 	"time"
 
@@ -13,8 +15,21 @@ import (
 	"meerkat-v0/utils"
 )
 
+// Time spent in each phase of a probe, zero when the phase doesn't apply
+type PhaseTimings struct {
+	DNS       time.Duration
+	Connect   time.Duration
+	TLS       time.Duration
+	FirstByte time.Duration
+}
+
+type RunResult struct {
+	Latency time.Duration
+	Phases  PhaseTimings
+}
+
 type Entity interface {
-	Run(ctx context.Context) error
+	Run(ctx context.Context) (RunResult, error)
 	Configure(id utils.EntityID, cfg []byte) error
 	Eq(newCfg []byte) (bool, error)
 }
@@ -45,37 +60,73 @@ func (c *EntityConfig) Valid(ctx context.Context) map[string]string {
 }
 
 type EntityInstance struct {
-	ID     utils.EntityID
-	Ent    Entity
-	Cfg    EntityConfig
+	ID  utils.EntityID
+	Ent Entity
+	Cfg EntityConfig
+	// The config as written, which is what gets saved
 	RawCfg []byte
+	// The config with references resolved, which the entity runs with
+	Resolved ResolvedConfig
 
 	ctx     context.Context
 	cancel  context.CancelFunc
 	running bool
+	// Closed once the run started last returns
+	done chan struct{}
 }
 
-func NewEntityInstance(id utils.EntityID, ent Entity, cfg EntityConfig, rawCfg []byte) *EntityInstance {
+func NewEntityInstance(id utils.EntityID, ent Entity, cfg EntityConfig, rawCfg []byte, resolved ResolvedConfig) *EntityInstance {
 	return &EntityInstance{
-		ID:     id,
-		Ent:    ent,
-		Cfg:    cfg,
-		RawCfg: rawCfg,
+		ID:       id,
+		Ent:      ent,
+		Cfg:      cfg,
+		RawCfg:   rawCfg,
+		Resolved: resolved,
 	}
 }
 
-type ServiceInstance struct {
-	ID        utils.EntityID
-	EntityIDs []string
-	RawCfg    []byte
-}
+// Reports whether other would run exactly like this instance. Besides the
+// entity's own config this covers the interval and settings like the state
+// config that live next to it, so the raw configs are compared as well.
+// Resolved configs are compared, so a changed secret is a changed config
+func (i *EntityInstance) Eq(other *EntityInstance) (bool, error) {
+	if i.Cfg != other.Cfg {
+		return false, nil
+	}
 
-func NewServiceInstance(id utils.EntityID, rawCfg []byte, entityIDs []string) *ServiceInstance {
-	return &ServiceInstance{
-		ID:        id,
-		EntityIDs: entityIDs,
-		RawCfg:    rawCfg,
+	same, err := i.Ent.Eq(other.Resolved.JSON)
+	if err != nil || !same {
+		return false, err
 	}
+
+	var a, b bytes.Buffer
+	if err := json.Compact(&a, i.Resolved.JSON); err != nil {
+		return false, err
+	}
+	if err := json.Compact(&b, other.Resolved.JSON); err != nil {
+		return false, err
+	}
+	return bytes.Equal(a.Bytes(), b.Bytes()), nil
+}
+
+// Raw entity configs of a single service
+type ServiceEntities struct {
+	ID      utils.EntityID
+	Configs []json.RawMessage
+}
+
+// Entities built from a new config and how they differ from the running ones
+type EntityPlan struct {
+	Diff ConfigDiff
+	// Canonical ID to the new instance of added and updated entities
+	instances map[string]*EntityInstance
+	// Canonical ID to the raw config of every entity in the new config
+	configs map[string][]byte
+}
+
+// Saved configs of the plan by canonical ID, see EntityRepo.SaveEntityConfigs
+func (p *EntityPlan) Configs() map[string][]byte {
+	return p.configs
 }
 
 type EntityBuilder func(
@@ -102,8 +153,6 @@ type EntityService struct {
 	mu sync.RWMutex
 	// Monitor ID to entity instance
 	entities map[string]*EntityInstance
-	// Service ID to a list of entity ids
-	services map[string]*ServiceInstance
 
 	wg sync.WaitGroup
 
@@ -115,6 +164,7 @@ func NewEntityService(name string, entityBuilder EntityBuilder, entityRunner Ent
 	ctx, cancel := context.WithCancel(context.Background())
 	return &EntityService{
 		Name:        name,
+		logger:      utils.DefaultLogger(),
 		entityRepo:  entityRepo,
 		buildEntity: entityBuilder,
 		runEntity:   entityRunner,
@@ -124,95 +174,137 @@ func NewEntityService(name string, entityBuilder EntityBuilder, entityRunner Ent
 	}
 }
 
-func (m *EntityService) DiffEntities(serviceID utils.EntityID, rawConfigs []json.RawMessage) (*ConfigDiff, error) {
-	add := make([]string, 10)
-	update := make([]string, 10)
-	delete := make([]string, 10)
+// Returns IDs of the currently loaded entities
+func (m *EntityService) Entities() []utils.EntityID {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	newConfigs := make(map[string]EntityConfig)
-	for _, rawCfg := range rawConfigs {
-		var cfg EntityConfig
-		err := json.Unmarshal(rawCfg, &cfg)
+	ids := make([]utils.EntityID, 0, len(m.entities))
+	for _, inst := range m.entities {
+		ids = append(ids, inst.ID)
+	}
+	return ids
+}
+
+// Builds the entities of every service and compares them with the running
+// ones. Nothing is started or stopped, running entities missing from services
+// are planned for deletion
+func (m *EntityService) DiffEntities(services []ServiceEntities) (*EntityPlan, error) {
+	var errs []error
+	built := make(map[string]*EntityInstance)
+	for _, service := range services {
+		instances, err := m.buildAll(service.ID, service.Configs)
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
+			continue
 		}
+		maps.Copy(built, instances)
+	}
 
-		problems := cfg.Valid(context.TODO())
-		if len(problems) > 0 {
-			return nil, NewValidationError(problems, serviceID.Labels["name"], cfg.Name)
-		}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
 
-		id := NewMonitorIDFromServiceID(serviceID, cfg.Type, cfg.Name)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-		oldCfg, ok := m.entities[id.Canonical()]
+	plan := &EntityPlan{
+		instances: make(map[string]*EntityInstance),
+		configs:   make(map[string][]byte, len(built)),
+	}
+	for id, inst := range built {
+		plan.configs[id] = inst.RawCfg
+
+		old, ok := m.entities[id]
 		if !ok {
-			add = append(add, id.Canonical())
+			plan.Diff.Add = append(plan.Diff.Add, id)
+			plan.instances[id] = inst
 			continue
 		}
 
-		ok, err = oldCfg.Ent.Eq(rawCfg)
+		same, err := old.Eq(inst)
 		if err != nil {
 			return nil, err
 		}
-		if !ok {
-			update = append(update, id.Canonical())
+		if same {
+			plan.Diff.Unchanged = append(plan.Diff.Unchanged, id)
+			continue
 		}
-		newConfigs[id.Canonical()] = cfg
+		plan.Diff.Update = append(plan.Diff.Update, id)
+		plan.instances[id] = inst
 	}
 
 	for id := range m.entities {
-		_, ok := newConfigs[id]
-		if ok {
-			continue
+		if _, ok := built[id]; !ok {
+			plan.Diff.Delete = append(plan.Diff.Delete, id)
 		}
-		delete = append(delete, id)
 	}
 
-	return &ConfigDiff{
-		Add:    add,
-		Update: update,
-		Delete: delete,
-	}, nil
+	slices.Sort(plan.Diff.Add)
+	slices.Sort(plan.Diff.Update)
+	slices.Sort(plan.Diff.Delete)
+	slices.Sort(plan.Diff.Unchanged)
+	return plan, nil
 }
 
-func (m *EntityService) LoadService(ctx context.Context, serviceID utils.EntityID, rawConfigs []json.RawMessage) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	newMonitors, err := m.buildAll(serviceID, rawConfigs)
+// Loads the entities saved by the last applied config without starting them,
+// so a plan can be made against what's running in another process
+func (m *EntityService) LoadSaved(ctx context.Context) error {
+	configs, err := m.entityRepo.ListEntityConfigs(ctx, m.Name)
 	if err != nil {
 		return err
 	}
 
-	for id := range newMonitors {
-		_, err := m.entityRepo.GetID(ctx, id)
-		if errors.Is(err, ErrIDNotFound) {
-			_, err = m.entityRepo.InsertEntity(ctx, id)
-			if err != nil {
-				return err
-			}
-		} else if err != nil {
-			return err
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for canonID, rawCfg := range configs {
+		id := utils.ParseEntityID(canonID)
+		serviceID := NewServiceID(id.Labels["instance"], id.Labels["service"])
+
+		// Configs that don't build anymore show up as added
+		_, inst, err := m.buildEntity(serviceID, rawCfg)
+		if err != nil {
+			continue
 		}
+		m.entities[canonID] = inst
 	}
+	return nil
+}
 
-	service, exisits := m.services[serviceID.Canonical()]
-	if exisits {
-		for _, id := range service.EntityIDs {
-			_, ok := newMonitors[id]
-			if !ok {
-				m.stopInstanceUnsynced(id)
-				delete(m.entities, id)
-			}
+// Starts added entities, restarts updated ones and stops deleted ones.
+// Unchanged entities keep running on their old schedule. Replacements start
+// only after the runs they replace return, so two runs of an entity never
+// overlap
+func (m *EntityService) ApplyEntities(plan *EntityPlan) {
+	m.mu.Lock()
+	var stopped []<-chan struct{}
+	for _, id := range plan.Diff.Delete {
+		if done := m.stopInstanceUnsynced(id); done != nil {
+			stopped = append(stopped, done)
 		}
+		delete(m.entities, id)
 	}
 
-	for id, inst := range newMonitors {
-		old, ok := m.entities[id]
-		if ok && old.running {
-			m.stopInstanceUnsynced(id)
+	for id := range plan.instances {
+		if _, ok := m.entities[id]; !ok {
+			continue
+		}
+		if done := m.stopInstanceUnsynced(id); done != nil {
+			stopped = append(stopped, done)
 		}
+	}
+	m.mu.Unlock()
 
+	// Runs can read the service, so they're waited for without the lock
+	for _, done := range stopped {
+		<-done
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, inst := range plan.instances {
 		ctx, cancel := context.WithCancel(m.ctx)
 
 		inst.ctx = ctx
@@ -222,11 +314,10 @@ func (m *EntityService) LoadService(ctx context.Context, serviceID utils.EntityI
 
 		m.startInstanceUnsynced(id)
 	}
-
-	return nil
 }
 
 func (m *EntityService) buildAll(serviceID utils.EntityID, rawConfigs []json.RawMessage) (map[string]*EntityInstance, error) {
+	var errs []error
 	result := make(map[string]*EntityInstance)
 
 	for i, rawMonitorCfg := range rawConfigs {
@@ -234,57 +325,93 @@ func (m *EntityService) buildAll(serviceID utils.EntityID, rawConfigs []json.Raw
 		var nnerr *NoNameError
 		if errors.As(err, &nnerr) {
 			nnerr.SetIndex(i)
-			return nil, nnerr
+			errs = append(errs, nnerr)
+			continue
 		} else if err != nil {
-			return nil, err
+			// Entities without a name can only be pointed to by their index
+			var val *ValidationError
+			if errors.As(err, &val) && len(val.Path) > 0 && len(val.Path[len(val.Path)-1].Name) == 0 {
+				val.Path = val.Path[:len(val.Path)-1].WithIndex(i)
+			}
+			errs = append(errs, err)
+			continue
 		}
 
 		canon := id.Canonical()
 
 		if _, exists := result[canon]; exists {
-			return nil, NewDuplicateFoundError(serviceID.Labels["name"], fmt.Sprint(i))
+			err := NewDuplicateFoundError(serviceID.Labels["instance"], serviceID.Labels["name"])
+			err.SetIndex(i)
+			errs = append(errs, err)
+			continue
 		}
 
 		result[canon] = inst
 	}
 
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
 	return result, nil
 }
 
 func (m *EntityService) startInstanceUnsynced(monitorID string) {
+	inst := m.entities[monitorID]
+	inst.running = true
+	inst.done = make(chan struct{})
+
 	m.wg.Add(1)
 	go func() {
-		m.runEntity(m.logger, m.entities[monitorID])
+		m.runEntity(m.logger, inst)
+		close(inst.done)
 		m.wg.Done()
 	}()
 }
 
-func (m *EntityService) stopInstanceUnsynced(monitorID string) {
+// Returns a channel closed once the stopped run returns, nil when the
+// instance isn't running
+func (m *EntityService) stopInstanceUnsynced(monitorID string) <-chan struct{} {
 	monitor := m.entities[monitorID]
 	if !monitor.running {
-		return
+		return nil
 	}
 	monitor.cancel()
 	monitor.running = false
+	return monitor.done
 }
 
 var ErrIDNotFound = errors.New("could not find entity with this id")
 
+type StoredEntity struct {
+	ID       int64
+	EntityID utils.EntityID
+}
+
 type EntityRepo interface {
 	GetID(ctx context.Context, canonID string) (int64, error)
 	InsertEntity(ctx context.Context, canonID string) (int64, error)
 	GetCanonicalID(ctx context.Context, id int64) (string, error)
+	ListEntities(ctx context.Context) ([]StoredEntity, error)
+	// Replaces the saved configs of every kind in configs, which go by kind
+	// and canonical ID. Either all of them are saved or none, IDs missing
+	// from the repo are inserted
+	SaveEntityConfigs(ctx context.Context, configs map[string]map[string][]byte) error
+	// Returns the saved configs of the kind by canonical ID
+	ListEntityConfigs(ctx context.Context, kind string) (map[string][]byte, error)
 }
 
 type SqliteEntityRepo struct {
 	readDB  *db.Queries
 	writeDB *db.Queries
+	// Saving configs needs a transaction on the write connection
+	writeConn *sql.DB
 }
 
-func NewSqliteEntityRepo(readDB *db.Queries, writeDB *db.Queries) *SqliteEntityRepo {
+func NewSqliteEntityRepo(readDB *db.Queries, writeConn *sql.DB) *SqliteEntityRepo {
 	return &SqliteEntityRepo{
-		readDB:  readDB,
-		writeDB: writeDB,
+		readDB:    readDB,
+		writeDB:   db.New(writeConn),
+		writeConn: writeConn,
 	}
 }
 
@@ -293,7 +420,7 @@ func (r *SqliteEntityRepo) GetID(ctx context.Context, canonID string) (int64, er
 	if errors.Is(err, sql.ErrNoRows) {
 		return 0, ErrIDNotFound
 	}
-	return id, nil
+	return id, err
 }
 
 func (r *SqliteEntityRepo) GetCanonicalID(ctx context.Context, id int64) (string, error) {
@@ -301,7 +428,7 @@ func (r *SqliteEntityRepo) GetCanonicalID(ctx context.Context, id int64) (string
 	if errors.Is(err, sql.ErrNoRows) {
 		return "", ErrIDNotFound
 	}
-	return canon, nil
+	return canon, err
 }
 
 func (r *SqliteEntityRepo) InsertEntity(ctx context.Context, canonID string) (int64, error) {
@@ -312,3 +439,70 @@ func (r *SqliteEntityRepo) InsertEntity(ctx context.Context, canonID string) (in
 
 	return id, nil
 }
+
+func (r *SqliteEntityRepo) ListEntities(ctx context.Context) ([]StoredEntity, error) {
+	rows, err := r.readDB.ListEntities(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entities := make([]StoredEntity, len(rows))
+	for i, row := range rows {
+		entities[i] = StoredEntity{
+			ID:       row.ID,
+			EntityID: utils.ParseEntityID(row.CanonicalID),
+		}
+	}
+	return entities, nil
+}
+
+// Runs in a transaction so a failed save keeps the previous configs
+func (r *SqliteEntityRepo) SaveEntityConfigs(ctx context.Context, configs map[string]map[string][]byte) error {
+	tx, err := r.writeConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	writeDB := r.writeDB.WithTx(tx)
+
+	for _, kind := range slices.Sorted(maps.Keys(configs)) {
+		err = writeDB.DeleteEntityConfigs(ctx, kind)
+		if err != nil {
+			return err
+		}
+
+		for canonID, cfg := range configs[kind] {
+			eId, err := writeDB.GetEntityID(ctx, canonID)
+			if errors.Is(err, sql.ErrNoRows) {
+				eId, err = writeDB.InsertEntity(ctx, canonID)
+			}
+			if err != nil {
+				return err
+			}
+
+			err = writeDB.InsertEntityConfig(ctx, db.InsertEntityConfigParams{
+				EntityID: eId,
+				Kind:     kind,
+				Config:   string(cfg),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *SqliteEntityRepo) ListEntityConfigs(ctx context.Context, kind string) (map[string][]byte, error) {
+	rows, err := r.readDB.ListEntityConfigs(ctx, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make(map[string][]byte, len(rows))
+	for _, row := range rows {
+		configs[row.CanonicalID] = []byte(row.Config)
+	}
+	return configs, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"meerkat-v0/db"
+	"meerkat-v0/utils"
+)
+
+// Counts the runs of every entity and how often two runs of the same one
+// overlapped. Runs take a while to return after being stopped
+type runRecorder struct {
+	mu       sync.Mutex
+	active   map[string]int
+	starts   map[string]int
+	overlaps int
+}
+
+func (r *runRecorder) run(logger *utils.Logger, inst *EntityInstance) {
+	id := inst.ID.Canonical()
+
+	r.mu.Lock()
+	if r.active[id] > 0 {
+		r.overlaps++
+	}
+	r.active[id]++
+	r.starts[id]++
+	r.mu.Unlock()
+
+	<-inst.ctx.Done()
+	time.Sleep(50 * time.Millisecond)
+
+	r.mu.Lock()
+	r.active[id]--
+	r.mu.Unlock()
+}
+
+func tcpEntityConfig(name string, port string) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{"type": "tcp", "name": %q, "interval": 60, "hostname": "localhost", "port": %q}`, name, port))
+}
+
+func TestDiffAndApplyEntities(t *testing.T) {
+	registry := NewRegistry("monitor")
+	RegisterMonitorTypes(registry, &memorySink{})
+	builder := func(serviceID utils.EntityID, rawCfg []byte) (utils.EntityID, *EntityInstance, error) {
+		return BuildMonitor(registry, serviceID, rawCfg)
+	}
+	recorder := &runRecorder{active: make(map[string]int), starts: make(map[string]int)}
+	service := NewEntityService("monitor", builder, recorder.run, nil)
+	defer service.Stop(context.Background())
+
+	serviceID := NewServiceID("home", "web")
+	id := func(name string) string {
+		return NewMonitorID("home", "web", "tcp", name).Canonical()
+	}
+
+	plan, err := service.DiffEntities([]ServiceEntities{{
+		ID: serviceID,
+		Configs: []json.RawMessage{
+			tcpEntityConfig("a", "80"),
+			tcpEntityConfig("b", "80"),
+			tcpEntityConfig("c", "80"),
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ConfigDiff{Add: []string{id("a"), id("b"), id("c")}}
+	if !diffEqual(plan.Diff, want) {
+		t.Fatalf("expected diff %+v, got %+v", want, plan.Diff)
+	}
+	service.ApplyEntities(plan)
+
+	plan, err = service.DiffEntities([]ServiceEntities{{
+		ID: serviceID,
+		Configs: []json.RawMessage{
+			tcpEntityConfig("a", "80"),
+			tcpEntityConfig("b", "443"),
+			tcpEntityConfig("d", "80"),
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = ConfigDiff{
+		Add:       []string{id("d")},
+		Update:    []string{id("b")},
+		Delete:    []string{id("c")},
+		Unchanged: []string{id("a")},
+	}
+	if !diffEqual(plan.Diff, want) {
+		t.Fatalf("expected diff %+v, got %+v", want, plan.Diff)
+	}
+	if got := slices.Sorted(maps.Keys(plan.Configs())); !slices.Equal(got, []string{id("a"), id("b"), id("d")}) {
+		t.Fatalf("expected configs of every entity in the new config, got %v", got)
+	}
+	service.ApplyEntities(plan)
+
+	// Runs start in the background, stopped ones have returned already
+	wantStarts := map[string]int{id("a"): 1, id("b"): 2, id("c"): 1, id("d"): 1}
+	deadline := time.Now().Add(2 * time.Second)
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	for !maps.Equal(recorder.starts, wantStarts) && time.Now().Before(deadline) {
+		recorder.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		recorder.mu.Lock()
+	}
+
+	if recorder.overlaps > 0 {
+		t.Errorf("expected replaced runs to return before their replacements start, %d overlapped", recorder.overlaps)
+	}
+	if !maps.Equal(recorder.starts, wantStarts) {
+		t.Errorf("expected starts %v, got %v", wantStarts, recorder.starts)
+	}
+	wantActive := map[string]int{id("a"): 1, id("b"): 1, id("c"): 0, id("d"): 1}
+	if !maps.Equal(recorder.active, wantActive) {
+		t.Errorf("expected running %v, got %v", wantActive, recorder.active)
+	}
+
+	var running []string
+	for _, entID := range service.Entities() {
+		running = append(running, entID.Canonical())
+	}
+	slices.Sort(running)
+	if !slices.Equal(running, []string{id("a"), id("b"), id("d")}) {
+		t.Errorf("expected a, b and d to be loaded, got %v", running)
+	}
+}
+
+func diffEqual(a, b ConfigDiff) bool {
+	return slices.Equal(a.Add, b.Add) && slices.Equal(a.Update, b.Update) &&
+		slices.Equal(a.Delete, b.Delete) && slices.Equal(a.Unchanged, b.Unchanged)
+}
+
+func TestSaveEntityConfigsAtomic(t *testing.T) {
+	ctx := context.Background()
+	dbRead, dbWrite, err := openObservations(ctx, filepath.Join(t.TempDir(), "observations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbRead.Close()
+	defer dbWrite.Close()
+
+	entityRepo := NewSqliteEntityRepo(db.New(dbRead), dbWrite)
+	first := NewMonitorID("home", "web", "tcp", "first").Canonical()
+	second := NewMonitorID("home", "web", "tcp", "second").Canonical()
+	disk := NewMetricsID("home", "host", "disk", "root").Canonical()
+
+	err = entityRepo.SaveEntityConfigs(ctx, map[string]map[string][]byte{
+		"monitor": {first: []byte(`{"name": "first"}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Kinds are saved in order, so this fails after the metrics configs
+	// are written
+	_, err = dbWrite.ExecContext(ctx, `create trigger fail_monitor before insert on entity_configs
+when new.kind = 'monitor' begin select raise(abort, 'monitor configs are read only'); end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = entityRepo.SaveEntityConfigs(ctx, map[string]map[string][]byte{
+		"metrics": {disk: []byte(`{"name": "root"}`)},
+		"monitor": {second: []byte(`{"name": "second"}`)},
+	})
+	checkError(t, err, "monitor configs are read only")
+
+	configs, err := entityRepo.ListEntityConfigs(ctx, "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.EqualFunc(configs, map[string][]byte{first: []byte(`{"name": "first"}`)}, slices.Equal) {
+		t.Errorf("expected the monitor configs of the first save, got %q", configs)
+	}
+
+	configs, err = entityRepo.ListEntityConfigs(ctx, "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) > 0 {
+		t.Errorf("expected the metrics configs to be rolled back, got %q", configs)
+	}
+
+	for _, id := range []string{second, disk} {
+		_, err = entityRepo.GetID(ctx, id)
+		if !errors.Is(err, ErrIDNotFound) {
+			t.Errorf("expected %s not to be inserted, got %v", id, err)
+		}
+	}
+}
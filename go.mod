@@ -2,7 +2,11 @@ module meerkat-v0
 
 go 1.24.11
 
-require modernc.org/sqlite v1.44.1
+require (
+	github.com/BurntSushi/toml v1.6.0
+	gopkg.in/yaml.v3 v3.0.1
+	modernc.org/sqlite v1.44.1
+)
 
 require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
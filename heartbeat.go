@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -11,13 +12,32 @@ import (
 )
 
 type Heartbeat struct {
+	// Set on heartbeats read back from a repo
+	ID        int64
 	MonitorID string
 	Timestamp time.Time
 	Error     error
+	Latency   time.Duration
+	Phases    PhaseTimings
 }
 
 type HeartbeatRepo interface {
 	InsertHeartbeat(context.Context, Heartbeat) error
+	// Returns heartbeats in [from, to) ordered by time
+	ListHeartbeats(ctx context.Context, monitorID string, from time.Time, to time.Time) ([]Heartbeat, error)
+	// Returns up to limit heartbeats in [from, to) that come after the
+	// heartbeat with afterID
+	PageHeartbeats(ctx context.Context, monitorID string, from time.Time, to time.Time, afterID int64, limit int) ([]Heartbeat, error)
+	// Counts all and successful heartbeats in [from, to)
+	CountHeartbeats(ctx context.Context, monitorID string, from time.Time, to time.Time) (HeartbeatCount, error)
+	// Counts heartbeats of each day starting at from, days follow the
+	// location of from
+	CountDailyHeartbeats(ctx context.Context, monitorID string, from time.Time, days int) ([]HeartbeatCount, error)
+}
+
+type HeartbeatCount struct {
+	Total      int64
+	Successful int64
 }
 
 type WriterHeartbeat struct {
@@ -25,7 +45,7 @@ type WriterHeartbeat struct {
 }
 
 func (h *WriterHeartbeat) InsertHeartbeat(ctx context.Context, heartbeat Heartbeat) error {
-	fmt.Fprintf(h.w, "%s [%s]: ", heartbeat.Timestamp.String(), heartbeat.MonitorID)
+	fmt.Fprintf(h.w, "%s [%s] (%s): ", heartbeat.Timestamp.String(), heartbeat.MonitorID, heartbeat.Latency)
 	if heartbeat.Error != nil {
 		fmt.Fprintf(h.w, "error: %s\n", heartbeat.Error)
 	} else {
@@ -34,6 +54,22 @@ func (h *WriterHeartbeat) InsertHeartbeat(ctx context.Context, heartbeat Heartbe
 	return nil
 }
 
+func (h *WriterHeartbeat) ListHeartbeats(ctx context.Context, monitorID string, from time.Time, to time.Time) ([]Heartbeat, error) {
+	return nil, errors.New("heartbeats written to a writer cannot be listed")
+}
+
+func (h *WriterHeartbeat) PageHeartbeats(ctx context.Context, monitorID string, from time.Time, to time.Time, afterID int64, limit int) ([]Heartbeat, error) {
+	return nil, errors.New("heartbeats written to a writer cannot be listed")
+}
+
+func (h *WriterHeartbeat) CountHeartbeats(ctx context.Context, monitorID string, from time.Time, to time.Time) (HeartbeatCount, error) {
+	return HeartbeatCount{}, errors.New("heartbeats written to a writer cannot be counted")
+}
+
+func (h *WriterHeartbeat) CountDailyHeartbeats(ctx context.Context, monitorID string, from time.Time, days int) ([]HeartbeatCount, error) {
+	return nil, errors.New("heartbeats written to a writer cannot be counted")
+}
+
 type SqliteHeartbeatRepo struct {
 	readDB     *db.Queries
 	writeDB    *db.Queries
@@ -63,10 +99,15 @@ func (r *SqliteHeartbeatRepo) InsertHeartbeat(ctx context.Context, heartbeat Hea
 	}
 
 	_, err = r.writeDB.InsertHeartbeat(ctx, db.InsertHeartbeatParams{
-		EntityID:   eId,
-		Ts:         heartbeat.Timestamp,
-		Successful: successful,
-		Error:      error,
+		EntityID:    eId,
+		Ts:          heartbeat.Timestamp.UTC(),
+		Successful:  successful,
+		Error:       error,
+		LatencyUs:   sql.NullInt64{Int64: heartbeat.Latency.Microseconds(), Valid: true},
+		DnsUs:       durationToMicros(heartbeat.Phases.DNS),
+		ConnectUs:   durationToMicros(heartbeat.Phases.Connect),
+		TlsUs:       durationToMicros(heartbeat.Phases.TLS),
+		FirstByteUs: durationToMicros(heartbeat.Phases.FirstByte),
 	})
 	if err != nil {
 		return err
@@ -74,3 +115,136 @@ func (r *SqliteHeartbeatRepo) InsertHeartbeat(ctx context.Context, heartbeat Hea
 
 	return nil
 }
+
+func (r *SqliteHeartbeatRepo) ListHeartbeats(ctx context.Context, monitorID string, from time.Time, to time.Time) ([]Heartbeat, error) {
+	eId, err := r.entityRepo.GetID(ctx, monitorID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.readDB.ListHeartbeats(ctx, db.ListHeartbeatsParams{
+		EntityID: eId,
+		FromTs:   from.UTC(),
+		ToTs:     to.UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	heartbeats := make([]Heartbeat, len(rows))
+	for i, row := range rows {
+		heartbeats[i] = heartbeatFromRow(monitorID, row)
+	}
+	return heartbeats, nil
+}
+
+func (r *SqliteHeartbeatRepo) PageHeartbeats(ctx context.Context, monitorID string, from time.Time, to time.Time, afterID int64, limit int) ([]Heartbeat, error) {
+	eId, err := r.entityRepo.GetID(ctx, monitorID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.readDB.ListHeartbeatsPage(ctx, db.ListHeartbeatsPageParams{
+		EntityID: eId,
+		FromTs:   from.UTC(),
+		ToTs:     to.UTC(),
+		AfterID:  afterID,
+		PageSize: int64(limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	heartbeats := make([]Heartbeat, len(rows))
+	for i, row := range rows {
+		heartbeats[i] = heartbeatFromRow(monitorID, row)
+	}
+	return heartbeats, nil
+}
+
+func (r *SqliteHeartbeatRepo) CountHeartbeats(ctx context.Context, monitorID string, from time.Time, to time.Time) (HeartbeatCount, error) {
+	eId, err := r.entityRepo.GetID(ctx, monitorID)
+	if err != nil {
+		return HeartbeatCount{}, err
+	}
+
+	row, err := r.readDB.CountHeartbeats(ctx, db.CountHeartbeatsParams{
+		EntityID: eId,
+		FromTs:   from.UTC(),
+		ToTs:     to.UTC(),
+	})
+	if err != nil {
+		return HeartbeatCount{}, err
+	}
+
+	return HeartbeatCount{
+		Total:      row.Total,
+		Successful: row.Successful,
+	}, nil
+}
+
+// Heartbeats are grouped by quarter hour in the database, UTC offsets are
+// multiples of it so every quarter falls into a single local day
+func (r *SqliteHeartbeatRepo) CountDailyHeartbeats(ctx context.Context, monitorID string, from time.Time, days int) ([]HeartbeatCount, error) {
+	eId, err := r.entityRepo.GetID(ctx, monitorID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.readDB.CountHeartbeatsPerQuarterHour(ctx, db.CountHeartbeatsPerQuarterHourParams{
+		EntityID: eId,
+		FromTs:   from.UTC(),
+		ToTs:     from.AddDate(0, 0, days).UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]HeartbeatCount, days)
+	day := 0
+	dayEnd := from.AddDate(0, 0, 1)
+	for _, row := range rows {
+		start := time.Unix(row.QuarterHour*15*60, 0)
+		for !start.Before(dayEnd) && day < days-1 {
+			day++
+			dayEnd = from.AddDate(0, 0, day+1)
+		}
+		counts[day].Total += row.Total
+		counts[day].Successful += row.Successful
+	}
+
+	return counts, nil
+}
+
+func heartbeatFromRow(monitorID string, row db.Heartbeat) Heartbeat {
+	var err error
+	if !row.Successful {
+		err = errors.New(row.Error.String)
+	}
+
+	return Heartbeat{
+		ID:        row.ID,
+		MonitorID: monitorID,
+		Timestamp: row.Ts,
+		Error:     err,
+		Latency:   microsToDuration(row.LatencyUs),
+		Phases: PhaseTimings{
+			DNS:       microsToDuration(row.DnsUs),
+			Connect:   microsToDuration(row.ConnectUs),
+			TLS:       microsToDuration(row.TlsUs),
+			FirstByte: microsToDuration(row.FirstByteUs),
+		},
+	}
+}
+
+// Phases that didn't happen are stored as null
+func durationToMicros(d time.Duration) sql.NullInt64 {
+	if d == 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: d.Microseconds(), Valid: true}
+}
+
+func microsToDuration(us sql.NullInt64) time.Duration {
+	return time.Duration(us.Int64) * time.Microsecond
+}
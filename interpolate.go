@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Secrets shorter than this aren't redacted, they would hide too much of
+// the messages they show up in
+const minRedactedLength = 4
+
+const redacted = "[redacted]"
+
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// A config with the references in its strings resolved
+type ResolvedConfig struct {
+	JSON []byte
+	// Values of environment variables and files the references resolved to
+	Secrets Secrets
+	// References that couldn't be resolved, keyed by the path of the string
+	Problems map[string]string
+}
+
+// Resolves references in every string of a raw JSON config:
+//
+//	${NAME}              environment variable, it has to be set
+//	${NAME:-default}     default when the variable is unset or empty
+//	${file:/path}        file contents without the trailing newline
+//	${file:/path:-value} default when the file doesn't exist
+//	$${                  a literal ${
+//
+// References that can't be resolved are left as they are and reported in
+// Problems
+func ResolveConfig(raw []byte) (ResolvedConfig, error) {
+	// Numbers are kept as written, so they encode back the same
+	var value any
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err := dec.Decode(&value)
+	if err != nil {
+		return ResolvedConfig{}, err
+	}
+
+	r := &resolver{problems: make(map[string]string)}
+	value = r.resolveValue(value, "")
+	if !r.changed {
+		return ResolvedConfig{JSON: raw, Problems: r.problems}, nil
+	}
+
+	resolved, err := json.Marshal(value)
+	if err != nil {
+		return ResolvedConfig{}, err
+	}
+	return ResolvedConfig{JSON: resolved, Secrets: r.secrets, Problems: r.problems}, nil
+}
+
+// Returns the validation problems of the config together with its unresolved
+// references, redacted, or nil when there are none. A field with a reference
+// that couldn't be resolved fails for that reason, the reference is what's
+// worth showing
+func (c ResolvedConfig) ValidationError(problems map[string]string, path ...string) *ValidationError {
+	maps.Copy(problems, c.Problems)
+	if len(problems) == 0 {
+		return nil
+	}
+	return NewValidationError(c.Secrets.RedactProblems(problems), path...)
+}
+
+type resolver struct {
+	secrets  Secrets
+	problems map[string]string
+	changed  bool
+}
+
+func (r *resolver) resolveValue(value any, path string) any {
+	switch value := value.(type) {
+	case string:
+		resolved, err := r.resolveString(value)
+		if err != nil {
+			r.problems[path] = err.Error()
+			return value
+		}
+		if resolved != value {
+			r.changed = true
+		}
+		return resolved
+	case map[string]any:
+		for key, item := range value {
+			value[key] = r.resolveValue(item, joinJSONPath(path, key))
+		}
+	case []any:
+		for i, item := range value {
+			value[i] = r.resolveValue(item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+	return value
+}
+
+func (r *resolver) resolveString(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+
+		if start > 0 && s[start-1] == '$' {
+			b.WriteString(s[:start-1])
+			b.WriteString("${")
+			s = s[start+2:]
+			continue
+		}
+		b.WriteString(s[:start])
+
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("reference '%s' isn't closed with }", s[start:])
+		}
+		ref := s[start+2 : start+end]
+		s = s[start+end+1:]
+
+		value, err := r.resolveRef(ref)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+	}
+}
+
+func (r *resolver) resolveRef(ref string) (string, error) {
+	ref, def, hasDefault := strings.Cut(ref, ":-")
+
+	if path, ok := strings.CutPrefix(ref, "file:"); ok {
+		contents, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) && hasDefault {
+			return def, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("reading '%s': %w", path, err)
+		}
+		value := strings.TrimRight(string(contents), "\r\n")
+		r.secrets = append(r.secrets, value)
+		return value, nil
+	}
+
+	if !envNameRegex.MatchString(ref) {
+		return "", fmt.Errorf("invalid reference '${%s}', should be an environment variable name or file:path", ref)
+	}
+	value := os.Getenv(ref)
+	if len(value) == 0 {
+		if hasDefault {
+			return def, nil
+		}
+		return "", fmt.Errorf("environment variable '%s' isn't set", ref)
+	}
+	r.secrets = append(r.secrets, value)
+	return value, nil
+}
+
+// Values that shouldn't show up in messages and logs
+type Secrets []string
+
+func (s Secrets) Redact(text string) string {
+	// Longest first, so secrets containing others are hidden whole
+	sorted := slices.SortedFunc(slices.Values(s), func(a, b string) int {
+		return cmp.Compare(len(b), len(a))
+	})
+	for _, secret := range sorted {
+		if len(secret) < minRedactedLength {
+			continue
+		}
+		text = strings.ReplaceAll(text, secret, redacted)
+	}
+	return text
+}
+
+func (s Secrets) RedactProblems(problems map[string]string) map[string]string {
+	for field, problem := range problems {
+		problems[field] = s.Redact(problem)
+	}
+	return problems
+}
+
+// Returns err with secrets redacted from its message, it still unwraps to
+// err
+func (s Secrets) RedactError(err error) error {
+	if err == nil || len(s) == 0 {
+		return err
+	}
+	msg := s.Redact(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{msg, err}
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestInstanceSectionsResolveReferences(t *testing.T) {
+	t.Setenv("MEERKAT_TEST_THRESHOLD", "4")
+	t.Setenv("MEERKAT_TEST_TITLE", "Home status")
+	t.Setenv("MEERKAT_TEST_START", "2026-01-01T00:00:00Z")
+
+	rule, err := NewAlertRule("home", []byte(`{"name": "load", "expr": "avg(cpu_loadavg) over 5m > ${MEERKAT_TEST_THRESHOLD}"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.expr.Threshold != 4 {
+		t.Errorf("expected the threshold from the environment, got %g", rule.expr.Threshold)
+	}
+
+	s := &StatusPageService{}
+	page, err := s.PrepareInstance("home", []byte(`{"title": "${MEERKAT_TEST_TITLE}"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Title != "Home status" {
+		t.Errorf("expected the title from the environment, got %q", page.Title)
+	}
+
+	reporter := &UptimeReporter{}
+	windows, err := reporter.PrepareInstance("home", []json.RawMessage{
+		[]byte(`{"name": "upgrade", "start": "${MEERKAT_TEST_START}", "end": "2026-01-02T00:00:00Z"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 1 || windows[0].Start.Year() != 2026 {
+		t.Errorf("expected the start from the environment, got %+v", windows)
+	}
+
+	_, err = reporter.PrepareInstance("home", []json.RawMessage{
+		[]byte(`{"name": "upgrade", "start": "${MEERKAT_TEST_UNSET}", "end": "2026-01-02T00:00:00Z"}`),
+	})
+	var val *ValidationError
+	if !errors.As(err, &val) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	if got, want := val.Problems["start"], "environment variable 'MEERKAT_TEST_UNSET' isn't set"; got != want {
+		t.Errorf("expected the reference problem %q, got %q", want, got)
+	}
+	if got, want := val.Path.String(), "home.maintenance[0]"; got != want {
+		t.Errorf("expected path %s, got %s", want, got)
+	}
+}
+
+func TestResolvedConfigRedactsProblems(t *testing.T) {
+	t.Setenv("MEERKAT_TEST_TOKEN", "s3cr3t-token")
+
+	resolved, err := ResolveConfig([]byte(`{"url": "http://${MEERKAT_TEST_TOKEN}@host", "header": "${MEERKAT_TEST_UNSET}"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valErr := resolved.ValidationError(map[string]string{}, "home"); valErr == nil || len(valErr.Problems) != 1 {
+		t.Fatalf("expected only the unresolved reference, got %v", valErr)
+	}
+
+	valErr := resolved.ValidationError(map[string]string{"url": "invalid url 'http://s3cr3t-token@host'"}, "home", "hook")
+	if got, want := valErr.Problems["url"], "invalid url 'http://[redacted]@host'"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	clean, err := ResolveConfig([]byte(`{"url": "http://host"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valErr := clean.ValidationError(map[string]string{}, "home"); valErr != nil {
+		t.Errorf("expected no error, got %v", valErr)
+	}
+}
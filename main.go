@@ -5,12 +5,13 @@ import (
 	"database/sql"
 	_ "embed"
 	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
 	"sync"
+	"syscall"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -22,72 +23,279 @@ import (
 //go:embed schema.sql
 var ddl string
 
-func help() {
-	fmt.Fprintln(os.Stderr, "./meerkat [config]")
+func help(flags *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "./meerkat [flags] [config file or directory]")
+	fmt.Fprintln(os.Stderr, "./meerkat report [flags] [config file or directory]")
+	fmt.Fprintln(os.Stderr, "./meerkat check [flags] [config file or directory]")
+	flags.PrintDefaults()
 }
 
 func run() error {
-	if len(os.Args) < 2 {
-		help()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "report":
+			return runReport(os.Args[2:])
+		case "check":
+			return runCheck(os.Args[2:])
+		}
+	}
+
+	flags := flag.NewFlagSet("meerkat", flag.ContinueOnError)
+	listen := flags.String("listen", "", "address of the read-only HTTP API and status pages, like :8080, disabled when empty")
+	watch := flags.Bool("watch", false, "reload the config when the file changes, it's always reloaded on SIGHUP")
+	configFormat := flags.String("config-format", "", "json, yaml or toml, guessed from the config extension when empty")
+	flags.Usage = func() { help(flags) }
+
+	err := flags.Parse(os.Args[1:])
+	if err != nil {
+		return err
+	}
+
+	format, err := ParseConfigFormat(*configFormat)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() < 1 {
+		help(flags)
 		return fmt.Errorf("not enough arguments")
 	}
 
 	sigCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
-	configPath := os.Args[1]
-	rawCfg, err := os.ReadFile(configPath)
+	configPath := flags.Arg(0)
+	set, err := ReadConfigSet(configPath, format)
 	if err != nil {
 		return err
 	}
 
-	dbRead, err := connectSqliteDb("observations.db")
+	dbRead, dbWrite, err := openObservations(sigCtx, "observations.db")
 	if err != nil {
 		return err
 	}
 	defer dbRead.Close()
-	dbRead.SetMaxOpenConns(runtime.NumCPU())
+	defer dbWrite.Close()
 
-	dbWrite, err := connectSqliteDb("observations.db")
+	app := newApp(dbRead, dbWrite)
+	meerkat := app.meerkat
+	err = meerkat.LoadConfig(sigCtx, set)
 	if err != nil {
 		return err
 	}
-	defer dbWrite.Close()
-	dbWrite.SetMaxOpenConns(1)
 
-	_, err = dbWrite.ExecContext(sigCtx, ddl)
-	if err != nil {
-		return err
+	var api *APIServer
+	if len(*listen) > 0 {
+		api = NewAPIServer(*listen, app.entityRepo, app.heartbeatRepo, app.metricsRepo, app.reports)
+		api.Handle("GET /status/{instance}", app.statusPages)
+		err = api.Start()
+		if err != nil {
+			return err
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// Files of the last read config, including ones that failed
+	var watchedMu sync.Mutex
+	watched := set.Files
+
+	var changed <-chan struct{}
+	if *watch {
+		changed = watchConfig(sigCtx, func() []string {
+			watchedMu.Lock()
+			defer watchedMu.Unlock()
+			return append([]string{configPath}, watched...)
+		}, configWatchInterval)
+	}
+
+	logger := utils.DefaultLogger()
+	reload := func(reason string) {
+		logger.Info("Reloading config", "path", configPath, "reason", reason)
+		set, err := ReadConfigSet(configPath, format)
+		watchedMu.Lock()
+		watched = set.Files
+		watchedMu.Unlock()
+		if err == nil {
+			err = meerkat.LoadConfig(sigCtx, set)
+		}
+		if err != nil {
+			logger.Error("Could not reload config, keeping the running one", "err", err)
+		}
 	}
 
+running:
+	for {
+		select {
+		case <-hup:
+			reload("SIGHUP")
+		case <-changed:
+			reload("file changed")
+		case <-sigCtx.Done():
+			break running
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 350*time.Millisecond)
+	defer cancel()
+
+	if api != nil {
+		err = api.Stop(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return meerkat.Stop(ctx)
+}
+
+// Repos and services shared by the commands that load a config
+type app struct {
+	entityRepo    *SqliteEntityRepo
+	heartbeatRepo *SqliteHeartbeatRepo
+	metricsRepo   *SqliteMetricsRepo
+	reports       *UptimeReporter
+	statusPages   *StatusPageService
+	meerkat       *Meerkat
+}
+
+func newApp(dbRead *sql.DB, dbWrite *sql.DB) *app {
 	readDB := db.New(dbRead)
 	writeDB := db.New(dbWrite)
 
-	entityRepo := NewSqliteEntityRepo(readDB, writeDB)
+	entityRepo := NewSqliteEntityRepo(readDB, dbWrite)
 	heartbeatRepo := NewSqliteHeartbeatRepo(readDB, writeDB, entityRepo)
 	metricsRepo := NewSqliteMetricsRepo(readDB, writeDB, entityRepo)
+	stateRepo := NewSqliteStateChangeRepo(readDB, writeDB, entityRepo)
+	deliveryRepo := NewSqliteDeliveryRepo(readDB, writeDB, entityRepo)
+
+	notifications := NewNotificationService(deliveryRepo)
+	alerts := NewAlertService(metricsRepo, notifications)
+	reports := NewUptimeReporter(entityRepo, heartbeatRepo)
+	stateSink := MultiStateChangeSink{
+		NewDBStateChangeSink(stateRepo),
+		notifications,
+	}
+
+	metricsSink := NewDBMetricsSink(metricsRepo)
+
+	monitorRegistry := NewRegistry("monitor")
+	RegisterMonitorTypes(monitorRegistry, metricsSink)
+
+	metricsRegistry := NewRegistry("metrics")
+	RegisterMetricsTypes(metricsRegistry, metricsSink)
+
+	monitorBuilder := func(serviceID utils.EntityID, rawCfg []byte) (utils.EntityID, *EntityInstance, error) {
+		return BuildMonitor(monitorRegistry, serviceID, rawCfg)
+	}
 
 	monitorRunner := func(logger *utils.Logger, inst *EntityInstance) {
-		RunMonitor(heartbeatRepo, logger, inst)
+		RunMonitor(heartbeatRepo, stateRepo, stateSink, logger, inst)
 	}
 
 	metricsBuilder := func(serviceID utils.EntityID, rawCfg []byte) (utils.EntityID, *EntityInstance, error) {
-		return BuildMetrics(metricsRepo, serviceID, rawCfg)
+		return BuildMetrics(metricsRegistry, serviceID, rawCfg)
 	}
 
-	monitorService := NewEntityService("monitor", BuildMonitor, monitorRunner, entityRepo)
+	monitorService := NewEntityService("monitor", monitorBuilder, monitorRunner, entityRepo)
 	metricsSerivce := NewEntityService("metrics", metricsBuilder, RunMetrics, entityRepo)
 
-	meerkat := NewMeerkat([]*EntityService{monitorService, metricsSerivce})
-	err = meerkat.LoadConfig(sigCtx, rawCfg)
+	statusPages := NewStatusPageService(monitorService, heartbeatRepo, stateRepo)
+
+	return &app{
+		entityRepo:    entityRepo,
+		heartbeatRepo: heartbeatRepo,
+		metricsRepo:   metricsRepo,
+		reports:       reports,
+		statusPages:   statusPages,
+		meerkat:       NewMeerkat(entityRepo, []*EntityService{monitorService, metricsSerivce}, notifications, alerts, reports, statusPages),
+	}
+}
+
+func runReport(args []string) error {
+	flags := flag.NewFlagSet("meerkat report", flag.ContinueOnError)
+	window := flags.String("window", defaultReportWindow, "report window, like 24h, 7d, month or 2006-01")
+	from := flags.String("from", "", "start of the report as RFC 3339, overrides -window")
+	to := flags.String("to", "", "end of the report as RFC 3339, defaults to now")
+	format := flags.String("format", "json", "output format, json or csv")
+	instance := flags.String("instance", "", "only report on this instance")
+	configFormat := flags.String("config-format", "", "json, yaml or toml, guessed from the config extension when empty")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "./meerkat report [flags] [config file or directory]")
+		fmt.Fprintln(os.Stderr, "The config is optional and only used for its maintenance windows")
+		flags.PrintDefaults()
+	}
+
+	err := flags.Parse(args)
 	if err != nil {
 		return err
 	}
 
-	<-sigCtx.Done()
-	ctx, cancel := context.WithTimeout(context.Background(), 350*time.Millisecond)
-	defer cancel()
-	return meerkat.Stop(ctx)
+	now := time.Now()
+	if len(*to) > 0 {
+		now, err = time.Parse(time.RFC3339, *to)
+		if err != nil {
+			return fmt.Errorf("invalid -to: %w", err)
+		}
+	}
+
+	fromTs, toTs, err := ParseReportWindow(*window, now)
+	if err != nil {
+		return err
+	}
+	if len(*from) > 0 {
+		fromTs, err = time.Parse(time.RFC3339, *from)
+		if err != nil {
+			return fmt.Errorf("invalid -from: %w", err)
+		}
+		toTs = now
+	}
+	if !fromTs.Before(toTs) {
+		return fmt.Errorf("start of the report should be before its end")
+	}
+
+	ctx := context.Background()
+	dbRead, dbWrite, err := openObservations(ctx, "observations.db")
+	if err != nil {
+		return err
+	}
+	defer dbRead.Close()
+	defer dbWrite.Close()
+
+	readDB := db.New(dbRead)
+	writeDB := db.New(dbWrite)
+
+	entityRepo := NewSqliteEntityRepo(readDB, dbWrite)
+	heartbeatRepo := NewSqliteHeartbeatRepo(readDB, writeDB, entityRepo)
+	reports := NewUptimeReporter(entityRepo, heartbeatRepo)
+
+	if flags.NArg() > 0 {
+		cfgFormat, err := ParseConfigFormat(*configFormat)
+		if err != nil {
+			return err
+		}
+
+		set, err := ReadConfigSet(flags.Arg(0), cfgFormat)
+		if err != nil {
+			return err
+		}
+
+		for _, cfg := range set.Instances {
+			windows, err := reports.PrepareInstance(cfg.Name, cfg.Maintenance)
+			if err != nil {
+				return err
+			}
+			reports.ApplyInstance(cfg.Name, windows)
+		}
+	}
+
+	report, err := reports.Report(ctx, fromTs, toTs, *instance)
+	if err != nil {
+		return err
+	}
+
+	return WriteUptimeReport(os.Stdout, report, *format)
 }
 
 func main() {
@@ -97,19 +305,70 @@ func main() {
 	}
 }
 
+// Opens the read and write pools of the observations database and makes sure
+// its schema is up to date
+func openObservations(ctx context.Context, dbName string) (*sql.DB, *sql.DB, error) {
+	dbRead, err := connectSqliteDb(dbName)
+	if err != nil {
+		return nil, nil, err
+	}
+	dbRead.SetMaxOpenConns(runtime.NumCPU())
+
+	dbWrite, err := connectSqliteDb(dbName)
+	if err != nil {
+		dbRead.Close()
+		return nil, nil, err
+	}
+	dbWrite.SetMaxOpenConns(1)
+
+	_, err = dbWrite.ExecContext(ctx, ddl)
+	if err == nil {
+		err = migrate(ctx, dbWrite)
+	}
+	if err != nil {
+		dbRead.Close()
+		dbWrite.Close()
+		return nil, nil, err
+	}
+
+	return dbRead, dbWrite, nil
+}
+
 func connectSqliteDb(dbName string) (*sql.DB, error) {
-	return sql.Open("sqlite", dbName)
+	// Readers and the writer use separate pools, WAL and a busy timeout keep
+	// them from failing with SQLITE_BUSY when monitors write at the same time.
+	// Timestamps are stored in a sortable format so they can be range queried
+	return sql.Open("sqlite", "file:"+dbName+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite")
+}
+
+// Opens the database of a running meerkat without changing it, its schema is
+// left as it is
+func connectSqliteDbReadOnly(dbName string) (*sql.DB, error) {
+	return sql.Open("sqlite", "file:"+dbName+"?mode=ro&_pragma=busy_timeout(5000)&_time_format=sqlite")
 }
 
 type ConfigDiff struct {
-	Add    []string
-	Update []string
-	Delete []string
+	Add       []string
+	Update    []string
+	Delete    []string
+	Unchanged []string
 }
 
 type InstanceConfig struct {
-	Name     string            `json:"name"`
-	Services []json.RawMessage `json:"services"`
+	Name      string            `json:"name"`
+	Services  []json.RawMessage `json:"services"`
+	Notifiers []json.RawMessage `json:"notifiers,omitempty"`
+	Alerts    []json.RawMessage `json:"alerts,omitempty"`
+	// Periods left out of uptime reports
+	Maintenance []json.RawMessage `json:"maintenance,omitempty"`
+	// Served on /status/<name> when set
+	StatusPage json.RawMessage `json:"status_page,omitempty"`
+	// Merged under every entity of the instance. Keys named after an entity
+	// kind, like monitor, are merged under entities of that kind only
+	Defaults json.RawMessage `json:"defaults,omitempty"`
+	// Named entity configs that entities can extend, they can extend each
+	// other too
+	Templates map[string]json.RawMessage `json:"templates,omitempty"`
 }
 
 func (c *InstanceConfig) Valid(ctx context.Context) map[string]string {
@@ -128,7 +387,11 @@ func (c *InstanceConfig) Valid(ctx context.Context) map[string]string {
 }
 
 type ServiceConfig struct {
-	Name string `json:"name"`
+	Name      string            `json:"name"`
+	Notifiers []json.RawMessage `json:"notifiers"`
+	// Merged under every entity of the service over the instance defaults,
+	// scoped by entity kind the same way
+	Defaults json.RawMessage `json:"defaults"`
 }
 
 func (c *ServiceConfig) Valid(ctx context.Context) map[string]string {
@@ -153,80 +416,50 @@ func NewServiceID(instance string, name string) utils.EntityID {
 }
 
 type Meerkat struct {
-	services map[string]*EntityService
-
-	rawCfg []byte
-	cfg    InstanceConfig
-	mu     sync.RWMutex
+	entityRepo    EntityRepo
+	services      map[string]*EntityService
+	notifications *NotificationService
+	alerts        *AlertService
+	reports       *UptimeReporter
+	statusPages   *StatusPageService
+
+	logger *utils.Logger
+
+	// Configs of the running instances
+	instances map[string]InstanceConfig
+	mu        sync.RWMutex
 }
 
-func NewMeerkat(services []*EntityService) *Meerkat {
+func NewMeerkat(entityRepo EntityRepo, services []*EntityService, notifications *NotificationService, alerts *AlertService, reports *UptimeReporter, statusPages *StatusPageService) *Meerkat {
 	serviceMap := make(map[string]*EntityService, len(services))
 	for _, service := range services {
 		serviceMap[service.Name] = service
 	}
 	return &Meerkat{
-		services: serviceMap,
+		entityRepo:    entityRepo,
+		services:      serviceMap,
+		notifications: notifications,
+		alerts:        alerts,
+		reports:       reports,
+		statusPages:   statusPages,
+		logger:        utils.DefaultLogger(),
 	}
 }
 
-func (m *Meerkat) LoadConfig(ctx context.Context, newConfig []byte) error {
-	var cfg InstanceConfig
-	err := json.Unmarshal(newConfig, &cfg)
-	if err != nil {
-		return err
-	}
-
-	problems := cfg.Valid(context.TODO())
-	if len(problems) > 0 {
-		return NewValidationError(problems, cfg.Name)
-	}
-
+// Validates the whole config before touching anything, so a config that
+// fails leaves everything running as it was
+func (m *Meerkat) LoadConfig(ctx context.Context, set *ConfigSet) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	for i, service := range cfg.Services {
-		var servCfg map[string]json.RawMessage
-		err := json.Unmarshal(service, &servCfg)
-		if err != nil {
-			return err
-		}
-
-		anyName, exists := servCfg["name"]
-		if !exists {
-			err := NewNoNameError(cfg.Name)
-			err.SetIndex(i)
-			return err
-		}
-		var name string
-		err = json.Unmarshal(anyName, &name)
-		if !exists || err != nil {
-			err := NewNoNameError(cfg.Name)
-			err.SetIndex(i)
-			return err
-		}
-
-		id := NewServiceID(cfg.Name, name)
-		for name, entService := range m.services {
-			var configs []json.RawMessage
-			rawConfigs, exists := servCfg[name]
-			if !exists {
-				continue
-			}
+	plan, err := m.Plan(set)
+	if err != nil {
+		return err
+	}
 
-			err = json.Unmarshal(rawConfigs, &configs)
-			if err != nil {
-				return err
-			}
-			err = entService.LoadService(ctx, id, configs)
-			var val ConfigError
-			if errors.As(err, &val) {
-				val.PrependPath(cfg.Name)
-				return err
-			} else if err != nil {
-				return err
-			}
-		}
+	err = m.apply(ctx, plan)
+	if err != nil {
+		return err
 	}
 
 	return nil
@@ -262,6 +495,13 @@ func (m *Meerkat) Stop(ctx context.Context) error {
 	case err := <-errChan:
 		return err
 	case <-done:
-		return nil
 	}
+
+	err := m.alerts.Stop(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Monitors and alerts are stopped, so no new notifications can come in
+	return m.notifications.Stop(ctx)
 }
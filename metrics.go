@@ -5,9 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
-	"strconv"
-	"strings"
+	"maps"
+	"path"
+	"slices"
 	"time"
 
 	"meerkat-v0/db"
@@ -16,7 +16,7 @@ import (
 
 func NewMetricsID(instance, service, monType, name string) utils.EntityID {
 	return utils.EntityID{
-		Kind: "monitor",
+		Kind: "metrics",
 		Labels: map[string]string{
 			"instance": instance,
 			"service":  service,
@@ -27,7 +27,7 @@ func NewMetricsID(instance, service, monType, name string) utils.EntityID {
 }
 
 func NewMetricsIDFromServiceID(serviceID utils.EntityID, monType, name string) utils.EntityID {
-	return NewMonitorID(
+	return NewMetricsID(
 		serviceID.Labels["instance"],
 		serviceID.Labels["name"],
 		monType,
@@ -44,6 +44,8 @@ const (
 )
 
 type MetricsSample struct {
+	// Set on samples read back from a repo
+	RowID     int64
 	ID        utils.EntityID
 	Timestamp time.Time
 	Type      MetricType
@@ -52,12 +54,135 @@ type MetricsSample struct {
 	Labels    map[string]string
 }
 
+// Checks that every selector label matches the sample label with the same
+// key, or the entity ID label when the sample doesn't have it
+func MatchLabels(selector map[string]string, sample MetricsSample) bool {
+	for key, value := range selector {
+		got, ok := sample.Labels[key]
+		if !ok {
+			got, ok = sample.ID.Labels[key]
+		}
+		if !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Include and exclude globs for names like mountpoints or devices
+type GlobFilter struct {
+	// Every name is included when empty
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+func (f GlobFilter) Valid() error {
+	for _, pattern := range slices.Concat(f.Include, f.Exclude) {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("invalid glob '%s'", pattern)
+		}
+	}
+	return nil
+}
+
+// Checks that the name matches one of the include globs, if there are any,
+// and none of the exclude globs
+func (f GlobFilter) Match(name string) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(f.Include) > 0 && !matches(f.Include) {
+		return false
+	}
+	return !matches(f.Exclude)
+}
+
+func (f GlobFilter) Equal(other GlobFilter) bool {
+	return slices.Equal(f.Include, other.Include) && slices.Equal(f.Exclude, other.Exclude)
+}
+
+// A counter of a device, like bytes read from a disk
+type counterSample struct {
+	name  string
+	value uint64
+	unit  string
+}
+
+// Tracks counters between runs to derive their per-second rates
+type counterRates struct {
+	prevAt time.Time
+	prev   map[string]uint64
+	at     time.Time
+	cur    map[string]uint64
+}
+
+// Starts a run, counters of the previous one become the base of the rates
+func (r *counterRates) start(now time.Time) {
+	r.prevAt, r.prev = r.at, r.cur
+	r.at, r.cur = now, make(map[string]uint64)
+}
+
+// False on the first run, or when the counter went back like after a reboot
+func (r *counterRates) rate(key string, value uint64) (float64, bool) {
+	r.cur[key] = value
+	prev, ok := r.prev[key]
+	if !ok || value < prev || !r.at.After(r.prevAt) {
+		return 0, false
+	}
+	return float64(value-prev) / r.at.Sub(r.prevAt).Seconds(), true
+}
+
+// Emits the counters of a device, and their rates as gauges suffixed with
+// _rate when rates isn't nil
+func emitCounters(ctx context.Context, sink MetricsSink, id utils.EntityID, now time.Time, device string, counters []counterSample, rates *counterRates) []error {
+	var errs []error
+	emit := func(metricType MetricType, name string, value float64, unit string) {
+		err := sink.Emit(ctx, MetricsSample{
+			ID:        id,
+			Timestamp: now,
+			Type:      metricType,
+			Name:      name,
+			Value:     value,
+			Labels: map[string]string{
+				"device": device,
+				"unit":   unit,
+			},
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, counter := range counters {
+		emit(MetricCounter, counter.name, float64(counter.value), counter.unit)
+		if rates == nil {
+			continue
+		}
+		rate, ok := rates.rate(device+"|"+counter.name, counter.value)
+		if ok {
+			emit(MetricGauge, counter.name+"_rate", rate, counter.unit+"/s")
+		}
+	}
+	return errs
+}
+
 type MetricsSink interface {
 	Emit(context.Context, MetricsSample) error
 }
 
 type MetricsRepo interface {
 	InsertSample(context.Context, MetricsSample) error
+	// Returns samples with the name in [from, to) ordered by time
+	ListSamples(ctx context.Context, name string, from time.Time, to time.Time) ([]MetricsSample, error)
+	// Returns up to limit samples with the name in [from, to) that come
+	// after the sample with afterID and match the selector like MatchLabels
+	PageSamples(ctx context.Context, name string, selector map[string]string, from time.Time, to time.Time, afterID int64, limit int) ([]MetricsSample, error)
 }
 
 type DBMetricsSink struct {
@@ -74,40 +199,78 @@ func (s *DBMetricsSink) Emit(ctx context.Context, sample MetricsSample) error {
 	return s.metricsRepo.InsertSample(ctx, sample)
 }
 
-func BuildMetrics(metricsRepo MetricsRepo, serviceID utils.EntityID, rawCfg []byte) (utils.EntityID, *EntityInstance, error) {
+func RegisterMetricsTypes(r *Registry, sink MetricsSink) {
+	r.MustRegister(EntityType{
+		Name:        "cpu",
+		Description: "Reports load averages and CPU utilisation from /proc/loadavg and /proc/stat",
+		Config:      func() Validator { return &CPUConfig{} },
+		New:         func() Entity { return &CPUMetrics{sink: sink} },
+	})
+	r.MustRegister(EntityType{
+		Name:        "memory",
+		Description: "Reports memory and swap usage from /proc/meminfo",
+		Config:      func() Validator { return &MemoryConfig{} },
+		New:         func() Entity { return &MemoryMetrics{sink: sink} },
+	})
+	r.MustRegister(EntityType{
+		Name:        "disk",
+		Description: "Reports filesystem space and inode usage of mounts",
+		Config:      func() Validator { return &DiskConfig{} },
+		New:         func() Entity { return &DiskMetrics{sink: sink} },
+	})
+	r.MustRegister(EntityType{
+		Name:        "diskio",
+		Description: "Reports disk reads, writes and I/O time from /proc/diskstats",
+		Config:      func() Validator { return &DiskIOConfig{} },
+		New:         func() Entity { return &DiskIOMetrics{sink: sink} },
+	})
+	r.MustRegister(EntityType{
+		Name:        "network",
+		Description: "Reports traffic, errors and drops of network interfaces from /proc/net/dev",
+		Config:      func() Validator { return &NetworkConfig{} },
+		New:         func() Entity { return &NetworkMetrics{sink: sink} },
+	})
+	r.MustRegister(EntityType{
+		Name:        "process",
+		Description: "Reports memory, CPU time, threads, open files and uptime of matching processes",
+		Config:      func() Validator { return &ProcessMatch{} },
+		New:         func() Entity { return &ProcessMetrics{sink: sink} },
+	})
+}
+
+func BuildMetrics(registry *Registry, serviceID utils.EntityID, rawCfg []byte) (utils.EntityID, *EntityInstance, error) {
 	var id utils.EntityID
-	var cfg EntityConfig
-	err := json.Unmarshal(rawCfg, &cfg)
+	resolved, err := ResolveConfig(rawCfg)
 	if err != nil {
 		return id, nil, err
 	}
 
-	problems := cfg.Valid(context.TODO())
-	if len(problems) > 0 {
-		return id, nil, NewValidationError(problems, serviceID.Labels["name"], cfg.Name)
+	var cfg EntityConfig
+	err = json.Unmarshal(resolved.JSON, &cfg)
+	if err != nil {
+		return id, nil, err
 	}
 
-	id = NewMonitorIDFromServiceID(serviceID, cfg.Type, cfg.Name)
+	problems := cfg.Valid(context.TODO())
 
-	sink := NewDBMetricsSink(metricsRepo)
+	id = NewMetricsIDFromServiceID(serviceID, cfg.Type, cfg.Name)
 
-	// TODO: Replace with modules
 	var entity Entity
-	switch cfg.Type {
-	case "cpu":
-		entity = &CPUMetrics{
-			sink: sink,
+	if _, ok := problems["type"]; !ok {
+		entity, err = registry.Build(id, resolved.JSON)
+		var val *ValidationError
+		if errors.As(err, &val) {
+			maps.Copy(problems, val.Problems)
+		} else if err != nil {
+			return id, nil, resolved.Secrets.RedactError(err)
 		}
-	default:
-		return id, nil, fmt.Errorf("unknown metrics type: %s", cfg.Type)
 	}
 
-	err = entity.Configure(id, rawCfg)
-	if err != nil {
-		return id, nil, err
+	if valErr := resolved.ValidationError(problems, serviceID.Labels["instance"], serviceID.Labels["name"], cfg.Name); valErr != nil {
+		return id, nil, valErr
 	}
 
-	return id, NewEntityInstance(id, entity, cfg, rawCfg), nil
+	return id, NewEntityInstance(id, entity, cfg, rawCfg, resolved), nil
 }
 
 func RunMetrics(logger *utils.Logger, inst *EntityInstance) {
@@ -118,9 +281,9 @@ func RunMetrics(logger *utils.Logger, inst *EntityInstance) {
 	for {
 		select {
 		case <-ticker.C:
-			err := inst.Ent.Run(inst.ctx)
-			if errors.Is(err, context.Canceled) {
-				logger.Warn("Metrics tick error", "id", inst.ID.Canonical(), "err", err)
+			_, err := inst.Ent.Run(inst.ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				logger.Warn("Metrics tick error", "id", inst.ID.Canonical(), "err", inst.Resolved.Secrets.RedactError(err))
 				continue
 			}
 		case <-inst.ctx.Done():
@@ -129,42 +292,6 @@ func RunMetrics(logger *utils.Logger, inst *EntityInstance) {
 	}
 }
 
-type CPUMetrics struct {
-	ID   utils.EntityID
-	sink MetricsSink
-}
-
-func (m *CPUMetrics) Run(ctx context.Context) error {
-	contents, err := os.ReadFile("/proc/loadavg")
-	if err != nil {
-		return err
-	}
-	values := strings.Split(string(contents), " ")
-	f64, err := strconv.ParseFloat(values[0], 32)
-	if err != nil {
-		return err
-	}
-	return m.sink.Emit(ctx, MetricsSample{
-		ID:        m.ID,
-		Timestamp: time.Now(),
-		Type:      MetricGauge,
-		Name:      "cpu_loadavg",
-		Value:     f64,
-		Labels: map[string]string{
-			"span": "1m",
-		},
-	})
-}
-
-func (m *CPUMetrics) Configure(id utils.EntityID, cfg []byte) error {
-	m.ID = id
-	return nil
-}
-
-func (m *CPUMetrics) Eq(newCfg []byte) (bool, error) {
-	return true, nil
-}
-
 type SqliteMetricsRepo struct {
 	readDB     *db.Queries
 	writeDB    *db.Queries
@@ -192,7 +319,7 @@ func (r *SqliteMetricsRepo) InsertSample(ctx context.Context, sample MetricsSamp
 
 	_, err = r.writeDB.InsertMetrics(ctx, db.InsertMetricsParams{
 		EntityID: eId,
-		Ts:       sample.Timestamp,
+		Ts:       sample.Timestamp.UTC(),
 		Type:     string(sample.Type),
 		Value:    sample.Value,
 		Name:     sample.Name,
@@ -204,3 +331,72 @@ func (r *SqliteMetricsRepo) InsertSample(ctx context.Context, sample MetricsSamp
 
 	return nil
 }
+
+func (r *SqliteMetricsRepo) ListSamples(ctx context.Context, name string, from time.Time, to time.Time) ([]MetricsSample, error) {
+	rows, err := r.readDB.ListMetricSamples(ctx, db.ListMetricSamplesParams{
+		Name:   name,
+		FromTs: from.UTC(),
+		ToTs:   to.UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]MetricsSample, len(rows))
+	for i, row := range rows {
+		samples[i], err = sampleFromRow(row)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+func (r *SqliteMetricsRepo) PageSamples(ctx context.Context, name string, selector map[string]string, from time.Time, to time.Time, afterID int64, limit int) ([]MetricsSample, error) {
+	if selector == nil {
+		selector = map[string]string{}
+	}
+	rawSelector, err := json.Marshal(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.readDB.ListMetricSamplesPage(ctx, db.ListMetricSamplesPageParams{
+		Name:     name,
+		FromTs:   from.UTC(),
+		ToTs:     to.UTC(),
+		AfterID:  afterID,
+		Selector: string(rawSelector),
+		PageSize: int64(limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]MetricsSample, len(rows))
+	for i, row := range rows {
+		samples[i], err = sampleFromRow(db.ListMetricSamplesRow(row))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+func sampleFromRow(row db.ListMetricSamplesRow) (MetricsSample, error) {
+	var labels map[string]string
+	err := json.Unmarshal(row.Labels, &labels)
+	if err != nil {
+		return MetricsSample{}, err
+	}
+
+	return MetricsSample{
+		RowID:     row.ID,
+		ID:        utils.ParseEntityID(row.CanonicalID),
+		Timestamp: row.Ts,
+		Type:      MetricType(row.Type),
+		Name:      row.Name,
+		Value:     row.Value,
+		Labels:    labels,
+	}, nil
+}
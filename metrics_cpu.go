@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+const (
+	defaultLoadavgPath = "/proc/loadavg"
+	defaultStatPath    = "/proc/stat"
+)
+
+type CPUConfig struct {
+	// Defaults to /proc/loadavg
+	LoadavgPath string `json:"loadavg_path"`
+	// Defaults to /proc/stat
+	StatPath string `json:"stat_path"`
+}
+
+func (c *CPUConfig) Valid(ctx context.Context) map[string]string {
+	return nil
+}
+
+type CPUMetrics struct {
+	ID   utils.EntityID
+	cfg  CPUConfig
+	sink MetricsSink
+
+	// Times of the previous /proc/stat read, utilisation is reported from
+	// the second run on
+	prevTimes map[string]CPUTimes
+}
+
+type Loadavg struct {
+	Load1    float64
+	Load5    float64
+	Load15   float64
+	Runnable uint64
+	Total    uint64
+}
+
+func ParseLoadavg(contents []byte) (Loadavg, error) {
+	var avg Loadavg
+	fields := strings.Fields(string(contents))
+	if len(fields) < 4 {
+		return avg, fmt.Errorf("expected at least 4 fields, got %d", len(fields))
+	}
+
+	for i, load := range []*float64{&avg.Load1, &avg.Load5, &avg.Load15} {
+		var err error
+		*load, err = strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return avg, err
+		}
+	}
+
+	runnable, total, ok := strings.Cut(fields[3], "/")
+	if !ok {
+		return avg, fmt.Errorf("expected runnable/total tasks, got '%s'", fields[3])
+	}
+	var err error
+	avg.Runnable, err = strconv.ParseUint(runnable, 10, 64)
+	if err != nil {
+		return avg, err
+	}
+	avg.Total, err = strconv.ParseUint(total, 10, 64)
+	if err != nil {
+		return avg, err
+	}
+	return avg, nil
+}
+
+// Time a CPU spent in each mode, in USER_HZ ticks
+type CPUTimes struct {
+	User    uint64
+	Nice    uint64
+	System  uint64
+	Idle    uint64
+	IOWait  uint64
+	IRQ     uint64
+	SoftIRQ uint64
+	Steal   uint64
+}
+
+// Guest time is already counted in user time, so it's left out
+func (t CPUTimes) Total() uint64 {
+	return t.User + t.Nice + t.System + t.Idle + t.IOWait + t.IRQ + t.SoftIRQ + t.Steal
+}
+
+// Times of the cpu lines in /proc/stat keyed by their name, "cpu" is the
+// sum of all the cores
+func ParseStat(contents []byte) (map[string]CPUTimes, error) {
+	times := make(map[string]CPUTimes)
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		// Steal time is missing before Linux 2.6.11, it stays zero then
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("%s: expected at least 7 values, got %d", fields[0], len(fields)-1)
+		}
+
+		values := make([]uint64, 8)
+		for i := range values {
+			if i+1 >= len(fields) {
+				break
+			}
+			var err error
+			values[i], err = strconv.ParseUint(fields[i+1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", fields[0], err)
+			}
+		}
+		times[fields[0]] = CPUTimes{
+			User:    values[0],
+			Nice:    values[1],
+			System:  values[2],
+			Idle:    values[3],
+			IOWait:  values[4],
+			IRQ:     values[5],
+			SoftIRQ: values[6],
+			Steal:   values[7],
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := times["cpu"]; !ok {
+		return nil, fmt.Errorf("missing the cpu line")
+	}
+	return times, nil
+}
+
+// Percentages of the time between prev and cur spent in each mode. Nice
+// time counts as user, interrupts as system. False when the counters didn't
+// move forward, like after a reset
+func CPUUsage(prev, cur CPUTimes) (map[string]float64, bool) {
+	if cur.Total() <= prev.Total() {
+		return nil, false
+	}
+	total := float64(cur.Total() - prev.Total())
+	delta := func(cur, prev uint64) float64 {
+		if cur < prev {
+			return 0
+		}
+		return float64(cur-prev) / total * 100
+	}
+
+	return map[string]float64{
+		"user":   delta(cur.User+cur.Nice, prev.User+prev.Nice),
+		"system": delta(cur.System+cur.IRQ+cur.SoftIRQ, prev.System+prev.IRQ+prev.SoftIRQ),
+		"iowait": delta(cur.IOWait, prev.IOWait),
+		"steal":  delta(cur.Steal, prev.Steal),
+		"idle":   delta(cur.Idle, prev.Idle),
+	}, true
+}
+
+func (m *CPUMetrics) Run(ctx context.Context) (RunResult, error) {
+	now := time.Now()
+	var errs []error
+	emit := func(name string, value float64, labels map[string]string) {
+		err := m.sink.Emit(ctx, MetricsSample{
+			ID:        m.ID,
+			Timestamp: now,
+			Type:      MetricGauge,
+			Name:      name,
+			Value:     value,
+			Labels:    labels,
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	err := m.emitLoadavg(emit)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	err = m.emitUsage(emit)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return RunResult{}, errors.Join(errs...)
+}
+
+func (m *CPUMetrics) emitLoadavg(emit func(string, float64, map[string]string)) error {
+	contents, err := os.ReadFile(m.cfg.LoadavgPath)
+	if err != nil {
+		return err
+	}
+	avg, err := ParseLoadavg(contents)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.cfg.LoadavgPath, err)
+	}
+
+	emit("cpu_loadavg", avg.Load1, map[string]string{"span": "1m"})
+	emit("cpu_loadavg", avg.Load5, map[string]string{"span": "5m"})
+	emit("cpu_loadavg", avg.Load15, map[string]string{"span": "15m"})
+	emit("cpu_tasks_runnable", float64(avg.Runnable), map[string]string{"unit": "tasks"})
+	emit("cpu_tasks_total", float64(avg.Total), map[string]string{"unit": "tasks"})
+	return nil
+}
+
+func (m *CPUMetrics) emitUsage(emit func(string, float64, map[string]string)) error {
+	contents, err := os.ReadFile(m.cfg.StatPath)
+	if err != nil {
+		return err
+	}
+	times, err := ParseStat(contents)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.cfg.StatPath, err)
+	}
+
+	prevTimes := m.prevTimes
+	m.prevTimes = times
+	for name, cur := range times {
+		prev, ok := prevTimes[name]
+		if !ok {
+			continue
+		}
+		usage, ok := CPUUsage(prev, cur)
+		if !ok {
+			continue
+		}
+
+		cpu := strings.TrimPrefix(name, "cpu")
+		if len(cpu) == 0 {
+			cpu = "all"
+		}
+		for mode, value := range usage {
+			emit("cpu_usage", value, map[string]string{
+				"cpu":  cpu,
+				"mode": mode,
+				"unit": "percent",
+			})
+		}
+	}
+	return nil
+}
+
+func (m *CPUMetrics) Configure(id utils.EntityID, rawCfg []byte) error {
+	var cfg CPUConfig
+	err := json.Unmarshal(rawCfg, &cfg)
+	if err != nil {
+		return err
+	}
+	if len(cfg.LoadavgPath) == 0 {
+		cfg.LoadavgPath = defaultLoadavgPath
+	}
+	if len(cfg.StatPath) == 0 {
+		cfg.StatPath = defaultStatPath
+	}
+
+	m.ID = id
+	m.cfg = cfg
+	return nil
+}
+
+func (m *CPUMetrics) Eq(newRawCfg []byte) (bool, error) {
+	var newMet CPUMetrics
+	err := newMet.Configure(m.ID, newRawCfg)
+	if err != nil {
+		return false, err
+	}
+
+	return m.cfg == newMet.cfg, nil
+}
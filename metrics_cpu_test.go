@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseLoadavg(t *testing.T) {
+	testFixtures(t, "loadavg", ParseLoadavg, nil, []fixtureCase[Loadavg]{
+		{file: "busy", want: Loadavg{0.52, 0.58, 0.59, 2, 1205}},
+		{file: "idle", want: Loadavg{0, 0.01, 0.05, 1, 89}},
+		{file: "short", err: "expected at least 4 fields, got 2"},
+		{file: "bad-tasks", err: "expected runnable/total tasks"},
+		{file: "bad-load", err: "invalid syntax"},
+	})
+}
+
+func TestParseStat(t *testing.T) {
+	testFixtures(t, "stat", ParseStat, nil, []fixtureCase[map[string]CPUTimes]{
+		{
+			file: "linux-6.8",
+			want: map[string]CPUTimes{
+				"cpu":  {4705, 150, 1120, 16250, 520, 0, 66, 10},
+				"cpu0": {1393, 40, 326, 4012, 121, 0, 45, 3},
+				"cpu1": {1128, 37, 278, 4089, 140, 0, 9, 2},
+				"cpu2": {1107, 38, 264, 4087, 132, 0, 7, 3},
+				"cpu3": {1077, 35, 252, 4062, 127, 0, 5, 2},
+			},
+		},
+		{
+			// No steal column yet
+			file: "linux-2.6.9",
+			want: map[string]CPUTimes{
+				"cpu":  {2255, 34, 2290, 22625563, 6290, 127, 456, 0},
+				"cpu0": {1132, 34, 1441, 11311718, 3675, 127, 438, 0},
+				"cpu1": {1123, 0, 849, 11313845, 2614, 0, 18, 0},
+			},
+		},
+		{file: "no-cpu", err: "missing the cpu line"},
+		{file: "short", err: "cpu: expected at least 7 values, got 4"},
+		{file: "malformed", err: "cpu0: "},
+	})
+}
+
+func TestCPUUsage(t *testing.T) {
+	prev, err := ParseStat(readFixture(t, "stat", "linux-6.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := ParseStat(readFixture(t, "stat", "linux-6.8-later"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage, ok := CPUUsage(prev["cpu"], cur["cpu"])
+	if !ok {
+		t.Fatal("expected the counters to move forward")
+	}
+	// 279 ticks passed, nice counts as user and softirq as system
+	want := map[string]float64{
+		"user":   80.0 / 279 * 100,
+		"system": 34.0 / 279 * 100,
+		"iowait": 10.0 / 279 * 100,
+		"steal":  5.0 / 279 * 100,
+		"idle":   150.0 / 279 * 100,
+	}
+	for mode, percent := range want {
+		if math.Abs(usage[mode]-percent) > 1e-9 {
+			t.Errorf("%s: expected %.3f%%, got %.3f%%", mode, percent, usage[mode])
+		}
+	}
+
+	if _, ok := CPUUsage(cur["cpu"], prev["cpu"]); ok {
+		t.Errorf("expected counters going back to be ignored")
+	}
+}
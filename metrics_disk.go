@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+const (
+	defaultMountinfoPath = "/proc/self/mountinfo"
+	defaultStatfsTimeout = 5
+)
+
+type DiskConfig struct {
+	// Defaults to /proc/self/mountinfo
+	MountinfoPath string     `json:"mountinfo_path"`
+	Mountpoints   GlobFilter `json:"mountpoints"`
+	FSTypes       GlobFilter `json:"fstypes"`
+	// Seconds to wait for the usage of a mount, so a hung network mount
+	// doesn't block the others. Defaults to 5 seconds
+	Timeout int `json:"timeout"`
+}
+
+func (c *DiskConfig) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string)
+
+	err := c.Mountpoints.Valid()
+	if err != nil {
+		problems["mountpoints"] = err.Error()
+	}
+
+	err = c.FSTypes.Valid()
+	if err != nil {
+		problems["fstypes"] = err.Error()
+	}
+
+	if c.Timeout < 0 {
+		problems["timeout"] = "cannot be less than zero"
+	}
+
+	return problems
+}
+
+type DiskMetrics struct {
+	ID   utils.EntityID
+	cfg  DiskConfig
+	sink MetricsSink
+
+	statfs  func(path string, stat *syscall.Statfs_t) error
+	timeout time.Duration
+	// Statfs calls that timed out by mountpoint. They can't be cancelled,
+	// so the mount is skipped until its call returns instead of piling up
+	// goroutines. Only used by Run, which never runs concurrently
+	hung map[string]<-chan statfsResult
+}
+
+type statfsResult struct {
+	stat syscall.Statfs_t
+	err  error
+}
+
+type Mount struct {
+	Mountpoint string
+	Device     string
+	FSType     string
+}
+
+// Mounts of a mountinfo file in mount order. When a mountpoint is mounted
+// over, only the last mount is kept, it's the one statfs sees
+func ParseMountinfo(contents []byte) ([]Mount, error) {
+	var mounts []Mount
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		// Optional fields end with a lone dash, the filesystem type and
+		// source follow it
+		sep := slices.Index(fields, "-")
+		if sep < 5 || sep+2 >= len(fields) {
+			return nil, fmt.Errorf("invalid mountinfo line '%s'", scanner.Text())
+		}
+
+		mount := Mount{
+			Mountpoint: unescapeMountinfo(fields[4]),
+			FSType:     fields[sep+1],
+			Device:     unescapeMountinfo(fields[sep+2]),
+		}
+		mounts = slices.DeleteFunc(mounts, func(m Mount) bool {
+			return m.Mountpoint == mount.Mountpoint
+		})
+		mounts = append(mounts, mount)
+	}
+	return mounts, scanner.Err()
+}
+
+// Spaces, tabs, newlines and backslashes are escaped as octal like \040
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func (m *DiskMetrics) Run(ctx context.Context) (RunResult, error) {
+	contents, err := os.ReadFile(m.cfg.MountinfoPath)
+	if err != nil {
+		return RunResult{}, err
+	}
+	mounts, err := ParseMountinfo(contents)
+	if err != nil {
+		return RunResult{}, fmt.Errorf("%s: %w", m.cfg.MountinfoPath, err)
+	}
+
+	now := time.Now()
+	var errs []error
+	for _, mount := range mounts {
+		if !m.cfg.Mountpoints.Match(mount.Mountpoint) || !m.cfg.FSTypes.Match(mount.FSType) {
+			continue
+		}
+
+		stat, err := m.statfsTimeout(ctx, mount.Mountpoint)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", mount.Mountpoint, err))
+			continue
+		}
+		// Pseudo filesystems like proc and sysfs have no blocks
+		if stat.Blocks == 0 {
+			continue
+		}
+
+		blockSize := uint64(stat.Bsize)
+		gauges := []struct {
+			name  string
+			value uint64
+			unit  string
+		}{
+			{"disk_total", stat.Blocks * blockSize, "bytes"},
+			{"disk_used", (stat.Blocks - stat.Bfree) * blockSize, "bytes"},
+			// Space reserved for root isn't counted as free, like df does
+			{"disk_free", stat.Bavail * blockSize, "bytes"},
+			{"disk_inodes_total", stat.Files, "inodes"},
+			{"disk_inodes_used", stat.Files - min(stat.Ffree, stat.Files), "inodes"},
+			{"disk_inodes_free", stat.Ffree, "inodes"},
+		}
+		for _, gauge := range gauges {
+			err := m.sink.Emit(ctx, MetricsSample{
+				ID:        m.ID,
+				Timestamp: now,
+				Type:      MetricGauge,
+				Name:      gauge.name,
+				Value:     float64(gauge.value),
+				Labels: map[string]string{
+					"mountpoint": mount.Mountpoint,
+					"device":     mount.Device,
+					"fstype":     mount.FSType,
+					"unit":       gauge.unit,
+				},
+			})
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return RunResult{}, errors.Join(errs...)
+}
+
+// Runs statfs in the background and gives up on it after the timeout
+func (m *DiskMetrics) statfsTimeout(ctx context.Context, mountpoint string) (syscall.Statfs_t, error) {
+	if pending, ok := m.hung[mountpoint]; ok {
+		select {
+		case <-pending:
+			delete(m.hung, mountpoint)
+		default:
+			return syscall.Statfs_t{}, errors.New("statfs of an earlier run hasn't returned yet")
+		}
+	}
+
+	done := make(chan statfsResult, 1)
+	go func() {
+		var res statfsResult
+		res.err = m.statfs(mountpoint, &res.stat)
+		done <- res
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	select {
+	case res := <-done:
+		return res.stat, res.err
+	case <-ctx.Done():
+		m.hung[mountpoint] = done
+		return syscall.Statfs_t{}, fmt.Errorf("statfs timed out after %s", m.timeout)
+	}
+}
+
+func (m *DiskMetrics) Configure(id utils.EntityID, rawCfg []byte) error {
+	var cfg DiskConfig
+	err := json.Unmarshal(rawCfg, &cfg)
+	if err != nil {
+		return err
+	}
+	if len(cfg.MountinfoPath) == 0 {
+		cfg.MountinfoPath = defaultMountinfoPath
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultStatfsTimeout
+	}
+
+	m.ID = id
+	m.cfg = cfg
+	m.statfs = syscall.Statfs
+	m.timeout = time.Duration(cfg.Timeout) * time.Second
+	m.hung = make(map[string]<-chan statfsResult)
+	return nil
+}
+
+func (m *DiskMetrics) Eq(newRawCfg []byte) (bool, error) {
+	var newMet DiskMetrics
+	err := newMet.Configure(m.ID, newRawCfg)
+	if err != nil {
+		return false, err
+	}
+
+	return m.cfg.MountinfoPath == newMet.cfg.MountinfoPath &&
+		m.cfg.Timeout == newMet.cfg.Timeout &&
+		m.cfg.Mountpoints.Equal(newMet.cfg.Mountpoints) &&
+		m.cfg.FSTypes.Equal(newMet.cfg.FSTypes), nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDiskMetricsHungMount(t *testing.T) {
+	mountinfo := filepath.Join(t.TempDir(), "mountinfo")
+	err := os.WriteFile(mountinfo, []byte(
+		"22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"+
+			"40 22 0:45 / /mnt/nfs rw,relatime shared:30 - nfs4 server:/export rw\n",
+	), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawCfg, err := json.Marshal(DiskConfig{MountinfoPath: mountinfo})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &memorySink{}
+	m := &DiskMetrics{sink: sink}
+	err = m.Configure(NewMetricsID("home", "host", "disk", "disks"), rawCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.timeout = 20 * time.Millisecond
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	m.statfs = func(path string, stat *syscall.Statfs_t) error {
+		mu.Lock()
+		calls[path]++
+		mu.Unlock()
+		if path == "/mnt/nfs" {
+			<-release
+		}
+		stat.Blocks = 100
+		stat.Bsize = 4096
+		return nil
+	}
+	nfsCalls := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls["/mnt/nfs"]
+	}
+	mountpoints := func() map[string]bool {
+		seen := make(map[string]bool)
+		for _, sample := range sink.named("disk_total") {
+			seen[sample.Labels["mountpoint"]] = true
+		}
+		return seen
+	}
+
+	_, err = m.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "/mnt/nfs: statfs timed out") {
+		t.Fatalf("expected the nfs mount to time out, got %v", err)
+	}
+	if seen := mountpoints(); !seen["/"] || seen["/mnt/nfs"] {
+		t.Errorf("expected only / to be reported, got %v", seen)
+	}
+
+	// The hung call is waited out, not started again
+	_, err = m.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "hasn't returned yet") {
+		t.Fatalf("expected the nfs mount to be skipped, got %v", err)
+	}
+	if n := nfsCalls(); n != 1 {
+		t.Errorf("expected a single statfs of the nfs mount, got %d", n)
+	}
+
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err = m.Run(context.Background())
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("expected the mount to recover, got %v", err)
+	}
+	if seen := mountpoints(); !seen["/mnt/nfs"] {
+		t.Errorf("expected the nfs mount to be reported again, got %v", seen)
+	}
+}
+
+func TestDiskMetricsFilters(t *testing.T) {
+	tests := []struct {
+		name        string
+		mountpoints GlobFilter
+		fstypes     GlobFilter
+		want        []string
+	}{
+		{
+			name: "everything with blocks",
+			want: []string{"/", "/boot/efi", "/dev", "/home", "/media/usb\tstick\\x", "/mnt/backup disk"},
+		},
+		{
+			name:        "included mountpoints",
+			mountpoints: GlobFilter{Include: []string{"/", "/home"}},
+			want:        []string{"/", "/home"},
+		},
+		{
+			// Globs match whole paths, not prefixes
+			name:        "glob below a directory",
+			mountpoints: GlobFilter{Include: []string{"/boot", "/mnt/*"}},
+			want:        []string{"/mnt/backup disk"},
+		},
+		{
+			name:        "excluded mountpoints",
+			mountpoints: GlobFilter{Exclude: []string{"/media/*", "/mnt/*", "/dev"}},
+			want:        []string{"/", "/boot/efi", "/home"},
+		},
+		{
+			name:    "included fstypes",
+			fstypes: GlobFilter{Include: []string{"ext4", "btrfs"}},
+			want:    []string{"/", "/home"},
+		},
+		{
+			name:        "exclude wins over include",
+			mountpoints: GlobFilter{Include: []string{"/*"}, Exclude: []string{"/dev"}},
+			fstypes:     GlobFilter{Exclude: []string{"nfs*", "vfat"}},
+			want:        []string{"/", "/home"},
+		},
+		{
+			name:        "pseudo filesystems have no usage",
+			mountpoints: GlobFilter{Include: []string{"/proc", "/sys"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DiskConfig{
+				MountinfoPath: filepath.Join("testdata", "mountinfo", "host"),
+				Mountpoints:   tt.mountpoints,
+				FSTypes:       tt.fstypes,
+			}
+			if problems := cfg.Valid(context.Background()); len(problems) > 0 {
+				t.Fatalf("config is invalid: %v", problems)
+			}
+			rawCfg, err := json.Marshal(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sink := &memorySink{}
+			m := &DiskMetrics{sink: sink}
+			err = m.Configure(NewMetricsID("home", "host", "disk", "disks"), rawCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var statted []string
+			m.statfs = func(path string, stat *syscall.Statfs_t) error {
+				statted = append(statted, path)
+				if path != "/proc" && path != "/sys" {
+					stat.Blocks = 100
+					stat.Bsize = 4096
+				}
+				return nil
+			}
+
+			_, err = m.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, sample := range sink.named("disk_total") {
+				got = append(got, sample.Labels["mountpoint"])
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+			// Filtered out mounts aren't even looked at
+			for _, path := range statted {
+				if !tt.mountpoints.Match(path) {
+					t.Errorf("expected %s not to be statted", path)
+				}
+			}
+		})
+	}
+}
+
+func TestDiskConfigInvalidGlob(t *testing.T) {
+	cfg := DiskConfig{FSTypes: GlobFilter{Exclude: []string{"nfs["}}}
+	problems := cfg.Valid(context.Background())
+	if problems["fstypes"] != "invalid glob 'nfs['" {
+		t.Errorf("expected the glob to be invalid, got %v", problems)
+	}
+}
+
+func TestParseMountinfo(t *testing.T) {
+	testFixtures(t, "mountinfo", ParseMountinfo, nil, []fixtureCase[[]Mount]{
+		{
+			file: "host",
+			want: []Mount{
+				{"/sys", "sysfs", "sysfs"},
+				{"/proc", "proc", "proc"},
+				{"/dev", "udev", "devtmpfs"},
+				{"/", "/dev/nvme0n1p2", "ext4"},
+				{"/boot/efi", "/dev/nvme0n1p1", "vfat"},
+				{"/home", "/dev/mapper/vg-home", "btrfs"},
+				{"/mnt/backup disk", "nas:/export/backup disk", "nfs4"},
+				{"/media/usb\tstick\\x", "/dev/sdb1", "vfat"},
+			},
+		},
+		{
+			// Only the mount on top is visible
+			file: "overmounted",
+			want: []Mount{
+				{"/", "/dev/nvme0n1p2", "ext4"},
+				{"/tmp", "/dev/nvme0n1p3", "xfs"},
+			},
+		},
+		{file: "empty"},
+		{file: "no-separator", err: "invalid mountinfo line"},
+		{file: "truncated", err: "invalid mountinfo line"},
+	})
+}
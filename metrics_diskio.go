@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+const defaultDiskstatsPath = "/proc/diskstats"
+
+// Sizes in /proc/diskstats are in 512 byte sectors, whatever the device's
+// sector size is
+const diskstatsSectorSize = 512
+
+type DiskIOConfig struct {
+	// Defaults to /proc/diskstats
+	Path    string     `json:"path"`
+	Devices GlobFilter `json:"devices"`
+	// Also emit per-second rates of the counters
+	Rates bool `json:"rates"`
+}
+
+func (c *DiskIOConfig) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string)
+
+	err := c.Devices.Valid()
+	if err != nil {
+		problems["devices"] = err.Error()
+	}
+
+	return problems
+}
+
+type DiskIOMetrics struct {
+	ID   utils.EntityID
+	cfg  DiskIOConfig
+	sink MetricsSink
+
+	rates counterRates
+}
+
+type DiskStats struct {
+	Device       string
+	Reads        uint64
+	ReadSectors  uint64
+	Writes       uint64
+	WriteSectors uint64
+	// Milliseconds spent doing I/O
+	IOTime uint64
+}
+
+func ParseDiskstats(contents []byte) ([]DiskStats, error) {
+	var stats []DiskStats
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 14 {
+			return nil, fmt.Errorf("expected at least 14 fields, got %d", len(fields))
+		}
+
+		// Fields after the device name, in the order of the kernel's iostats
+		// docs
+		values := make([]uint64, 11)
+		for i := range values {
+			var err error
+			values[i], err = strconv.ParseUint(fields[i+3], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", fields[2], err)
+			}
+		}
+		stats = append(stats, DiskStats{
+			Device:       fields[2],
+			Reads:        values[0],
+			ReadSectors:  values[2],
+			Writes:       values[4],
+			WriteSectors: values[6],
+			IOTime:       values[9],
+		})
+	}
+	return stats, scanner.Err()
+}
+
+func (m *DiskIOMetrics) Run(ctx context.Context) (RunResult, error) {
+	contents, err := os.ReadFile(m.cfg.Path)
+	if err != nil {
+		return RunResult{}, err
+	}
+	stats, err := ParseDiskstats(contents)
+	if err != nil {
+		return RunResult{}, fmt.Errorf("%s: %w", m.cfg.Path, err)
+	}
+
+	now := time.Now()
+	var rates *counterRates
+	if m.cfg.Rates {
+		rates = &m.rates
+		rates.start(now)
+	}
+
+	var errs []error
+	for _, disk := range stats {
+		if !m.cfg.Devices.Match(disk.Device) {
+			continue
+		}
+		errs = append(errs, emitCounters(ctx, m.sink, m.ID, now, disk.Device, []counterSample{
+			{"diskio_read_bytes", disk.ReadSectors * diskstatsSectorSize, "bytes"},
+			{"diskio_write_bytes", disk.WriteSectors * diskstatsSectorSize, "bytes"},
+			{"diskio_reads", disk.Reads, "ops"},
+			{"diskio_writes", disk.Writes, "ops"},
+			{"diskio_io_time", disk.IOTime, "ms"},
+		}, rates)...)
+	}
+	return RunResult{}, errors.Join(errs...)
+}
+
+func (m *DiskIOMetrics) Configure(id utils.EntityID, rawCfg []byte) error {
+	var cfg DiskIOConfig
+	err := json.Unmarshal(rawCfg, &cfg)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Path) == 0 {
+		cfg.Path = defaultDiskstatsPath
+	}
+
+	m.ID = id
+	m.cfg = cfg
+	return nil
+}
+
+func (m *DiskIOMetrics) Eq(newRawCfg []byte) (bool, error) {
+	var newMet DiskIOMetrics
+	err := newMet.Configure(m.ID, newRawCfg)
+	if err != nil {
+		return false, err
+	}
+
+	return m.cfg.Path == newMet.cfg.Path &&
+		m.cfg.Devices.Equal(newMet.cfg.Devices) &&
+		m.cfg.Rates == newMet.cfg.Rates, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"math"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseDiskstats(t *testing.T) {
+	testFixtures(t, "diskstats", ParseDiskstats, nil, []fixtureCase[[]DiskStats]{
+		{
+			// Discard and flush fields are ignored
+			file: "linux-6.8",
+			want: []DiskStats{
+				{"nvme0n1", 184523, 12840922, 412553, 29872160, 223760},
+				{"nvme0n1p1", 312, 17418, 2, 2, 120},
+				{"nvme0n1p2", 184118, 12819632, 412551, 29872158, 223640},
+				{"loop0", 58, 2204, 0, 0, 28},
+				{"dm-0", 233912, 12710226, 711262, 29872158, 224410},
+			},
+		},
+		{
+			file: "linux-4.4",
+			want: []DiskStats{
+				{"sda", 4129, 295114, 3027, 97712, 4428},
+				{"sda1", 3992, 290698, 2996, 97712, 4384},
+			},
+		},
+		{file: "short", err: "expected at least 14 fields, got 6"},
+		{file: "malformed", err: "sda: "},
+	})
+}
+
+func TestDiskIORates(t *testing.T) {
+	rawCfg, err := json.Marshal(DiskIOConfig{Rates: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &DiskIOMetrics{}
+	err = m.Configure(NewMetricsID("home", "host", "diskio", "disks"), rawCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Returns the samples of a run by name and device
+	run := func(file string) map[string]map[string]MetricsSample {
+		t.Helper()
+		sink := &memorySink{}
+		m.sink = sink
+		m.cfg.Path = filepath.Join("testdata", "diskstats", file)
+		_, err := m.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		samples := make(map[string]map[string]MetricsSample)
+		for _, sample := range sink.samples {
+			if samples[sample.Name] == nil {
+				samples[sample.Name] = make(map[string]MetricsSample)
+			}
+			samples[sample.Name][sample.Labels["device"]] = sample
+		}
+		return samples
+	}
+	devices := func(samples map[string]MetricsSample) []string {
+		return slices.Sorted(maps.Keys(samples))
+	}
+
+	first := run("linux-6.8")
+	if rates, ok := first["diskio_reads_rate"]; ok {
+		t.Errorf("expected no rates on the first run, got them for %v", devices(rates))
+	}
+
+	// nvme0n1p1 went back, loop0 is gone and sdb is new
+	second := run("linux-6.8-later")
+	if got, want := devices(second["diskio_reads_rate"]), []string{"dm-0", "nvme0n1", "nvme0n1p2"}; !slices.Equal(got, want) {
+		t.Fatalf("expected rates for %v, got %v", want, got)
+	}
+	elapsed := second["diskio_reads"]["nvme0n1"].Timestamp.Sub(first["diskio_reads"]["nvme0n1"].Timestamp).Seconds()
+	for name, delta := range map[string]float64{
+		"diskio_reads_rate":       100,
+		"diskio_read_bytes_rate":  1024 * diskstatsSectorSize,
+		"diskio_write_bytes_rate": 2048 * diskstatsSectorSize,
+		"diskio_io_time_rate":     100,
+	} {
+		sample := second[name]["nvme0n1"]
+		if sample.Type != MetricGauge {
+			t.Errorf("%s: expected a gauge, got %s", name, sample.Type)
+		}
+		if want := delta / elapsed; math.Abs(sample.Value-want) > 1e-6*want {
+			t.Errorf("%s: expected %.3f, got %.3f", name, want, sample.Value)
+		}
+	}
+	if rate := second["diskio_reads_rate"]["dm-0"].Value; rate != 0 {
+		t.Errorf("expected an idle device to have a zero rate, got %.3f", rate)
+	}
+	if unit := second["diskio_read_bytes_rate"]["nvme0n1"].Labels["unit"]; unit != "bytes/s" {
+		t.Errorf("expected the rate unit to be bytes/s, got %q", unit)
+	}
+
+	// loop0 comes back, its rate isn't taken against the run before the last
+	third := run("linux-6.8")
+	if got, want := devices(third["diskio_reads_rate"]), []string{"dm-0", "nvme0n1p1", "nvme0n1p2"}; !slices.Equal(got, want) {
+		t.Fatalf("expected rates for %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+const defaultMeminfoPath = "/proc/meminfo"
+
+type MemoryConfig struct {
+	// Defaults to /proc/meminfo
+	Path string `json:"path"`
+}
+
+func (c *MemoryConfig) Valid(ctx context.Context) map[string]string {
+	return nil
+}
+
+type MemoryMetrics struct {
+	ID   utils.EntityID
+	cfg  MemoryConfig
+	sink MetricsSink
+}
+
+// Values of /proc/meminfo in bytes, keyed by their name like MemTotal
+func ParseMeminfo(contents []byte) (map[string]uint64, error) {
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		key, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", key, err)
+		}
+		// Sizes are in kibibytes, counts like HugePages_Total have no unit
+		if len(fields) > 1 && fields[1] == "kB" {
+			value *= 1024
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+func (m *MemoryMetrics) Run(ctx context.Context) (RunResult, error) {
+	contents, err := os.ReadFile(m.cfg.Path)
+	if err != nil {
+		return RunResult{}, err
+	}
+	info, err := ParseMeminfo(contents)
+	if err != nil {
+		return RunResult{}, fmt.Errorf("%s: %w", m.cfg.Path, err)
+	}
+
+	for _, key := range []string{"MemTotal", "MemFree", "Buffers", "Cached", "SwapTotal", "SwapFree", "Dirty", "Writeback"} {
+		if _, ok := info[key]; !ok {
+			return RunResult{}, fmt.Errorf("%s: missing %s", m.cfg.Path, key)
+		}
+	}
+
+	// Kernels before 3.14 don't estimate it
+	available, ok := info["MemAvailable"]
+	if !ok {
+		available = info["MemFree"] + info["Buffers"] + info["Cached"]
+	}
+
+	gauges := []struct {
+		name  string
+		value uint64
+	}{
+		{"memory_total", info["MemTotal"]},
+		{"memory_available", available},
+		{"memory_used", info["MemTotal"] - min(available, info["MemTotal"])},
+		{"memory_buffers", info["Buffers"]},
+		{"memory_cached", info["Cached"]},
+		{"memory_swap_used", info["SwapTotal"] - min(info["SwapFree"], info["SwapTotal"])},
+		{"memory_swap_free", info["SwapFree"]},
+		{"memory_dirty", info["Dirty"]},
+		{"memory_writeback", info["Writeback"]},
+	}
+
+	now := time.Now()
+	var errs []error
+	for _, gauge := range gauges {
+		err := m.sink.Emit(ctx, MetricsSample{
+			ID:        m.ID,
+			Timestamp: now,
+			Type:      MetricGauge,
+			Name:      gauge.name,
+			Value:     float64(gauge.value),
+			Labels: map[string]string{
+				"unit": "bytes",
+			},
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return RunResult{}, errors.Join(errs...)
+}
+
+func (m *MemoryMetrics) Configure(id utils.EntityID, rawCfg []byte) error {
+	var cfg MemoryConfig
+	err := json.Unmarshal(rawCfg, &cfg)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Path) == 0 {
+		cfg.Path = defaultMeminfoPath
+	}
+
+	m.ID = id
+	m.cfg = cfg
+	return nil
+}
+
+func (m *MemoryMetrics) Eq(newRawCfg []byte) (bool, error) {
+	var newMet MemoryMetrics
+	err := newMet.Configure(m.ID, newRawCfg)
+	if err != nil {
+		return false, err
+	}
+
+	return m.cfg == newMet.cfg, nil
+}
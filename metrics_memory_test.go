@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readFixture(t *testing.T, path ...string) []byte {
+	t.Helper()
+	contents, err := os.ReadFile(filepath.Join(append([]string{"testdata"}, path...)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+// Fails the test unless err contains want, or is nil when want is empty.
+// Returns whether an error was expected, so there's nothing left to check
+func checkError(t *testing.T, err error, want string) bool {
+	t.Helper()
+	if len(want) == 0 {
+		if err != nil {
+			t.Fatalf("expected success, got %v", err)
+		}
+		return false
+	}
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("expected error containing %q, got %v", want, err)
+	}
+	return true
+}
+
+// Parser input read from testdata/<kind>/<file>, err is checked with
+// checkError and want only when parsing succeeds
+type fixtureCase[T any] struct {
+	file string
+	want T
+	err  string
+}
+
+// Runs the parser on the fixture of every case and compares the result with
+// check, which is a deep comparison when nil
+func testFixtures[T any](t *testing.T, kind string, parse func([]byte) (T, error), check func(t *testing.T, want T, got T), cases []fixtureCase[T]) {
+	t.Helper()
+	if check == nil {
+		check = func(t *testing.T, want T, got T) {
+			t.Helper()
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("expected\n%+v\ngot\n%+v", want, got)
+			}
+		}
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.file, func(t *testing.T) {
+			got, err := parse(readFixture(t, kind, tt.file))
+			if checkError(t, err, tt.err) {
+				return
+			}
+			check(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseMeminfo(t *testing.T) {
+	// Only the keys of want are checked, the ones set to absent shouldn't be
+	// parsed at all
+	const absent = math.MaxUint64
+	testFixtures(t, "meminfo", ParseMeminfo, func(t *testing.T, want map[string]uint64, got map[string]uint64) {
+		for key, wantValue := range want {
+			gotValue, ok := got[key]
+			if wantValue == absent {
+				if ok {
+					t.Errorf("expected %s to be skipped", key)
+				}
+			} else if !ok {
+				t.Errorf("%s is missing", key)
+			} else if gotValue != wantValue {
+				t.Errorf("%s: expected %d, got %d", key, wantValue, gotValue)
+			}
+		}
+	}, []fixtureCase[map[string]uint64]{
+		{
+			file: "linux-6.8",
+			want: map[string]uint64{
+				"MemTotal":        16303428 * 1024,
+				"MemAvailable":    9512768 * 1024,
+				"SwapFree":        8126460 * 1024,
+				"Active(anon)":    4120016 * 1024,
+				"VmallocTotal":    34359738367 * 1024,
+				"HugePages_Total": 4,
+				"HugePages_Free":  3,
+			},
+		},
+		{
+			file: "linux-3.10",
+			want: map[string]uint64{
+				"MemTotal": 1016476 * 1024,
+				"Cached":   489428 * 1024,
+			},
+		},
+		{
+			file: "missing-fields",
+			want: map[string]uint64{
+				"MemTotal":               16303428 * 1024,
+				"MemFree":                1893624 * 1024,
+				"Cached":                 absent,
+				"this line has no colon": absent,
+			},
+		},
+		{file: "malformed", err: "parsing MemFree"},
+	})
+}
+
+func TestMemoryMetrics(t *testing.T) {
+	tests := []struct {
+		file      string
+		available uint64
+		swapUsed  uint64
+		err       string
+	}{
+		{file: "linux-6.8", available: 9512768 * 1024, swapUsed: (8388604 - 8126460) * 1024},
+		// Estimated from free, buffers and cache before MemAvailable existed
+		{file: "linux-3.10", available: (118264 + 52744 + 489428) * 1024},
+		{file: "missing-fields", err: "missing Buffers"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			rawCfg, err := json.Marshal(MemoryConfig{Path: filepath.Join("testdata", "meminfo", tt.file)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink := &memorySink{}
+			m := &MemoryMetrics{sink: sink}
+			err = m.Configure(NewMetricsID("home", "host", "memory", "mem"), rawCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = m.Run(context.Background())
+			if checkError(t, err, tt.err) {
+				return
+			}
+
+			for name, want := range map[string]uint64{"memory_available": tt.available, "memory_swap_used": tt.swapUsed} {
+				samples := sink.named(name)
+				if len(samples) != 1 {
+					t.Fatalf("expected one %s sample, got %d", name, len(samples))
+				}
+				if samples[0].Value != float64(want) {
+					t.Errorf("%s: expected %d, got %.0f", name, want, samples[0].Value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+const defaultNetDevPath = "/proc/net/dev"
+
+type NetworkConfig struct {
+	// Defaults to /proc/net/dev
+	Path    string     `json:"path"`
+	Devices GlobFilter `json:"devices"`
+	// Also emit per-second rates of the counters
+	Rates bool `json:"rates"`
+}
+
+func (c *NetworkConfig) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string)
+
+	err := c.Devices.Valid()
+	if err != nil {
+		problems["devices"] = err.Error()
+	}
+
+	return problems
+}
+
+type NetworkMetrics struct {
+	ID   utils.EntityID
+	cfg  NetworkConfig
+	sink MetricsSink
+
+	rates counterRates
+}
+
+type NetDevStats struct {
+	Device    string
+	RxBytes   uint64
+	RxPackets uint64
+	RxErrors  uint64
+	RxDrops   uint64
+	TxBytes   uint64
+	TxPackets uint64
+	TxErrors  uint64
+	TxDrops   uint64
+}
+
+func ParseNetDev(contents []byte) ([]NetDevStats, error) {
+	var stats []NetDevStats
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		// The two header lines have no colon
+		device, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		device = strings.TrimSpace(device)
+
+		fields := strings.Fields(rest)
+		if len(fields) < 16 {
+			return nil, fmt.Errorf("%s: expected 16 values, got %d", device, len(fields))
+		}
+		values := make([]uint64, 16)
+		for i := range values {
+			var err error
+			values[i], err = strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", device, err)
+			}
+		}
+		stats = append(stats, NetDevStats{
+			Device:    device,
+			RxBytes:   values[0],
+			RxPackets: values[1],
+			RxErrors:  values[2],
+			RxDrops:   values[3],
+			TxBytes:   values[8],
+			TxPackets: values[9],
+			TxErrors:  values[10],
+			TxDrops:   values[11],
+		})
+	}
+	return stats, scanner.Err()
+}
+
+func (m *NetworkMetrics) Run(ctx context.Context) (RunResult, error) {
+	contents, err := os.ReadFile(m.cfg.Path)
+	if err != nil {
+		return RunResult{}, err
+	}
+	stats, err := ParseNetDev(contents)
+	if err != nil {
+		return RunResult{}, fmt.Errorf("%s: %w", m.cfg.Path, err)
+	}
+
+	now := time.Now()
+	var rates *counterRates
+	if m.cfg.Rates {
+		rates = &m.rates
+		rates.start(now)
+	}
+
+	var errs []error
+	for _, dev := range stats {
+		if !m.cfg.Devices.Match(dev.Device) {
+			continue
+		}
+		errs = append(errs, emitCounters(ctx, m.sink, m.ID, now, dev.Device, []counterSample{
+			{"network_rx_bytes", dev.RxBytes, "bytes"},
+			{"network_rx_packets", dev.RxPackets, "packets"},
+			{"network_rx_errors", dev.RxErrors, "packets"},
+			{"network_rx_drops", dev.RxDrops, "packets"},
+			{"network_tx_bytes", dev.TxBytes, "bytes"},
+			{"network_tx_packets", dev.TxPackets, "packets"},
+			{"network_tx_errors", dev.TxErrors, "packets"},
+			{"network_tx_drops", dev.TxDrops, "packets"},
+		}, rates)...)
+	}
+	return RunResult{}, errors.Join(errs...)
+}
+
+func (m *NetworkMetrics) Configure(id utils.EntityID, rawCfg []byte) error {
+	var cfg NetworkConfig
+	err := json.Unmarshal(rawCfg, &cfg)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Path) == 0 {
+		cfg.Path = defaultNetDevPath
+	}
+
+	m.ID = id
+	m.cfg = cfg
+	return nil
+}
+
+func (m *NetworkMetrics) Eq(newRawCfg []byte) (bool, error) {
+	var newMet NetworkMetrics
+	err := newMet.Configure(m.ID, newRawCfg)
+	if err != nil {
+		return false, err
+	}
+
+	return m.cfg.Path == newMet.cfg.Path &&
+		m.cfg.Devices.Equal(newMet.cfg.Devices) &&
+		m.cfg.Rates == newMet.cfg.Rates, nil
+}
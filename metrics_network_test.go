@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseNetDev(t *testing.T) {
+	testFixtures(t, "net_dev", ParseNetDev, nil, []fixtureCase[[]NetDevStats]{
+		{
+			file: "linux-6.8",
+			want: []NetDevStats{
+				{"lo", 26182711, 139052, 0, 0, 26182711, 139052, 0, 0},
+				{"enp3s0", 9827364512, 7923114, 0, 312, 1228734091, 3312045, 2, 0},
+				{"wlp2s0", 0, 0, 0, 0, 0, 0, 0, 0},
+				{"docker0", 1572041, 18412, 0, 0, 52833110, 24119, 0, 0},
+			},
+		},
+		{
+			// Large counters run into the colon
+			file: "glued",
+			want: []NetDevStats{
+				{"eth0", 4294967296, 3000000, 1, 2, 123456789, 2000000, 3, 4},
+			},
+		},
+		{file: "short", err: "eth0: expected 16 values, got 4"},
+		{file: "malformed", err: "eth0: "},
+	})
+}
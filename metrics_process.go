@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+const defaultProcPath = "/proc"
+
+// Clock ticks per second of times in /proc/<pid>/stat. It's 100 on every
+// architecture Linux runs on, reading the real value would need cgo
+const userHZ = 100
+
+// Which processes to look at, every set field has to match
+type ProcessMatch struct {
+	// Matched against the process name and the base name of its executable
+	ProcessName  string `json:"process_name"`
+	CmdlineRegex string `json:"cmdline_regex"`
+	Pidfile      string `json:"pidfile"`
+	// Defaults to /proc
+	ProcPath string `json:"proc_path"`
+}
+
+func (c *ProcessMatch) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string)
+
+	if len(c.ProcessName) == 0 && len(c.CmdlineRegex) == 0 && len(c.Pidfile) == 0 {
+		problems["process_name"] = "one of process_name, cmdline_regex or pidfile is required"
+	}
+
+	if len(c.CmdlineRegex) > 0 {
+		if _, err := regexp.Compile(c.CmdlineRegex); err != nil {
+			problems["cmdline_regex"] = fmt.Sprint("invalid regex: ", err)
+		}
+	}
+
+	return problems
+}
+
+type Process struct {
+	PID     int
+	Name    string
+	Cmdline string
+}
+
+type processMatcher struct {
+	cfg   ProcessMatch
+	regex *regexp.Regexp
+}
+
+func newProcessMatcher(cfg ProcessMatch) (processMatcher, error) {
+	var regex *regexp.Regexp
+	if len(cfg.CmdlineRegex) > 0 {
+		var err error
+		regex, err = regexp.Compile(cfg.CmdlineRegex)
+		if err != nil {
+			return processMatcher{}, err
+		}
+	}
+	if len(cfg.ProcPath) == 0 {
+		cfg.ProcPath = defaultProcPath
+	}
+	return processMatcher{cfg: cfg, regex: regex}, nil
+}
+
+// Returns the matching processes. A missing pidfile means the process isn't
+// running, so it matches nothing
+func (m processMatcher) Find() ([]Process, error) {
+	var pids []int
+	if len(m.cfg.Pidfile) > 0 {
+		contents, err := os.ReadFile(m.cfg.Pidfile)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid pid: %w", m.cfg.Pidfile, err)
+		}
+		pids = []int{pid}
+	} else {
+		entries, err := os.ReadDir(m.cfg.ProcPath)
+		if err != nil {
+			return nil, err
+		}
+		self := os.Getpid()
+		for _, entry := range entries {
+			pid, err := strconv.Atoi(entry.Name())
+			// A cmdline regex would match meerkat's own command line if
+			// it's in the arguments
+			if err == nil && pid != self {
+				pids = append(pids, pid)
+			}
+		}
+	}
+
+	var procs []Process
+	for _, pid := range pids {
+		proc, err := m.read(pid)
+		// Exited since the listing
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if m.match(proc) {
+			procs = append(procs, proc)
+		}
+	}
+	return procs, nil
+}
+
+func (m processMatcher) read(pid int) (Process, error) {
+	dir := filepath.Join(m.cfg.ProcPath, strconv.Itoa(pid))
+	comm, err := os.ReadFile(filepath.Join(dir, "comm"))
+	if err != nil {
+		return Process{}, err
+	}
+	cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline"))
+	if err != nil {
+		return Process{}, err
+	}
+
+	return Process{
+		PID:     pid,
+		Name:    strings.TrimSuffix(string(comm), "\n"),
+		Cmdline: strings.TrimSpace(string(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '}))),
+	}, nil
+}
+
+func (m processMatcher) match(proc Process) bool {
+	if len(m.cfg.ProcessName) > 0 {
+		// Names are cut to 15 characters, the executable has the full one
+		exe, _, _ := strings.Cut(proc.Cmdline, " ")
+		if proc.Name != m.cfg.ProcessName && filepath.Base(exe) != m.cfg.ProcessName {
+			return false
+		}
+	}
+	if m.regex != nil && !m.regex.MatchString(proc.Cmdline) {
+		return false
+	}
+	return true
+}
+
+type ProcessStats struct {
+	RSS     uint64
+	CPUTime time.Duration
+	Threads uint64
+	// Ticks since boot the process started at
+	StartTicks uint64
+}
+
+// Parses /proc/<pid>/stat, the RSS is in pages
+func ParseProcessStat(contents []byte) (ProcessStats, error) {
+	var stats ProcessStats
+	// The name is in parentheses and can contain spaces and parentheses
+	end := bytes.LastIndexByte(contents, ')')
+	if end < 0 {
+		return stats, fmt.Errorf("missing process name")
+	}
+	// Fields from the state on, which is the third
+	fields := strings.Fields(string(contents[end+1:]))
+	if len(fields) < 22 {
+		return stats, fmt.Errorf("expected at least 24 fields, got %d", len(fields)+2)
+	}
+
+	values := make(map[int]uint64)
+	for _, field := range []int{14, 15, 20, 22, 24} {
+		value, err := strconv.ParseUint(fields[field-3], 10, 64)
+		if err != nil {
+			return stats, fmt.Errorf("field %d: %w", field, err)
+		}
+		values[field] = value
+	}
+
+	stats.CPUTime = time.Duration(values[14]+values[15]) * time.Second / userHZ
+	stats.Threads = values[20]
+	stats.StartTicks = values[22]
+	stats.RSS = values[24]
+	return stats, nil
+}
+
+type ProcessMetrics struct {
+	ID      utils.EntityID
+	cfg     ProcessMatch
+	matcher processMatcher
+	sink    MetricsSink
+}
+
+func (m *ProcessMetrics) Run(ctx context.Context) (RunResult, error) {
+	procs, err := m.matcher.Find()
+	if err != nil {
+		return RunResult{}, err
+	}
+
+	now := time.Now()
+	var errs []error
+	emit := func(metricType MetricType, name string, value float64, labels map[string]string) {
+		err := m.sink.Emit(ctx, MetricsSample{
+			ID:        m.ID,
+			Timestamp: now,
+			Type:      metricType,
+			Name:      name,
+			Value:     value,
+			Labels:    labels,
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	emit(MetricGauge, "process_count", float64(len(procs)), map[string]string{"unit": "processes"})
+	if len(procs) == 0 {
+		return RunResult{}, errors.Join(errs...)
+	}
+
+	uptime, err := m.systemUptime()
+	if err != nil {
+		return RunResult{}, errors.Join(append(errs, err)...)
+	}
+	pageSize := uint64(os.Getpagesize())
+
+	for _, proc := range procs {
+		dir := filepath.Join(m.matcher.cfg.ProcPath, strconv.Itoa(proc.PID))
+		contents, err := os.ReadFile(filepath.Join(dir, "stat"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		stats, err := ParseProcessStat(contents)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", filepath.Join(dir, "stat"), err))
+			continue
+		}
+
+		labels := func(unit string) map[string]string {
+			return map[string]string{
+				"pid":     strconv.Itoa(proc.PID),
+				"process": proc.Name,
+				"unit":    unit,
+			}
+		}
+		startedAt := time.Duration(stats.StartTicks) * time.Second / userHZ
+		emit(MetricGauge, "process_rss", float64(stats.RSS*pageSize), labels("bytes"))
+		emit(MetricCounter, "process_cpu_time", stats.CPUTime.Seconds(), labels("seconds"))
+		emit(MetricGauge, "process_threads", float64(stats.Threads), labels("threads"))
+		emit(MetricGauge, "process_uptime", max(uptime-startedAt, 0).Seconds(), labels("seconds"))
+
+		// Only readable for processes of the same user, or as root
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err == nil {
+			emit(MetricGauge, "process_fds", float64(len(fds)), labels("fds"))
+		}
+	}
+	return RunResult{}, errors.Join(errs...)
+}
+
+func (m *ProcessMetrics) systemUptime() (time.Duration, error) {
+	path := filepath.Join(m.matcher.cfg.ProcPath, "uptime")
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(contents))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("%s: empty", path)
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func (m *ProcessMetrics) Configure(id utils.EntityID, rawCfg []byte) error {
+	var cfg ProcessMatch
+	err := json.Unmarshal(rawCfg, &cfg)
+	if err != nil {
+		return err
+	}
+
+	matcher, err := newProcessMatcher(cfg)
+	if err != nil {
+		return err
+	}
+
+	m.ID = id
+	m.cfg = cfg
+	m.matcher = matcher
+	return nil
+}
+
+func (m *ProcessMetrics) Eq(newRawCfg []byte) (bool, error) {
+	var newMet ProcessMetrics
+	err := newMet.Configure(m.ID, newRawCfg)
+	if err != nil {
+		return false, err
+	}
+
+	return m.cfg == newMet.cfg, nil
+}
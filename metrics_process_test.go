@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseProcessStat(t *testing.T) {
+	testFixtures(t, "process_stat", ParseProcessStat, nil, []fixtureCase[ProcessStats]{
+		{
+			file: "nginx",
+			want: ProcessStats{RSS: 1690, CPUTime: 1750 * time.Millisecond, Threads: 1, StartTicks: 2231},
+		},
+		{
+			// The name is cut at the last parenthesis
+			file: "spaces-and-parens",
+			want: ProcessStats{RSS: 1024, CPUTime: 16 * time.Second, Threads: 1, StartTicks: 98765},
+		},
+		{
+			file: "kthread",
+			want: ProcessStats{RSS: 0, CPUTime: 270 * time.Millisecond, Threads: 1, StartTicks: 48213},
+		},
+		{
+			file: "linux-2.6",
+			want: ProcessStats{RSS: 287, CPUTime: 100 * time.Millisecond, Threads: 1, StartTicks: 1530},
+		},
+		{file: "no-name", err: "missing process name"},
+		{file: "short", err: "expected at least 24 fields, got 22"},
+		{file: "malformed", err: "field 15: "},
+	})
+}
+
+func TestProcessMatcherFind(t *testing.T) {
+	pidfile := func(contents string) string {
+		path := filepath.Join(t.TempDir(), "app.pid")
+		err := os.WriteFile(path, []byte(contents), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name string
+		cfg  ProcessMatch
+		want []int
+		err  string
+	}{
+		{name: "by name", cfg: ProcessMatch{ProcessName: "nginx"}, want: []int{1423, 1424}},
+		{name: "by a name with spaces", cfg: ProcessMatch{ProcessName: "tmux: server"}, want: []int{3171}},
+		{
+			// The name is cut to 15 characters, the executable isn't
+			name: "by executable",
+			cfg:  ProcessMatch{ProcessName: "long-running-service"},
+			want: []int{5120},
+		},
+		{name: "kernel thread", cfg: ProcessMatch{ProcessName: "kworker/u16:3"}, want: []int{2101}},
+		{name: "script is not the name", cfg: ProcessMatch{ProcessName: "worker.py"}},
+		{name: "by command line", cfg: ProcessMatch{CmdlineRegex: `worker\.py --queue mail$`}, want: []int{4410}},
+		{name: "name and command line", cfg: ProcessMatch{ProcessName: "nginx", CmdlineRegex: "master"}, want: []int{1423}},
+		{name: "by pidfile", cfg: ProcessMatch{Pidfile: pidfile("812\n")}, want: []int{812}},
+		{name: "pidfile and name", cfg: ProcessMatch{Pidfile: pidfile("812\n"), ProcessName: "nginx"}},
+		{name: "pidfile of an exited process", cfg: ProcessMatch{Pidfile: pidfile("4242")}},
+		{name: "missing pidfile", cfg: ProcessMatch{Pidfile: filepath.Join(t.TempDir(), "missing.pid")}},
+		{name: "invalid pidfile", cfg: ProcessMatch{Pidfile: pidfile("nginx")}, err: "invalid pid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.ProcPath = filepath.Join("testdata", "proc")
+			if problems := tt.cfg.Valid(context.Background()); len(problems) > 0 {
+				t.Fatalf("config is invalid: %v", problems)
+			}
+			matcher, err := newProcessMatcher(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			procs, err := matcher.Find()
+			if checkError(t, err, tt.err) {
+				return
+			}
+			var got []int
+			for _, proc := range procs {
+				got = append(got, proc.PID)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestProcessMetrics(t *testing.T) {
+	rawCfg, err := json.Marshal(ProcessMatch{ProcessName: "nginx", ProcPath: filepath.Join("testdata", "proc")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &memorySink{}
+	m := &ProcessMetrics{sink: sink}
+	err = m.Configure(NewMetricsID("home", "web", "process", "nginx"), rawCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := sink.named("process_count")
+	if len(count) != 1 || count[0].Value != 2 {
+		t.Fatalf("expected a count of 2 processes, got %+v", count)
+	}
+
+	pageSize := float64(os.Getpagesize())
+	// Uptime of the system is 5000 seconds
+	want := map[string]map[string]float64{
+		"1423": {
+			"process_rss":      1690 * pageSize,
+			"process_cpu_time": 1.75,
+			"process_threads":  1,
+			"process_uptime":   5000 - 22.31,
+			"process_fds":      3,
+		},
+		"1424": {
+			"process_rss":      3000 * pageSize,
+			"process_cpu_time": 7.5,
+			"process_threads":  4,
+			"process_uptime":   5000 - 22.4,
+		},
+	}
+	for pid, metrics := range want {
+		for name, value := range metrics {
+			var found bool
+			for _, sample := range sink.named(name) {
+				if sample.Labels["pid"] != pid {
+					continue
+				}
+				found = true
+				if math.Abs(sample.Value-value) > 1e-6 {
+					t.Errorf("%s of %s: expected %.2f, got %.2f", name, pid, value, sample.Value)
+				}
+				if sample.Labels["process"] != "nginx" {
+					t.Errorf("%s of %s: expected the process label, got %v", name, pid, sample.Labels)
+				}
+			}
+			if !found {
+				t.Errorf("%s of %s is missing", name, pid)
+			}
+		}
+	}
+	// Without access to the fds there's no sample rather than a zero
+	for _, sample := range sink.named("process_fds") {
+		if sample.Labels["pid"] == "1424" {
+			t.Errorf("expected no fd count for 1424, got %.0f", sample.Value)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Columns added after their table was first released. schema.sql only
+// creates missing tables, so existing databases get these through ALTER TABLE
+var columnMigrations = []struct {
+	Table  string
+	Column string
+	Decl   string
+}{
+	{"heartbeat", "latency_us", "integer"},
+	{"heartbeat", "dns_us", "integer"},
+	{"heartbeat", "connect_us", "integer"},
+	{"heartbeat", "tls_us", "integer"},
+	{"heartbeat", "first_byte_us", "integer"},
+}
+
+// Timestamp columns written with time.Time.String before the connections
+// used _time_format=sqlite. Range queries compare them as text, which only
+// works when every row uses the same format
+var timestampColumns = []struct {
+	Table  string
+	Column string
+}{
+	{"heartbeat", "ts"},
+	{"metrics", "ts"},
+	{"state_changes", "ts"},
+	{"notification_deliveries", "ts"},
+}
+
+// Metrics entities used to share the monitor kind, their rows are found
+// through the kind their configs were saved with
+const migrateMetricsKind = `update entities
+   set canonical_id = replace(canonical_id, '|kind=monitor|', '|kind=metrics|')
+ where canonical_id like '%|kind=monitor|%'
+   and id in (select entity_id from entity_configs where kind = 'metrics')`
+
+// Layout of time.Time.String, the driver's default before _time_format
+const legacyTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+func migrate(ctx context.Context, conn *sql.DB) error {
+	for _, m := range columnMigrations {
+		exists, err := columnExists(ctx, conn, m.Table, m.Column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		_, err = conn.ExecContext(ctx, fmt.Sprintf("alter table %s add column %s %s", m.Table, m.Column, m.Decl))
+		if err != nil {
+			return fmt.Errorf("adding column %s.%s: %w", m.Table, m.Column, err)
+		}
+	}
+
+	for _, m := range timestampColumns {
+		err := migrateTimestamps(ctx, conn, m.Table, m.Column)
+		if err != nil {
+			return fmt.Errorf("rewriting timestamps of %s.%s: %w", m.Table, m.Column, err)
+		}
+	}
+
+	_, err := conn.ExecContext(ctx, migrateMetricsKind)
+	if err != nil {
+		return fmt.Errorf("moving metrics entities to their own kind: %w", err)
+	}
+	return nil
+}
+
+// Rewrites timestamps in the legacy format through the driver, which writes
+// them in the current one. Rows in the current format have a single space,
+// so they are left alone and the migration is a no-op once done
+func migrateTimestamps(ctx context.Context, conn *sql.DB, table string, column string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The cast keeps the driver from parsing the column into a time.Time
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("select id, cast(%[1]s as text) from %[2]s where %[1]s like '%% %% %%'", column, table))
+	if err != nil {
+		return err
+	}
+
+	type legacyRow struct {
+		id int64
+		ts time.Time
+	}
+	var legacy []legacyRow
+	for rows.Next() {
+		var id int64
+		var text string
+		err := rows.Scan(&id, &text)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		// Times with a monotonic reading end with " m=+1.234"
+		text, _, _ = strings.Cut(text, " m=")
+		ts, err := time.Parse(legacyTimeLayout, text)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("row %d: %w", id, err)
+		}
+		legacy = append(legacy, legacyRow{id, ts})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("update %s set %s = ? where id = ?", table, column))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, row := range legacy {
+		_, err := stmt.ExecContext(ctx, row.ts.UTC(), row.id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func columnExists(ctx context.Context, conn *sql.DB, table string, column string) (bool, error) {
+	rows, err := conn.QueryContext(ctx, "select name from pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"meerkat-v0/db"
+)
+
+func TestMigrateLegacyTimestamps(t *testing.T) {
+	ctx := context.Background()
+	dbName := filepath.Join(t.TempDir(), "observations.db")
+
+	// Written the way connections without _time_format did
+	legacy, err := sql.Open("sqlite", dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.ExecContext(ctx, ddl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.ExecContext(ctx, "insert into entities (id, canonical_id) values (1, 'kind=monitor|name=web')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	stamps := []time.Time{
+		base,
+		base.Add(500 * time.Millisecond),
+		base.Add(time.Minute),
+		base.Add(time.Hour),
+	}
+	for _, ts := range stamps {
+		_, err = legacy.ExecContext(ctx, "insert into heartbeat (entity_id, ts, successful) values (1, ?, true)", ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var text string
+	err = legacy.QueryRowContext(ctx, "select cast(ts as text) from heartbeat limit 1").Scan(&text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(text, " UTC") {
+		t.Fatalf("expected a legacy timestamp, got %q", text)
+	}
+	legacy.Close()
+
+	dbRead, dbWrite, err := openObservations(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbRead.Close()
+	defer dbWrite.Close()
+
+	rows, err := dbRead.QueryContext(ctx, "select cast(ts as text) from heartbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		err := rows.Scan(&text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(text, " ") != 1 {
+			t.Errorf("expected a rewritten timestamp, got %q", text)
+		}
+	}
+	rows.Close()
+
+	// Running it again finds nothing to rewrite
+	err = migrate(ctx, dbWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readDB, writeDB := db.New(dbRead), db.New(dbWrite)
+	repo := NewSqliteHeartbeatRepo(readDB, writeDB, NewSqliteEntityRepo(readDB, dbWrite))
+	heartbeats, err := repo.ListHeartbeats(ctx, "kind=monitor|name=web", base, base.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(heartbeats) != 3 {
+		t.Fatalf("expected the 3 heartbeats in [from, to), got %d", len(heartbeats))
+	}
+	for i, heartbeat := range heartbeats {
+		if !heartbeat.Timestamp.Equal(stamps[i]) {
+			t.Errorf("heartbeat %d: expected %s, got %s", i, stamps[i], heartbeat.Timestamp)
+		}
+	}
+}
+
+func TestMigrateMetricsKind(t *testing.T) {
+	ctx := context.Background()
+	dbName := filepath.Join(t.TempDir(), "observations.db")
+	dbRead, dbWrite, err := openObservations(ctx, dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbRead.Close()
+	defer dbWrite.Close()
+
+	// Written before metrics had their own kind
+	monitor := NewMonitorID("home", "web", "http", "site").Canonical()
+	legacyMetrics := NewMonitorID("home", "host", "cpu", "cpu").Canonical()
+	for i, entity := range []struct {
+		canonID string
+		kind    string
+	}{
+		{monitor, "monitor"},
+		{legacyMetrics, "metrics"},
+	} {
+		_, err := dbWrite.ExecContext(ctx, "insert into entities (id, canonical_id) values (?, ?)", i+1, entity.canonID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = dbWrite.ExecContext(ctx, "insert into entity_configs (entity_id, kind, config) values (?, ?, '{}')", i+1, entity.kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Running it twice changes nothing the second time
+	for range 2 {
+		err = migrate(ctx, dbWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{monitor, NewMetricsID("home", "host", "cpu", "cpu").Canonical()}
+	for i, canonID := range want {
+		var got string
+		err := dbRead.QueryRowContext(ctx, "select canonical_id from entities where id = ?", i+1).Scan(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != canonID {
+			t.Errorf("entity %d: expected %s, got %s", i+1, canonID, got)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+const defaultDNSTimeout = 5
+
+var DNSRecordTypes = []string{"A", "AAAA", "CNAME", "MX", "TXT", "SRV"}
+
+// Like HostnameRegex, but allows underscores used by SRV and TXT names
+var DNSNameRegex = regexp.MustCompile(`^([a-zA-Z0-9_]([a-zA-Z0-9_\-]*[a-zA-Z0-9_])?\.)*[a-zA-Z0-9_]([a-zA-Z0-9_\-]*[a-zA-Z0-9_])?\.?$`)
+
+type DNSConfig struct {
+	Hostname string `json:"hostname"`
+	// One of A, AAAA, CNAME, MX, TXT, SRV, defaults to A
+	RecordType string `json:"record_type"`
+	// Address of the resolver to query, the port defaults to 53. The system
+	// resolver is used when empty
+	Resolver string `json:"resolver"`
+	// Values that must be present in the answers. MX answers are formatted as
+	// "pref host" and SRV as "priority weight port target", but can be
+	// matched by host or target alone. TXT values only match whole, with
+	// their strings joined
+	Expected   []string `json:"expected"`
+	MinRecords int      `json:"min_records"`
+	// Defaults to 5 seconds
+	Timeout int `json:"timeout"`
+}
+
+func (c *DNSConfig) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string, 4)
+	if !DNSNameRegex.MatchString(c.Hostname) {
+		problems["hostname"] = "invalid domain name"
+	}
+
+	if len(c.RecordType) > 0 && !slices.Contains(DNSRecordTypes, strings.ToUpper(c.RecordType)) {
+		problems["record_type"] = fmt.Sprintf("should be one of %s", strings.Join(DNSRecordTypes, ", "))
+	}
+
+	if len(c.Resolver) > 0 {
+		host, port, err := net.SplitHostPort(c.Resolver)
+		if err != nil {
+			host, port = c.Resolver, "53"
+		}
+		if net.ParseIP(host) == nil {
+			problems["resolver"] = "should be an ip address with an optional port"
+		} else if err := CheckPort(port); err != nil {
+			problems["resolver"] = err.Error()
+		}
+	}
+
+	if c.MinRecords < 0 {
+		problems["min_records"] = "cannot be less than zero"
+	}
+
+	if c.Timeout < 0 {
+		problems["timeout"] = "cannot be less than zero"
+	}
+
+	return problems
+}
+
+type DNSMonitor struct {
+	ID       utils.EntityID
+	cfg      DNSConfig
+	resolver *net.Resolver
+}
+
+func (m *DNSMonitor) Run(parentCtx context.Context) (RunResult, error) {
+	var result RunResult
+
+	ctx, cancel := context.WithTimeout(parentCtx, time.Duration(m.cfg.Timeout)*time.Second)
+	defer cancel()
+
+	resolverName := m.cfg.Resolver
+	if len(resolverName) == 0 {
+		resolverName = "system resolver"
+	}
+
+	start := time.Now()
+	answers, err := LookupDNS(ctx, m.resolver, m.cfg.RecordType, m.cfg.Hostname)
+	result.Latency = time.Since(start)
+	result.Phases.DNS = result.Latency
+	if err != nil {
+		return result, fmt.Errorf("%s: %w", resolverName, err)
+	}
+
+	if len(answers) < m.cfg.MinRecords {
+		return result, fmt.Errorf("%s: got %d %s records for %s, expected at least %d",
+			resolverName, len(answers), m.cfg.RecordType, m.cfg.Hostname, m.cfg.MinRecords)
+	}
+
+	for _, expected := range m.cfg.Expected {
+		if !answerExpected(m.cfg.RecordType, answers, expected) {
+			return result, fmt.Errorf("%s: expected %s record '%s' for %s, got [%s]",
+				resolverName, m.cfg.RecordType, expected, m.cfg.Hostname, strings.Join(answers, ", "))
+		}
+	}
+
+	return result, nil
+}
+
+func normalizeDNSName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func answerExpected(recordType string, answers []string, expected string) bool {
+	// TXT values are free text, only the whole value matches
+	if recordType == "TXT" {
+		return slices.Contains(answers, expected)
+	}
+
+	expected = normalizeDNSName(expected)
+	for _, answer := range answers {
+		if normalizeDNSName(answer) == expected {
+			return true
+		}
+		// MX and SRV answers end with the target host
+		fields := strings.Fields(answer)
+		if (recordType == "MX" || recordType == "SRV") && len(fields) > 1 && normalizeDNSName(fields[len(fields)-1]) == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the answers formatted as strings
+func LookupDNS(ctx context.Context, resolver *net.Resolver, recordType string, name string) ([]string, error) {
+	var answers []string
+	switch recordType {
+	case "A", "AAAA":
+		network := "ip4"
+		if recordType == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := resolver.LookupIP(ctx, network, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			answers = append(answers, ip.String())
+		}
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		// Names that only have address records resolve to themselves
+		if normalizeDNSName(cname) != normalizeDNSName(name) {
+			answers = append(answers, cname)
+		}
+	case "MX":
+		mxs, err := resolver.LookupMX(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			answers = append(answers, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+	case "TXT":
+		txts, err := resolver.LookupTXT(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, txts...)
+	case "SRV":
+		_, srvs, err := resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			answers = append(answers, fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported record type %s", recordType)
+	}
+	return answers, nil
+}
+
+func newDNSResolver(address string) *net.Resolver {
+	if len(address) == 0 {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+func (m *DNSMonitor) Configure(id utils.EntityID, rawCfg []byte) error {
+	var cfg DNSConfig
+	err := json.Unmarshal(rawCfg, &cfg)
+	if err != nil {
+		return err
+	}
+
+	cfg.RecordType = strings.ToUpper(cfg.RecordType)
+	if len(cfg.RecordType) == 0 {
+		cfg.RecordType = "A"
+	}
+	if len(cfg.Resolver) > 0 {
+		if _, _, err := net.SplitHostPort(cfg.Resolver); err != nil {
+			cfg.Resolver = net.JoinHostPort(cfg.Resolver, "53")
+		}
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultDNSTimeout
+	}
+
+	m.ID = id
+	m.cfg = cfg
+	m.resolver = newDNSResolver(cfg.Resolver)
+	return nil
+}
+
+func (m *DNSMonitor) Eq(newRawCfg []byte) (bool, error) {
+	var newMon DNSMonitor
+	err := newMon.Configure(m.ID, newRawCfg)
+	if err != nil {
+		return false, err
+	}
+
+	return reflect.DeepEqual(m.cfg, newMon.cfg), nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeMX    = 15
+	dnsTypeTXT   = 16
+	dnsTypeAAAA  = 28
+	dnsTypeSRV   = 33
+)
+
+type dnsRecord struct {
+	Type uint16
+	Data []byte
+}
+
+// Answers UDP queries from a fixed zone, names are lower case with the
+// trailing dot. Unknown names get NXDOMAIN
+func startDNSServer(t *testing.T, zone map[string][]dnsRecord) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			reply, ok := dnsReply(buf[:n], zone)
+			if ok {
+				conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func dnsReply(query []byte, zone map[string][]dnsRecord) ([]byte, bool) {
+	if len(query) < 12 {
+		return nil, false
+	}
+
+	var labels []string
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		length := int(query[i])
+		if i+1+length > len(query) {
+			return nil, false
+		}
+		labels = append(labels, string(query[i+1:i+1+length]))
+		i += 1 + length
+	}
+	// Terminating zero, type and class
+	questionEnd := i + 5
+	if questionEnd > len(query) {
+		return nil, false
+	}
+	name := strings.ToLower(strings.Join(labels, ".")) + "."
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+
+	records, exists := zone[name]
+	var answers [][]byte
+	for _, record := range records {
+		if record.Type != qtype {
+			continue
+		}
+		// Owner name points at the question name
+		answer := []byte{0xc0, 12}
+		answer = binary.BigEndian.AppendUint16(answer, record.Type)
+		answer = binary.BigEndian.AppendUint16(answer, 1)
+		answer = binary.BigEndian.AppendUint32(answer, 60)
+		answer = binary.BigEndian.AppendUint16(answer, uint16(len(record.Data)))
+		answers = append(answers, append(answer, record.Data...))
+	}
+
+	reply := make([]byte, 12, 512)
+	copy(reply, query[:2])
+	flags := uint16(0x8180)
+	if !exists {
+		flags |= 3
+	}
+	binary.BigEndian.PutUint16(reply[2:], flags)
+	binary.BigEndian.PutUint16(reply[4:], 1)
+	binary.BigEndian.PutUint16(reply[6:], uint16(len(answers)))
+	reply = append(reply, query[12:questionEnd]...)
+	for _, answer := range answers {
+		reply = append(reply, answer...)
+	}
+	return reply, true
+}
+
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func dnsA(ip string) dnsRecord {
+	return dnsRecord{dnsTypeA, net.ParseIP(ip).To4()}
+}
+
+func dnsAAAA(ip string) dnsRecord {
+	return dnsRecord{dnsTypeAAAA, net.ParseIP(ip).To16()}
+}
+
+func dnsCNAME(target string) dnsRecord {
+	return dnsRecord{dnsTypeCNAME, dnsName(target)}
+}
+
+func dnsMX(pref uint16, host string) dnsRecord {
+	return dnsRecord{dnsTypeMX, append(binary.BigEndian.AppendUint16(nil, pref), dnsName(host)...)}
+}
+
+func dnsTXT(values ...string) dnsRecord {
+	var data []byte
+	for _, value := range values {
+		data = append(data, byte(len(value)))
+		data = append(data, value...)
+	}
+	return dnsRecord{dnsTypeTXT, data}
+}
+
+func dnsSRV(priority, weight, port uint16, target string) dnsRecord {
+	data := binary.BigEndian.AppendUint16(nil, priority)
+	data = binary.BigEndian.AppendUint16(data, weight)
+	data = binary.BigEndian.AppendUint16(data, port)
+	return dnsRecord{dnsTypeSRV, append(data, dnsName(target)...)}
+}
+
+func TestDNSMonitor(t *testing.T) {
+	resolver := startDNSServer(t, map[string][]dnsRecord{
+		"meerkat.test.": {
+			dnsA("192.0.2.1"),
+			dnsAAAA("2001:db8::1"),
+			dnsMX(10, "mail.meerkat.test."),
+			dnsTXT("v=spf1 include:_spf.meerkat.test ~all"),
+		},
+		"www.meerkat.test.":              {dnsCNAME("meerkat.test.")},
+		"_http._tcp.meerkat.test.":       {dnsSRV(1, 5, 8080, "web.meerkat.test.")},
+		"multi.meerkat.test.":            {dnsA("192.0.2.1"), dnsA("192.0.2.2")},
+		"mail.meerkat.test.":             {dnsA("192.0.2.3")},
+		"web.meerkat.test.":              {dnsA("192.0.2.4")},
+		"no-records.meerkat.test.":       nil,
+		"split.meerkat.test.":            {dnsTXT("first part ", "second part")},
+		"upper.meerkat.test.":            {dnsTXT("Token=ABC")},
+		"cname-to-missing.meerkat.test.": {dnsCNAME("missing.meerkat.test.")},
+	})
+
+	tests := []struct {
+		name string
+		cfg  map[string]any
+		err  string
+	}{
+		{
+			name: "A record",
+			cfg:  map[string]any{"hostname": "meerkat.test", "expected": []string{"192.0.2.1"}},
+		},
+		{
+			name: "A record missing",
+			cfg:  map[string]any{"hostname": "meerkat.test", "expected": []string{"192.0.2.9"}},
+			err:  "expected A record '192.0.2.9'",
+		},
+		{
+			name: "min records",
+			cfg:  map[string]any{"hostname": "multi.meerkat.test", "min_records": 2},
+		},
+		{
+			name: "too few records",
+			cfg:  map[string]any{"hostname": "meerkat.test", "min_records": 2},
+			err:  "got 1 A records",
+		},
+		{
+			name: "AAAA record",
+			cfg:  map[string]any{"hostname": "meerkat.test", "record_type": "aaaa", "expected": []string{"2001:db8::1"}},
+		},
+		{
+			name: "CNAME record",
+			cfg:  map[string]any{"hostname": "www.meerkat.test", "record_type": "CNAME", "expected": []string{"meerkat.test"}},
+		},
+		{
+			name: "CNAME to a missing name",
+			cfg:  map[string]any{"hostname": "cname-to-missing.meerkat.test", "record_type": "CNAME", "expected": []string{"missing.meerkat.test."}},
+		},
+		{
+			name: "no CNAME record",
+			cfg:  map[string]any{"hostname": "meerkat.test", "record_type": "CNAME", "expected": []string{"meerkat.test"}},
+			err:  "expected CNAME record 'meerkat.test'",
+		},
+		{
+			name: "no CNAME record with min records",
+			cfg:  map[string]any{"hostname": "meerkat.test", "record_type": "CNAME", "min_records": 1},
+			err:  "got 0 CNAME records",
+		},
+		{
+			name: "MX by host",
+			cfg:  map[string]any{"hostname": "meerkat.test", "record_type": "MX", "expected": []string{"mail.meerkat.test"}},
+		},
+		{
+			name: "MX by preference and host",
+			cfg:  map[string]any{"hostname": "meerkat.test", "record_type": "MX", "expected": []string{"10 mail.meerkat.test."}},
+		},
+		{
+			name: "TXT with spaces",
+			cfg:  map[string]any{"hostname": "meerkat.test", "record_type": "TXT", "expected": []string{"v=spf1 include:_spf.meerkat.test ~all"}},
+		},
+		{
+			name: "TXT matches whole values only",
+			cfg:  map[string]any{"hostname": "meerkat.test", "record_type": "TXT", "expected": []string{"~all"}},
+			err:  "expected TXT record '~all'",
+		},
+		{
+			name: "TXT split into strings",
+			cfg:  map[string]any{"hostname": "split.meerkat.test", "record_type": "TXT", "expected": []string{"first part second part"}},
+		},
+		{
+			name: "TXT is case sensitive",
+			cfg:  map[string]any{"hostname": "upper.meerkat.test", "record_type": "TXT", "expected": []string{"token=abc"}},
+			err:  "expected TXT record 'token=abc'",
+		},
+		{
+			name: "SRV by target",
+			cfg:  map[string]any{"hostname": "_http._tcp.meerkat.test", "record_type": "SRV", "expected": []string{"web.meerkat.test"}},
+		},
+		{
+			name: "SRV formatted",
+			cfg:  map[string]any{"hostname": "_http._tcp.meerkat.test", "record_type": "SRV", "expected": []string{"1 5 8080 web.meerkat.test."}},
+		},
+		{
+			name: "unknown name",
+			cfg:  map[string]any{"hostname": "nope.meerkat.test"},
+			err:  "no such host",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := map[string]any{"resolver": resolver, "timeout": 5}
+			for k, v := range tt.cfg {
+				cfg[k] = v
+			}
+			rawCfg, err := json.Marshal(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var dnsCfg DNSConfig
+			err = json.Unmarshal(rawCfg, &dnsCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if problems := dnsCfg.Valid(context.Background()); len(problems) > 0 {
+				t.Fatalf("config is invalid: %v", problems)
+			}
+
+			var mon DNSMonitor
+			err = mon.Configure(NewMonitorID("test", "dns", "dns", "lookup"), rawCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = mon.Run(context.Background())
+			if checkError(t, err, tt.err) {
+				return
+			}
+		})
+	}
+}
+
+func TestDNSMonitorTimeout(t *testing.T) {
+	// Reads queries but never answers them
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	rawCfg, err := json.Marshal(map[string]any{"hostname": "meerkat.test", "resolver": conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mon DNSMonitor
+	err = mon.Configure(NewMonitorID("test", "dns", "dns", "lookup"), rawCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mon.cfg.Timeout != defaultDNSTimeout {
+		t.Fatalf("expected the default timeout, got %d", mon.cfg.Timeout)
+	}
+
+	mon.cfg.Timeout = 1
+	start := time.Now()
+	_, err = mon.Run(context.Background())
+	if err == nil {
+		t.Fatal("expected the lookup to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("expected the lookup to give up after a second, took %s", elapsed)
+	}
+}
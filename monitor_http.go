@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+const (
+	maxHTTPBodySize    = 1 << 20
+	defaultHTTPTimeout = 10
+)
+
+type HTTPAssertion struct {
+	// One of contains, regex, json_path or header. For header assertions the
+	// path is the header name, and an empty value only checks it's present
+	Type  string `json:"type"`
+	Path  string `json:"path"`
+	Value string `json:"value"`
+}
+
+type HTTPConfig struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	// Status codes or ranges like "200", "200-299" or "2xx", defaults to 2xx
+	ExpectedStatus []string `json:"expected_status"`
+	// Defaults to true
+	FollowRedirects *bool `json:"follow_redirects"`
+	MaxRedirects    int   `json:"max_redirects"`
+	SkipTLSVerify   bool  `json:"skip_tls_verify"`
+	// Defaults to 10 seconds
+	Timeout int `json:"timeout"`
+
+	Assertions []HTTPAssertion `json:"assertions"`
+}
+
+func (c *HTTPConfig) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string)
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		problems["url"] = fmt.Sprint("invalid url: ", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		problems["url"] = "scheme should be http or https"
+	} else if len(u.Host) == 0 {
+		problems["url"] = "host is required"
+	}
+
+	if len(c.Method) > 0 && strings.ContainsAny(c.Method, " \t\r\n") {
+		problems["method"] = "invalid method"
+	}
+
+	for _, status := range c.ExpectedStatus {
+		_, err := parseStatusRange(status)
+		if err != nil {
+			problems["expected_status"] = err.Error()
+			break
+		}
+	}
+
+	if c.MaxRedirects < 0 {
+		problems["max_redirects"] = "cannot be less than zero"
+	}
+
+	if c.Timeout < 0 {
+		problems["timeout"] = "cannot be less than zero"
+	}
+
+	for i, assertion := range c.Assertions {
+		field := fmt.Sprintf("assertions[%d]", i)
+		switch assertion.Type {
+		case "contains":
+		case "header":
+			if len(assertion.Path) == 0 {
+				problems[field] = "header name is required in 'path'"
+			}
+		case "regex":
+			_, err := regexp.Compile(assertion.Value)
+			if err != nil {
+				problems[field] = fmt.Sprint("invalid regex: ", err)
+			}
+		case "json_path":
+			_, err := parseJSONPath(assertion.Path)
+			if err != nil {
+				problems[field] = err.Error()
+			}
+		default:
+			problems[field] = "type should be one of contains, regex, json_path, header"
+		}
+	}
+
+	return problems
+}
+
+type statusRange struct {
+	min, max int
+}
+
+func (r statusRange) String() string {
+	if r.min == r.max {
+		return strconv.Itoa(r.min)
+	}
+	return fmt.Sprintf("%d-%d", r.min, r.max)
+}
+
+func parseStatusRange(s string) (statusRange, error) {
+	if len(s) == 3 && strings.HasSuffix(strings.ToLower(s), "xx") {
+		class, err := strconv.Atoi(s[:1])
+		if err != nil || class < 1 || class > 5 {
+			return statusRange{}, fmt.Errorf("invalid status class '%s'", s)
+		}
+		return statusRange{class * 100, class*100 + 99}, nil
+	}
+
+	from, to, isRange := strings.Cut(s, "-")
+	min, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return statusRange{}, fmt.Errorf("invalid status code '%s'", s)
+	}
+	max := min
+	if isRange {
+		max, err = strconv.Atoi(strings.TrimSpace(to))
+		if err != nil {
+			return statusRange{}, fmt.Errorf("invalid status code '%s'", s)
+		}
+	}
+
+	if min < 100 || max > 599 || min > max {
+		return statusRange{}, fmt.Errorf("invalid status range '%s'", s)
+	}
+	return statusRange{min, max}, nil
+}
+
+type HTTPMonitor struct {
+	ID     utils.EntityID
+	cfg    HTTPConfig
+	client *http.Client
+	status []statusRange
+	regexs []*regexp.Regexp
+}
+
+func (m *HTTPMonitor) Run(parentCtx context.Context) (RunResult, error) {
+	var result RunResult
+
+	ctx, cancel := context.WithTimeout(parentCtx, time.Duration(m.cfg.Timeout)*time.Second)
+	defer cancel()
+
+	method := m.cfg.Method
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+
+	var body io.Reader
+	if len(m.cfg.Body) > 0 {
+		body = strings.NewReader(m.cfg.Body)
+	}
+
+	start := time.Now()
+	var dnsStart, connectStart, tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			result.Phases.DNS += time.Since(dnsStart)
+		},
+		ConnectStart: func(string, string) { connectStart = time.Now() },
+		ConnectDone: func(string, string, error) {
+			result.Phases.Connect += time.Since(connectStart)
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			result.Phases.TLS += time.Since(tlsStart)
+		},
+		GotFirstResponseByte: func() {
+			result.Phases.FirstByte = time.Since(start)
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), method, m.cfg.URL, body)
+	if err != nil {
+		return result, err
+	}
+	for k, v := range m.cfg.Headers {
+		if strings.EqualFold(k, "host") {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		result.Latency = time.Since(start)
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPBodySize))
+	result.Latency = time.Since(start)
+	if err != nil {
+		return result, fmt.Errorf("reading body: %w", err)
+	}
+
+	if !m.statusExpected(resp.StatusCode) {
+		expected := make([]string, len(m.status))
+		for i, r := range m.status {
+			expected[i] = r.String()
+		}
+		return result, fmt.Errorf("unexpected status code %d, expected %s", resp.StatusCode, strings.Join(expected, ", "))
+	}
+
+	for i, assertion := range m.cfg.Assertions {
+		err := m.check(i, assertion, resp.Header, respBody)
+		if err != nil {
+			return result, fmt.Errorf("assertion %d failed: %w", i, err)
+		}
+	}
+
+	return result, nil
+}
+
+func (m *HTTPMonitor) statusExpected(code int) bool {
+	for _, r := range m.status {
+		if code >= r.min && code <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *HTTPMonitor) check(i int, assertion HTTPAssertion, header http.Header, body []byte) error {
+	switch assertion.Type {
+	case "header":
+		values, ok := header[http.CanonicalHeaderKey(assertion.Path)]
+		if !ok {
+			return fmt.Errorf("header '%s' is missing", assertion.Path)
+		}
+		if len(assertion.Value) > 0 && !slices.Contains(values, assertion.Value) {
+			return fmt.Errorf("header '%s': expected %q, got %q", assertion.Path, assertion.Value, strings.Join(values, ", "))
+		}
+	case "contains":
+		if !bytes.Contains(body, []byte(assertion.Value)) {
+			return fmt.Errorf("body does not contain %q", assertion.Value)
+		}
+	case "regex":
+		if !m.regexs[i].Match(body) {
+			return fmt.Errorf("body does not match regex %q", assertion.Value)
+		}
+	case "json_path":
+		var doc any
+		err := json.Unmarshal(body, &doc)
+		if err != nil {
+			return fmt.Errorf("body is not valid json: %w", err)
+		}
+
+		path, _ := parseJSONPath(assertion.Path)
+		value, err := lookupJSONPath(doc, path)
+		if err != nil {
+			return fmt.Errorf("json path '%s': %w", assertion.Path, err)
+		}
+
+		got := jsonValueString(value)
+		if got != assertion.Value {
+			return fmt.Errorf("json path '%s': expected %q, got %q", assertion.Path, assertion.Value, got)
+		}
+	}
+	return nil
+}
+
+// Parses paths like "$.data.items[0].name" or "data.items.0.name" into
+// keys and array indices
+func parseJSONPath(path string) ([]string, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if len(path) == 0 {
+		return nil, errors.New("json path is required")
+	}
+
+	var parts []string
+	for _, part := range strings.Split(path, ".") {
+		key, rest, hasIndex := strings.Cut(part, "[")
+		if len(key) > 0 {
+			parts = append(parts, key)
+		}
+		for hasIndex {
+			var index string
+			index, rest, _ = strings.Cut(rest, "]")
+			if _, err := strconv.Atoi(index); err != nil {
+				return nil, fmt.Errorf("invalid index '%s' in json path", index)
+			}
+			parts = append(parts, index)
+			_, rest, hasIndex = strings.Cut(rest, "[")
+		}
+		if len(key) == 0 && !strings.Contains(part, "[") {
+			return nil, fmt.Errorf("empty key in json path '%s'", path)
+		}
+	}
+	return parts, nil
+}
+
+func lookupJSONPath(doc any, path []string) (any, error) {
+	current := doc
+	for _, part := range path {
+		switch v := current.(type) {
+		case map[string]any:
+			next, ok := v[part]
+			if !ok {
+				return nil, fmt.Errorf("key '%s' not found", part)
+			}
+			current = next
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("'%s' is not an array index", part)
+			}
+			if i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("index %d out of range", i)
+			}
+			current = v[i]
+		default:
+			return nil, fmt.Errorf("cannot look up '%s' in a scalar value", part)
+		}
+	}
+	return current, nil
+}
+
+// Strings are compared as is, everything else by its json encoding
+func jsonValueString(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func (m *HTTPMonitor) Configure(id utils.EntityID, rawCfg []byte) error {
+	var cfg HTTPConfig
+	err := json.Unmarshal(rawCfg, &cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultHTTPTimeout
+	}
+
+	status := make([]statusRange, 0, len(cfg.ExpectedStatus))
+	for _, s := range cfg.ExpectedStatus {
+		r, err := parseStatusRange(s)
+		if err != nil {
+			return err
+		}
+		status = append(status, r)
+	}
+	if len(status) == 0 {
+		status = append(status, statusRange{200, 299})
+	}
+
+	regexs := make([]*regexp.Regexp, len(cfg.Assertions))
+	for i, assertion := range cfg.Assertions {
+		if assertion.Type != "regex" {
+			continue
+		}
+		regexs[i], err = regexp.Compile(assertion.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	maxRedirects := cfg.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = 10
+	}
+	follow := cfg.FollowRedirects == nil || *cfg.FollowRedirects
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: cfg.SkipTLSVerify,
+	}
+	// Every run should measure a fresh connection
+	transport.DisableKeepAlives = true
+
+	m.ID = id
+	m.cfg = cfg
+	m.status = status
+	m.regexs = regexs
+	m.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !follow {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		},
+	}
+	return nil
+}
+
+func (m *HTTPMonitor) Eq(newRawCfg []byte) (bool, error) {
+	var newMon HTTPMonitor
+	err := newMon.Configure(m.ID, newRawCfg)
+	if err != nil {
+		return false, err
+	}
+
+	return reflect.DeepEqual(m.cfg, newMon.cfg), nil
+}
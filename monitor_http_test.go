@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newHTTPMonitor(t *testing.T, cfg map[string]any) *HTTPMonitor {
+	t.Helper()
+	rawCfg, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var httpCfg HTTPConfig
+	err = json.Unmarshal(rawCfg, &httpCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := httpCfg.Valid(context.Background()); len(problems) > 0 {
+		t.Fatalf("config is invalid: %v", problems)
+	}
+
+	var mon HTTPMonitor
+	err = mon.Configure(NewMonitorID("test", "web", "http", "site"), rawCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mon
+}
+
+func startHTTPServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Meerkat", "ready")
+		fmt.Fprint(w, `{"status": "ok", "items": [{"name": "first", "size": 3}]}`)
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	// Redirects /redirect/{n} down to /redirect/0, which ends at /ok
+	mux.HandleFunc("/redirect/{n}", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.PathValue("n"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next := "/ok"
+		if n > 0 {
+			next = fmt.Sprintf("/redirect/%d", n-1)
+		}
+		http.Redirect(w, r, next, http.StatusFound)
+	})
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s token=%s body=%s", r.Method, r.Host, r.Header.Get("X-Token"), body)
+	})
+	// Answers after the client gives up
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPMonitor(t *testing.T) {
+	server := startHTTPServer(t)
+
+	tests := []struct {
+		name string
+		path string
+		cfg  map[string]any
+		err  string
+	}{
+		{
+			name: "default status",
+			path: "/ok",
+		},
+		{
+			name: "unexpected status",
+			path: "/missing",
+			err:  "unexpected status code 404, expected 200-299",
+		},
+		{
+			name: "expected status code",
+			path: "/missing",
+			cfg:  map[string]any{"expected_status": []string{"200", "404"}},
+		},
+		{
+			name: "expected status class",
+			path: "/missing",
+			cfg:  map[string]any{"expected_status": []string{"4xx"}},
+		},
+		{
+			name: "unexpected status range",
+			path: "/ok",
+			cfg:  map[string]any{"expected_status": []string{"300-399", "500"}},
+			err:  "unexpected status code 200, expected 300-399, 500",
+		},
+		{
+			name: "request method, headers and body",
+			path: "/echo",
+			cfg: map[string]any{
+				"method":     "POST",
+				"headers":    map[string]string{"X-Token": "secret", "Host": "status.example.com"},
+				"body":       "ping",
+				"assertions": []map[string]any{{"type": "contains", "value": "POST status.example.com token=secret body=ping"}},
+			},
+		},
+		{
+			name: "body contains",
+			path: "/ok",
+			cfg:  map[string]any{"assertions": []map[string]any{{"type": "contains", "value": `"status": "ok"`}}},
+		},
+		{
+			name: "body does not contain",
+			path: "/ok",
+			cfg:  map[string]any{"assertions": []map[string]any{{"type": "contains", "value": "degraded"}}},
+			err:  `assertion 0 failed: body does not contain "degraded"`,
+		},
+		{
+			name: "body matches regex",
+			path: "/ok",
+			cfg:  map[string]any{"assertions": []map[string]any{{"type": "regex", "value": `"size":\s*\d+`}}},
+		},
+		{
+			name: "body does not match regex",
+			path: "/ok",
+			cfg:  map[string]any{"assertions": []map[string]any{{"type": "regex", "value": `^\[`}}},
+			err:  "body does not match regex",
+		},
+		{
+			name: "json path",
+			path: "/ok",
+			cfg: map[string]any{"assertions": []map[string]any{
+				{"type": "json_path", "path": "$.items[0].name", "value": "first"},
+				{"type": "json_path", "path": "items.0.size", "value": "3"},
+			}},
+		},
+		{
+			name: "json path mismatch",
+			path: "/ok",
+			cfg:  map[string]any{"assertions": []map[string]any{{"type": "json_path", "path": "$.status", "value": "down"}}},
+			err:  `json path '$.status': expected "down", got "ok"`,
+		},
+		{
+			name: "json path missing key",
+			path: "/ok",
+			cfg:  map[string]any{"assertions": []map[string]any{{"type": "json_path", "path": "$.items[1].name"}}},
+			err:  "index 1 out of range",
+		},
+		{
+			name: "body is not json",
+			path: "/echo",
+			cfg:  map[string]any{"assertions": []map[string]any{{"type": "json_path", "path": "$.status"}}},
+			err:  "body is not valid json",
+		},
+		{
+			name: "header present",
+			path: "/ok",
+			cfg: map[string]any{"assertions": []map[string]any{
+				{"type": "header", "path": "x-meerkat"},
+				{"type": "header", "path": "X-Meerkat", "value": "ready"},
+			}},
+		},
+		{
+			name: "header value mismatch",
+			path: "/ok",
+			cfg:  map[string]any{"assertions": []map[string]any{{"type": "header", "path": "X-Meerkat", "value": "busy"}}},
+			err:  `assertion 0 failed: header 'X-Meerkat': expected "busy", got "ready"`,
+		},
+		{
+			name: "header missing",
+			path: "/ok",
+			cfg:  map[string]any{"assertions": []map[string]any{{"type": "header", "path": "X-Missing"}}},
+			err:  "header 'X-Missing' is missing",
+		},
+		{
+			name: "redirects followed",
+			path: "/redirect/3",
+			cfg:  map[string]any{"assertions": []map[string]any{{"type": "header", "path": "X-Meerkat"}}},
+		},
+		{
+			name: "redirects not followed",
+			path: "/redirect/0",
+			cfg:  map[string]any{"follow_redirects": false},
+			err:  "unexpected status code 302",
+		},
+		{
+			name: "redirect status expected",
+			path: "/redirect/0",
+			cfg:  map[string]any{"follow_redirects": false, "expected_status": []string{"3xx"}},
+		},
+		{
+			name: "too many redirects",
+			path: "/redirect/3",
+			cfg:  map[string]any{"max_redirects": 2},
+			err:  "stopped after 2 redirects",
+		},
+		{
+			name: "timeout",
+			path: "/slow",
+			cfg:  map[string]any{"timeout": 1},
+			err:  "context deadline exceeded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := map[string]any{"url": server.URL + tt.path}
+			for k, v := range tt.cfg {
+				cfg[k] = v
+			}
+			mon := newHTTPMonitor(t, cfg)
+
+			start := time.Now()
+			result, err := mon.Run(context.Background())
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("expected the run to finish before the server answers, took %s", elapsed)
+			}
+			if checkError(t, err, tt.err) {
+				return
+			}
+			if result.Latency <= 0 || result.Phases.FirstByte <= 0 {
+				t.Errorf("expected latency and time to first byte, got %+v", result)
+			}
+		})
+	}
+}
+
+func TestHTTPMonitorEq(t *testing.T) {
+	mon := newHTTPMonitor(t, map[string]any{"url": "http://example.com/health"})
+	if mon.cfg.Timeout != defaultHTTPTimeout {
+		t.Fatalf("expected the default timeout, got %d", mon.cfg.Timeout)
+	}
+
+	same, err := mon.Eq([]byte(`{"url": "http://example.com/health"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same {
+		t.Error("expected the same config to be equal")
+	}
+
+	same, err = mon.Eq([]byte(`{"url": "http://example.com/health", "timeout": 3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same {
+		t.Error("expected a changed timeout to make the config differ")
+	}
+}
+
+func TestHTTPConfigValid(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   HTTPConfig
+		field string
+	}{
+		{name: "scheme", cfg: HTTPConfig{URL: "ftp://example.com"}, field: "url"},
+		{name: "host", cfg: HTTPConfig{URL: "http://"}, field: "url"},
+		{name: "method", cfg: HTTPConfig{URL: "http://example.com", Method: "GET /"}, field: "method"},
+		{name: "status", cfg: HTTPConfig{URL: "http://example.com", ExpectedStatus: []string{"6xx"}}, field: "expected_status"},
+		{name: "status range", cfg: HTTPConfig{URL: "http://example.com", ExpectedStatus: []string{"299-200"}}, field: "expected_status"},
+		{name: "redirects", cfg: HTTPConfig{URL: "http://example.com", MaxRedirects: -1}, field: "max_redirects"},
+		{name: "assertion type", cfg: HTTPConfig{URL: "http://example.com", Assertions: []HTTPAssertion{{Type: "xpath"}}}, field: "assertions[0]"},
+		{name: "header name", cfg: HTTPConfig{URL: "http://example.com", Assertions: []HTTPAssertion{{Type: "header"}}}, field: "assertions[0]"},
+		{name: "regex", cfg: HTTPConfig{URL: "http://example.com", Assertions: []HTTPAssertion{{Type: "regex", Value: "("}}}, field: "assertions[0]"},
+		{name: "json path", cfg: HTTPConfig{URL: "http://example.com", Assertions: []HTTPAssertion{{Type: "json_path", Path: "items[x]"}}}, field: "assertions[0]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := tt.cfg.Valid(context.Background())
+			if _, ok := problems[tt.field]; !ok || len(problems) != 1 {
+				t.Errorf("expected a problem with %s only, got %v", tt.field, problems)
+			}
+		})
+	}
+
+	valid := HTTPConfig{URL: "https://example.com", ExpectedStatus: []string{"2xx", "301-302"}}
+	if problems := valid.Valid(context.Background()); len(problems) > 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+type ProcessMonitorConfig struct {
+	ProcessMatch
+	// Defaults to 1, or to 0 when max_count is 0 so a process can be
+	// required not to run
+	MinCount *int `json:"min_count"`
+	// Unlimited when unset
+	MaxCount *int `json:"max_count"`
+}
+
+func (c *ProcessMonitorConfig) Valid(ctx context.Context) map[string]string {
+	problems := c.ProcessMatch.Valid(ctx)
+
+	if c.MinCount != nil && *c.MinCount < 0 {
+		problems["min_count"] = "cannot be less than zero"
+	}
+
+	if c.MaxCount != nil && *c.MaxCount < 0 {
+		problems["max_count"] = "cannot be less than zero"
+	} else if c.MaxCount != nil && *c.MaxCount < c.minCount() {
+		problems["max_count"] = "cannot be less than min_count"
+	}
+
+	return problems
+}
+
+// Minimum count with the default applied
+func (c *ProcessMonitorConfig) minCount() int {
+	if c.MinCount != nil {
+		return *c.MinCount
+	}
+	if c.MaxCount != nil && *c.MaxCount < 1 {
+		return 0
+	}
+	return 1
+}
+
+type ProcessMonitor struct {
+	ID      utils.EntityID
+	cfg     ProcessMonitorConfig
+	matcher processMatcher
+}
+
+func (m *ProcessMonitor) Run(ctx context.Context) (RunResult, error) {
+	var result RunResult
+
+	start := time.Now()
+	procs, err := m.matcher.Find()
+	result.Latency = time.Since(start)
+	if err != nil {
+		return result, err
+	}
+
+	if len(procs) < *m.cfg.MinCount {
+		return result, fmt.Errorf("found %d matching processes%s, expected at least %d", len(procs), listPIDs(procs), *m.cfg.MinCount)
+	}
+	if m.cfg.MaxCount != nil && len(procs) > *m.cfg.MaxCount {
+		return result, fmt.Errorf("found %d matching processes%s, expected at most %d", len(procs), listPIDs(procs), *m.cfg.MaxCount)
+	}
+
+	return result, nil
+}
+
+func listPIDs(procs []Process) string {
+	if len(procs) == 0 {
+		return ""
+	}
+	pids := make([]string, len(procs))
+	for i, proc := range procs {
+		pids[i] = strconv.Itoa(proc.PID)
+	}
+	return fmt.Sprintf(" (%s)", strings.Join(pids, ", "))
+}
+
+func (m *ProcessMonitor) Configure(id utils.EntityID, rawCfg []byte) error {
+	var cfg ProcessMonitorConfig
+	err := json.Unmarshal(rawCfg, &cfg)
+	if err != nil {
+		return err
+	}
+
+	minCount := cfg.minCount()
+	cfg.MinCount = &minCount
+
+	matcher, err := newProcessMatcher(cfg.ProcessMatch)
+	if err != nil {
+		return err
+	}
+
+	m.ID = id
+	m.cfg = cfg
+	m.matcher = matcher
+	return nil
+}
+
+func (m *ProcessMonitor) Eq(newRawCfg []byte) (bool, error) {
+	var newMon ProcessMonitor
+	err := newMon.Configure(m.ID, newRawCfg)
+	if err != nil {
+		return false, err
+	}
+
+	return reflect.DeepEqual(m.cfg, newMon.cfg), nil
+}
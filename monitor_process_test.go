@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestProcessMonitorCountBounds(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]any
+		// Minimum count after Configure, unused when the config is invalid
+		minCount int
+		// Key of the expected problem, empty when the config is valid
+		problem string
+	}{
+		{
+			name:     "defaults",
+			cfg:      map[string]any{},
+			minCount: 1,
+		},
+		{
+			name:     "must not run",
+			cfg:      map[string]any{"max_count": 0},
+			minCount: 0,
+		},
+		{
+			name:     "max only",
+			cfg:      map[string]any{"max_count": 3},
+			minCount: 1,
+		},
+		{
+			name:     "both set",
+			cfg:      map[string]any{"min_count": 2, "max_count": 2},
+			minCount: 2,
+		},
+		{
+			name:    "max below min",
+			cfg:     map[string]any{"min_count": 2, "max_count": 1},
+			problem: "max_count",
+		},
+		{
+			name:    "max zero with min set",
+			cfg:     map[string]any{"min_count": 1, "max_count": 0},
+			problem: "max_count",
+		},
+		{
+			name:    "negative min",
+			cfg:     map[string]any{"min_count": -1},
+			problem: "min_count",
+		},
+		{
+			name:    "negative max",
+			cfg:     map[string]any{"max_count": -1},
+			problem: "max_count",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := map[string]any{"process_name": "meerkat"}
+			for k, v := range tt.cfg {
+				cfg[k] = v
+			}
+			rawCfg, err := json.Marshal(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var processCfg ProcessMonitorConfig
+			err = json.Unmarshal(rawCfg, &processCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			problems := processCfg.Valid(context.Background())
+			if len(tt.problem) > 0 {
+				if _, ok := problems[tt.problem]; !ok || len(problems) != 1 {
+					t.Fatalf("expected a problem with %s, got %v", tt.problem, problems)
+				}
+				return
+			}
+			if len(problems) > 0 {
+				t.Fatalf("config is invalid: %v", problems)
+			}
+
+			var mon ProcessMonitor
+			err = mon.Configure(NewMonitorID("test", "host", "process", "meerkat"), rawCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *mon.cfg.MinCount != tt.minCount {
+				t.Errorf("expected min_count %d, got %d", tt.minCount, *mon.cfg.MinCount)
+			}
+		})
+	}
+}
+
+func TestProcessMonitorMustNotRun(t *testing.T) {
+	pidfile := filepath.Join(t.TempDir(), "meerkat.pid")
+
+	var mon ProcessMonitor
+	rawCfg, err := json.Marshal(map[string]any{"pidfile": pidfile, "max_count": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mon.Configure(NewMonitorID("test", "host", "process", "meerkat"), rawCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = mon.Run(context.Background())
+	checkError(t, err, "")
+
+	err = os.WriteFile(pidfile, []byte(strconv.Itoa(os.Getpid())), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mon.Run(context.Background())
+	checkError(t, err, "expected at most 0")
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+const (
+	defaultTLSExpiryDays = 14
+	defaultTLSTimeout    = 10
+)
+
+type TLSConfig struct {
+	Hostname string `json:"hostname"`
+	// Defaults to 443
+	Port string `json:"port"`
+	// SNI sent in the handshake and checked against the certificate,
+	// defaults to the hostname
+	ServerName string `json:"server_name"`
+	// Fail when any certificate in the chain expires within this many days,
+	// defaults to 14
+	ExpiryDays      int  `json:"expiry_days"`
+	AllowSelfSigned bool `json:"allow_self_signed"`
+	// Defaults to 10 seconds
+	Timeout int `json:"timeout"`
+}
+
+func (c *TLSConfig) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string, 4)
+	if err := CheckHostname(c.Hostname); err != nil {
+		problems["hostname"] = err.Error()
+	}
+
+	if len(c.Port) > 0 {
+		if err := CheckPort(c.Port); err != nil {
+			problems["port"] = err.Error()
+		}
+	}
+
+	if len(c.ServerName) > 0 && !HostnameRegex.MatchString(c.ServerName) {
+		problems["server_name"] = "invalid hostname"
+	}
+
+	if c.ExpiryDays < 0 {
+		problems["expiry_days"] = "cannot be less than zero"
+	}
+
+	if c.Timeout < 0 {
+		problems["timeout"] = "cannot be less than zero"
+	}
+
+	return problems
+}
+
+type TLSMonitor struct {
+	ID   utils.EntityID
+	cfg  TLSConfig
+	sink MetricsSink
+}
+
+func (m *TLSMonitor) Run(parentCtx context.Context) (RunResult, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, time.Duration(m.cfg.Timeout)*time.Second)
+	defer cancel()
+
+	certs, result, err := FetchTLSChain(ctx, m.cfg.Hostname, m.cfg.Port, m.cfg.ServerName)
+	if err != nil {
+		return result, err
+	}
+
+	now := time.Now()
+	m.emitDaysRemaining(parentCtx, now, certs)
+
+	window := time.Duration(m.cfg.ExpiryDays) * 24 * time.Hour
+	for i, cert := range certs {
+		remaining := cert.NotAfter.Sub(now)
+		if remaining < window {
+			return result, fmt.Errorf("%s '%s' expires in %.1f days (%s)",
+				certName(i), cert.Subject.CommonName, remaining.Hours()/24, cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+
+	return result, VerifyTLSChain(certs, m.cfg.ServerName, m.cfg.AllowSelfSigned, now)
+}
+
+func (m *TLSMonitor) emitDaysRemaining(ctx context.Context, now time.Time, certs []*x509.Certificate) {
+	chainRemaining := certs[0].NotAfter.Sub(now)
+	for _, cert := range certs[1:] {
+		chainRemaining = min(chainRemaining, cert.NotAfter.Sub(now))
+	}
+
+	samples := []MetricsSample{
+		{
+			ID:        m.ID,
+			Timestamp: now,
+			Type:      MetricGauge,
+			Name:      "tls_cert_days_remaining",
+			Value:     certs[0].NotAfter.Sub(now).Hours() / 24,
+			Labels: map[string]string{
+				"cert": "leaf",
+			},
+		},
+		{
+			ID:        m.ID,
+			Timestamp: now,
+			Type:      MetricGauge,
+			Name:      "tls_cert_days_remaining",
+			Value:     chainRemaining.Hours() / 24,
+			Labels: map[string]string{
+				"cert": "chain",
+			},
+		},
+	}
+
+	for _, sample := range samples {
+		err := m.sink.Emit(ctx, sample)
+		if err != nil {
+			utils.DefaultLogger().Warn("Could not emit tls metrics", "id", m.ID.Canonical(), "err", err)
+		}
+	}
+}
+
+func certName(i int) string {
+	if i == 0 {
+		return "leaf certificate"
+	}
+	return fmt.Sprintf("chain certificate %d", i)
+}
+
+// Does a handshake without verification and returns the peer certificates,
+// leaf first
+func FetchTLSChain(ctx context.Context, hostname string, port string, serverName string) ([]*x509.Certificate, RunResult, error) {
+	var result RunResult
+	start := time.Now()
+
+	var d net.Dialer
+	rawConn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(hostname, port))
+	result.Phases.Connect = time.Since(start)
+	if err != nil {
+		result.Latency = result.Phases.Connect
+		return nil, result, err
+	}
+	defer rawConn.Close()
+
+	conn := tls.Client(rawConn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	err = conn.HandshakeContext(ctx)
+	result.Latency = time.Since(start)
+	result.Phases.TLS = result.Latency - result.Phases.Connect
+	if err != nil {
+		return nil, result, err
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, result, errors.New("server sent no certificates")
+	}
+	return certs, result, nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+func VerifyTLSChain(certs []*x509.Certificate, serverName string, allowSelfSigned bool, now time.Time) error {
+	leaf := certs[0]
+	if isSelfSigned(leaf) {
+		if !allowSelfSigned {
+			return fmt.Errorf("certificate '%s' is self-signed", leaf.Subject.CommonName)
+		}
+		err := leaf.VerifyHostname(serverName)
+		if err != nil {
+			return fmt.Errorf("hostname verification failed: %w", err)
+		}
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+	})
+	if err != nil {
+		return fmt.Errorf("certificate verification failed: %w", err)
+	}
+	return nil
+}
+
+func (m *TLSMonitor) Configure(id utils.EntityID, rawCfg []byte) error {
+	var cfg TLSConfig
+	err := json.Unmarshal(rawCfg, &cfg)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.Port) == 0 {
+		cfg.Port = "443"
+	}
+	if len(cfg.ServerName) == 0 {
+		cfg.ServerName = cfg.Hostname
+	}
+	if cfg.ExpiryDays == 0 {
+		cfg.ExpiryDays = defaultTLSExpiryDays
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTLSTimeout
+	}
+
+	m.ID = id
+	m.cfg = cfg
+	return nil
+}
+
+func (m *TLSMonitor) Eq(newRawCfg []byte) (bool, error) {
+	var newMon TLSMonitor
+	err := newMon.Configure(m.ID, newRawCfg)
+	if err != nil {
+		return false, err
+	}
+
+	return m.cfg == newMon.cfg, nil
+}
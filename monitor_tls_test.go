@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Keeps emitted samples in memory
+type memorySink struct {
+	mu      sync.Mutex
+	samples []MetricsSample
+}
+
+func (s *memorySink) Emit(ctx context.Context, sample MetricsSample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples = append(s.samples, sample)
+	return nil
+}
+
+func (s *memorySink) named(name string) []MetricsSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var samples []MetricsSample
+	for _, sample := range s.samples {
+		if sample.Name == name {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+func newTLSMonitor(t *testing.T, sink MetricsSink, cfg map[string]any) *TLSMonitor {
+	t.Helper()
+	rawCfg, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tlsCfg TLSConfig
+	err = json.Unmarshal(rawCfg, &tlsCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := tlsCfg.Valid(context.Background()); len(problems) > 0 {
+		t.Fatalf("config is invalid: %v", problems)
+	}
+
+	mon := &TLSMonitor{sink: sink}
+	err = mon.Configure(NewMonitorID("test", "web", "tls", "cert"), rawCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mon
+}
+
+func TestTLSMonitor(t *testing.T) {
+	// The test certificate is self-signed, valid for example.com and
+	// 127.0.0.1 until 2084
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  map[string]any
+		err  string
+	}{
+		{
+			name: "self-signed allowed",
+			cfg:  map[string]any{"server_name": "example.com", "allow_self_signed": true},
+		},
+		{
+			name: "self-signed rejected",
+			cfg:  map[string]any{"server_name": "example.com"},
+			err:  "is self-signed",
+		},
+		{
+			name: "hostname mismatch",
+			cfg:  map[string]any{"server_name": "wrong.example.org", "allow_self_signed": true},
+			err:  "hostname verification failed",
+		},
+		{
+			name: "expires within the window",
+			cfg:  map[string]any{"server_name": "example.com", "allow_self_signed": true, "expiry_days": 100 * 365},
+			err:  "leaf certificate",
+		},
+		{
+			name: "nothing listening",
+			cfg:  map[string]any{"server_name": "example.com", "allow_self_signed": true, "port": "1"},
+			err:  "connection refused",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := map[string]any{"hostname": host, "port": port, "timeout": 5}
+			for k, v := range tt.cfg {
+				cfg[k] = v
+			}
+
+			sink := &memorySink{}
+			mon := newTLSMonitor(t, sink, cfg)
+			result, err := mon.Run(context.Background())
+			if checkError(t, err, tt.err) {
+				return
+			}
+			if result.Latency <= 0 {
+				t.Errorf("expected the latency to be measured")
+			}
+		})
+	}
+}
+
+func TestTLSMonitorEmitsDaysRemaining(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "https://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &memorySink{}
+	mon := newTLSMonitor(t, sink, map[string]any{
+		"hostname":          host,
+		"port":              port,
+		"server_name":       "example.com",
+		"allow_self_signed": true,
+	})
+	_, err = mon.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := sink.named("tls_cert_days_remaining")
+	if len(samples) != 2 {
+		t.Fatalf("expected leaf and chain samples, got %d", len(samples))
+	}
+	for _, sample := range samples {
+		if sample.Type != MetricGauge {
+			t.Errorf("expected a gauge, got %s", sample.Type)
+		}
+		if sample.Value < 365 {
+			t.Errorf("%s: expected years of validity left, got %.1f days", sample.Labels["cert"], sample.Value)
+		}
+		if sample.ID.Canonical() != mon.ID.Canonical() {
+			t.Errorf("expected samples of %s, got %s", mon.ID.Canonical(), sample.ID.Canonical())
+		}
+	}
+}
+
+func TestTLSMonitorHandshakeTimeout(t *testing.T) {
+	// Accepts connections but never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mon := newTLSMonitor(t, &memorySink{}, map[string]any{"hostname": host, "port": port})
+	if mon.cfg.Timeout != defaultTLSTimeout {
+		t.Fatalf("expected the default timeout, got %d", mon.cfg.Timeout)
+	}
+
+	mon.cfg.Timeout = 1
+	_, err = mon.Run(context.Background())
+	checkError(t, err, "deadline exceeded")
+}
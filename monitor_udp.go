@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+const (
+	defaultUDPTimeout = 5
+	maxUDPPacketSize  = 64 * 1024
+)
+
+type UDPConfig struct {
+	Hostname string `json:"hostname"`
+	Port     string `json:"port"`
+	// Payload to send, either as text or hex encoded
+	Payload    string `json:"payload"`
+	PayloadHex string `json:"payload_hex"`
+	// Optional checks against the reply
+	ExpectRegex     string `json:"expect_regex"`
+	ExpectPrefix    string `json:"expect_prefix"`
+	ExpectPrefixHex string `json:"expect_prefix_hex"`
+	// Defaults to 5 seconds
+	Timeout int `json:"timeout"`
+}
+
+func (c *UDPConfig) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string, 5)
+	if err := CheckHostname(c.Hostname); err != nil {
+		problems["hostname"] = err.Error()
+	}
+
+	if err := CheckPort(c.Port); err != nil {
+		problems["port"] = err.Error()
+	}
+
+	if _, err := DecodePayload(c.Payload, c.PayloadHex); err != nil {
+		problems["payload"] = err.Error()
+	}
+
+	if len(c.ExpectRegex) > 0 {
+		if _, err := regexp.Compile(c.ExpectRegex); err != nil {
+			problems["expect_regex"] = fmt.Sprint("invalid regex: ", err)
+		}
+	}
+
+	if _, err := DecodePayload(c.ExpectPrefix, c.ExpectPrefixHex); err != nil {
+		problems["expect_prefix"] = err.Error()
+	}
+
+	if c.Timeout < 0 {
+		problems["timeout"] = "cannot be less than zero"
+	}
+
+	return problems
+}
+
+type UDPMonitor struct {
+	ID      utils.EntityID
+	cfg     UDPConfig
+	payload []byte
+	prefix  []byte
+	regex   *regexp.Regexp
+}
+
+func (m *UDPMonitor) Run(parentCtx context.Context) (RunResult, error) {
+	var result RunResult
+
+	ctx, cancel := context.WithTimeout(parentCtx, time.Duration(m.cfg.Timeout)*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	reply, err := ProbeUDP(ctx, m.cfg.Hostname, m.cfg.Port, m.payload)
+	result.Latency = time.Since(start)
+	result.Phases.FirstByte = result.Latency
+	if err != nil {
+		return result, err
+	}
+
+	if len(m.prefix) > 0 && !bytes.HasPrefix(reply, m.prefix) {
+		return result, fmt.Errorf("reply %q does not start with %q", truncate(reply, 64), m.prefix)
+	}
+
+	if m.regex != nil && !m.regex.Match(reply) {
+		return result, fmt.Errorf("reply %q does not match regex %q", truncate(reply, 64), m.cfg.ExpectRegex)
+	}
+
+	return result, nil
+}
+
+// Sends the payload and waits for a single reply until the context is done
+func ProbeUDP(ctx context.Context, hostname string, port string, payload []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(hostname, port))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Unblock the read when the monitor is stopped
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	_, err = conn.Write(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxUDPPacketSize)
+	n, err := conn.Read(buf)
+	// The read deadline is the context's, it can pass just before the
+	// context is done
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		<-ctx.Done()
+	}
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("no reply: %w", ctx.Err())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+func (m *UDPMonitor) Configure(id utils.EntityID, rawCfg []byte) error {
+	var cfg UDPConfig
+	err := json.Unmarshal(rawCfg, &cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultUDPTimeout
+	}
+
+	payload, err := DecodePayload(cfg.Payload, cfg.PayloadHex)
+	if err != nil {
+		return err
+	}
+
+	prefix, err := DecodePayload(cfg.ExpectPrefix, cfg.ExpectPrefixHex)
+	if err != nil {
+		return err
+	}
+
+	var regex *regexp.Regexp
+	if len(cfg.ExpectRegex) > 0 {
+		regex, err = regexp.Compile(cfg.ExpectRegex)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.ID = id
+	m.cfg = cfg
+	m.payload = payload
+	m.prefix = prefix
+	m.regex = regex
+	return nil
+}
+
+func (m *UDPMonitor) Eq(newRawCfg []byte) (bool, error) {
+	var newMon UDPMonitor
+	err := newMon.Configure(m.ID, newRawCfg)
+	if err != nil {
+		return false, err
+	}
+
+	return m.cfg == newMon.cfg, nil
+}
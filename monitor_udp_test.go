@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Answers PING with PONG and LONG with a reply longer than errors quote,
+// anything else is never answered
+func startUDPServer(t *testing.T) (string, string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			switch string(bytes.TrimSpace(buf[:n])) {
+			case "PING":
+				conn.WriteTo([]byte("PONG 42\n"), addr)
+			case "LONG":
+				conn.WriteTo([]byte(strings.Repeat("x", 100)), addr)
+			}
+		}
+	}()
+
+	host, port, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, port
+}
+
+func TestUDPMonitor(t *testing.T) {
+	host, port := startUDPServer(t)
+
+	tests := []struct {
+		name string
+		cfg  map[string]any
+		err  string
+	}{
+		{
+			name: "any reply",
+			cfg:  map[string]any{"payload": "PING"},
+		},
+		{
+			name: "hex payload and prefix",
+			cfg:  map[string]any{"payload_hex": "50494e470a", "expect_prefix_hex": "504f4e47"},
+		},
+		{
+			name: "prefix and regex",
+			cfg:  map[string]any{"payload": "PING", "expect_prefix": "PONG", "expect_regex": `\d+`},
+		},
+		{
+			name: "prefix mismatch",
+			cfg:  map[string]any{"payload": "PING", "expect_prefix": "PANG"},
+			err:  `reply "PONG 42\n" does not start with "PANG"`,
+		},
+		{
+			name: "regex mismatch",
+			cfg:  map[string]any{"payload": "PING", "expect_regex": `^\d`},
+			err:  `reply "PONG 42\n" does not match regex "^\\d"`,
+		},
+		{
+			name: "long reply is truncated",
+			cfg:  map[string]any{"payload": "LONG", "expect_prefix": "y"},
+			err:  `reply "` + strings.Repeat("x", 64) + `" does not start with "y"`,
+		},
+		{
+			name: "no reply",
+			cfg:  map[string]any{"payload": "SLOW", "timeout": 1},
+			err:  "no reply: context deadline exceeded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := map[string]any{"hostname": host, "port": port}
+			for k, v := range tt.cfg {
+				cfg[k] = v
+			}
+			rawCfg, err := json.Marshal(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var udpCfg UDPConfig
+			err = json.Unmarshal(rawCfg, &udpCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if problems := udpCfg.Valid(context.Background()); len(problems) > 0 {
+				t.Fatalf("config is invalid: %v", problems)
+			}
+
+			var mon UDPMonitor
+			err = mon.Configure(NewMonitorID("test", "udp", "udp", "echo"), rawCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			result, err := mon.Run(context.Background())
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("expected the run to finish before the default timeout, took %s", elapsed)
+			}
+			if checkError(t, err, tt.err) {
+				return
+			}
+			if result.Latency <= 0 {
+				t.Errorf("expected a latency, got %s", result.Latency)
+			}
+		})
+	}
+}
+
+func TestUDPMonitorStopped(t *testing.T) {
+	host, port := startUDPServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := ProbeUDP(ctx, host, port, []byte("SLOW"))
+	checkError(t, err, "no reply: context canceled")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the probe to stop with the context, took %s", elapsed)
+	}
+}
+
+func TestUDPConfigValid(t *testing.T) {
+	cfg := UDPConfig{
+		Hostname:        "localhost",
+		Port:            "53",
+		Payload:         "PING",
+		PayloadHex:      "00",
+		ExpectRegex:     "(",
+		ExpectPrefixHex: "zz",
+		Timeout:         -1,
+	}
+
+	problems := cfg.Valid(context.Background())
+	for _, field := range []string{"payload", "expect_regex", "expect_prefix", "timeout"} {
+		if _, ok := problems[field]; !ok {
+			t.Errorf("expected a problem with %s, got %v", field, problems)
+		}
+	}
+	if len(problems) != 4 {
+		t.Errorf("expected 4 problems, got %v", problems)
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
 	"net"
+	"reflect"
 	"regexp"
 	"strconv"
 	"time"
@@ -34,55 +37,152 @@ func NewMonitorIDFromServiceID(serviceID utils.EntityID, monType, name string) u
 	)
 }
 
-func BuildMonitor(serviceID utils.EntityID, rawCfg []byte) (utils.EntityID, *EntityInstance, error) {
+func RegisterMonitorTypes(r *Registry, sink MetricsSink) {
+	r.MustRegister(EntityType{
+		Name:        "tcp",
+		Description: "Checks that a TCP port accepts connections",
+		Config:      func() Validator { return &TCPConfig{} },
+		New:         func() Entity { return &TCPMonitor{} },
+	})
+	r.MustRegister(EntityType{
+		Name:        "http",
+		Description: "Sends an HTTP request and checks the status code, headers and body",
+		Config:      func() Validator { return &HTTPConfig{} },
+		New:         func() Entity { return &HTTPMonitor{} },
+	})
+	r.MustRegister(EntityType{
+		Name:        "tls",
+		Description: "Checks the TLS certificate chain for expiry, hostname and trust",
+		Config:      func() Validator { return &TLSConfig{} },
+		New:         func() Entity { return &TLSMonitor{sink: sink} },
+	})
+	r.MustRegister(EntityType{
+		Name:        "dns",
+		Description: "Resolves a name and checks the returned records",
+		Config:      func() Validator { return &DNSConfig{} },
+		New:         func() Entity { return &DNSMonitor{} },
+	})
+	r.MustRegister(EntityType{
+		Name:        "udp",
+		Description: "Sends a UDP payload and checks the reply",
+		Config:      func() Validator { return &UDPConfig{} },
+		New:         func() Entity { return &UDPMonitor{} },
+	})
+	r.MustRegister(EntityType{
+		Name:        "process",
+		Description: "Checks that the number of matching processes is within bounds",
+		Config:      func() Validator { return &ProcessMonitorConfig{} },
+		New:         func() Entity { return &ProcessMonitor{} },
+	})
+}
+
+func BuildMonitor(registry *Registry, serviceID utils.EntityID, rawCfg []byte) (utils.EntityID, *EntityInstance, error) {
 	var id utils.EntityID
+	resolved, err := ResolveConfig(rawCfg)
+	if err != nil {
+		return id, nil, err
+	}
+
 	var cfg EntityConfig
-	err := json.Unmarshal(rawCfg, &cfg)
+	err = json.Unmarshal(resolved.JSON, &cfg)
 	if err != nil {
 		return id, nil, err
 	}
 
-	problems := cfg.Valid(context.TODO())
-	if len(problems) > 0 {
-		return id, nil, NewValidationError(problems, serviceID.Labels["name"], cfg.Name)
+	var stateCfg StateConfig
+	err = json.Unmarshal(resolved.JSON, &stateCfg)
+	if err != nil {
+		return id, nil, err
 	}
 
+	// Every level is validated, so all problems of the monitor show up at once
+	problems := cfg.Valid(context.TODO())
+	maps.Copy(problems, stateCfg.Valid(context.TODO()))
+
 	id = NewMonitorIDFromServiceID(serviceID, cfg.Type, cfg.Name)
 
-	// TODO: Replace with modules
 	var entity Entity
-	switch cfg.Type {
-	case "cpu":
-		entity = &TCPMonitor{}
-	default:
-		return id, nil, fmt.Errorf("unknown monitor type: %s", cfg.Type)
+	if _, ok := problems["type"]; !ok {
+		entity, err = registry.Build(id, resolved.JSON)
+		var val *ValidationError
+		if errors.As(err, &val) {
+			maps.Copy(problems, val.Problems)
+		} else if err != nil {
+			return id, nil, resolved.Secrets.RedactError(err)
+		}
 	}
 
-	err = entity.Configure(id, rawCfg)
-	if err != nil {
-		return id, nil, err
+	if valErr := resolved.ValidationError(problems, serviceID.Labels["instance"], serviceID.Labels["name"], cfg.Name); valErr != nil {
+		return id, nil, valErr
 	}
 
-	return id, NewEntityInstance(id, entity, cfg, rawCfg), nil
+	return id, NewEntityInstance(id, entity, cfg, rawCfg, resolved), nil
 }
 
-func RunMonitor(heartbeatRepo HeartbeatRepo, logger *utils.Logger, inst *EntityInstance) {
+func RunMonitor(heartbeatRepo HeartbeatRepo, stateRepo StateChangeRepo, stateSink StateChangeSink, logger *utils.Logger, inst *EntityInstance) {
+	monitorID := inst.ID.Canonical()
+
+	stateCfg, err := ParseStateConfig(inst.Resolved.JSON)
+	if err != nil {
+		logger.Error("Could not parse state config", "id", monitorID, "err", err)
+		return
+	}
+
+	// Continue from the last recorded state so restarts don't repeat transitions
+	initial := StatePending
+	last, err := stateRepo.LatestStateChange(inst.ctx, monitorID)
+	if err == nil {
+		initial = last.To
+	} else if !errors.Is(err, ErrNoStateChange) {
+		logger.Warn("Could not get the last monitor state", "id", monitorID, "err", err)
+	}
+	tracker := NewStateTracker(stateCfg, initial)
+
 	interval := inst.Cfg.Interval
+
+	// Heartbeats older than the last few intervals belong to an earlier run
+	// and shouldn't count towards the thresholds
+	window := tracker.ResumeWindow()
+	now := time.Now()
+	recent, err := heartbeatRepo.ListHeartbeats(inst.ctx, monitorID, now.Add(-time.Duration(window+1)*interval*time.Second), now)
+	if err == nil {
+		tracker.Resume(recent[max(len(recent)-window, 0):])
+	} else if !errors.Is(err, ErrIDNotFound) {
+		logger.Warn("Could not get the last heartbeats", "id", monitorID, "err", err)
+	}
+
 	ticker := time.NewTicker(time.Duration(interval) * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			err := inst.Ent.Run(inst.ctx)
-			if errors.Is(err, context.Canceled) {
-				continue
+			result, err := inst.Ent.Run(inst.ctx)
+			// Stopped while probing, the result isn't worth recording
+			if inst.ctx.Err() != nil {
+				return
 			}
-			heartbeatRepo.InsertHeartbeat(inst.ctx, Heartbeat{
-				MonitorID: inst.ID.Canonical(),
+			heartbeat := Heartbeat{
+				MonitorID: monitorID,
 				Timestamp: time.Now(),
-				Error:     err,
-			})
+				Error:     inst.Resolved.Secrets.RedactError(err),
+				Latency:   result.Latency,
+				Phases:    result.Phases,
+			}
+			err = heartbeatRepo.InsertHeartbeat(inst.ctx, heartbeat)
+			if err != nil {
+				logger.Warn("Could not insert heartbeat", "id", monitorID, "err", err)
+			}
+
+			change, changed := tracker.Observe(heartbeat)
+			if !changed {
+				continue
+			}
+			logger.Info("Monitor state changed", "id", monitorID, "from", change.From, "to", change.To)
+			err = stateSink.Emit(inst.ctx, change)
+			if err != nil {
+				logger.Warn("Could not emit state change", "id", monitorID, "err", err)
+			}
 		case <-inst.ctx.Done():
 			return
 		}
@@ -106,38 +206,82 @@ func (m *EntityService) Stop(ctx context.Context) error {
 	}
 }
 
+type TCPStep struct {
+	// Sent first, either as text or hex encoded
+	Send    string `json:"send"`
+	SendHex string `json:"send_hex"`
+	// Text that has to appear in what's read after sending
+	Expect string `json:"expect"`
+	// Seconds, bounded by the monitor timeout
+	Timeout int `json:"timeout"`
+}
+
 type TCPConfig struct {
 	Hostname string `json:"hostname"`
 	Port     string `json:"port"`
-	Timeout  int    `json:"timeout"`
+	// Defaults to 5 seconds
+	Timeout int `json:"timeout"`
+	// Optional send/expect conversation done after connecting
+	Steps []TCPStep `json:"steps"`
 }
 
+const (
+	defaultTCPTimeout = 5
+	maxTCPReceived    = 64 * 1024
+)
+
 var HostnameRegex = regexp.MustCompile(`^(([a-zA-Z]|[a-zA-Z][a-zA-Z0-9\-]*[a-zA-Z0-9])\.)*([A-Za-z]|[A-Za-z][A-Za-z0-9\-]*[A-Za-z0-9])$`)
 var IPRegex = regexp.MustCompile(`^(([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\.){3}([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])$`)
 
-func (c *TCPConfig) Valid(ctx context.Context) map[string]string {
-	problems := make(map[string]string, 3)
-	if !HostnameRegex.MatchString(c.Hostname) || IPRegex.MatchString(c.Hostname) {
-		problems["hostname"] = "invalid hostname or ip addres"
+func CheckHostname(hostname string) error {
+	if !HostnameRegex.MatchString(hostname) && !IPRegex.MatchString(hostname) {
+		return errors.New("invalid hostname or ip address")
 	}
+	return nil
+}
 
-	numPort, err := strconv.Atoi(c.Port)
+func CheckPort(port string) error {
+	numPort, err := strconv.Atoi(port)
 	if err != nil {
-		problems["port"] = fmt.Sprint("port should be a valid number: ", err)
+		return fmt.Errorf("port should be a valid number: %w", err)
 	}
 
 	if numPort < 0 {
-		problems["port"] = "cannot be less than zero"
+		return errors.New("cannot be less than zero")
 	}
 
 	if numPort > 65535 {
-		problems["port"] = "cannot be greater than 65,535"
+		return errors.New("cannot be greater than 65,535")
+	}
+
+	return nil
+}
+
+func (c *TCPConfig) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string, 3)
+	if err := CheckHostname(c.Hostname); err != nil {
+		problems["hostname"] = err.Error()
+	}
+
+	if err := CheckPort(c.Port); err != nil {
+		problems["port"] = err.Error()
 	}
 
 	if c.Timeout < 0 {
 		problems["timeout"] = "cannot be less than zero"
 	}
 
+	for i, step := range c.Steps {
+		field := fmt.Sprintf("steps[%d]", i)
+		if _, err := DecodePayload(step.Send, step.SendHex); err != nil {
+			problems[field] = err.Error()
+		} else if len(step.Send) == 0 && len(step.SendHex) == 0 && len(step.Expect) == 0 {
+			problems[field] = "step should send or expect something"
+		} else if step.Timeout < 0 {
+			problems[field] = "timeout cannot be less than zero"
+		}
+	}
+
 	return problems
 }
 
@@ -146,20 +290,108 @@ type TCPMonitor struct {
 	cfg TCPConfig
 }
 
-func (m *TCPMonitor) Run(parentCtx context.Context) error {
+func (m *TCPMonitor) Run(parentCtx context.Context) (RunResult, error) {
 	ctx, cancel := context.WithTimeout(parentCtx, time.Duration(m.cfg.Timeout)*time.Second)
 	defer cancel()
+	if len(m.cfg.Steps) > 0 {
+		return ConverseTCP(ctx, m.cfg.Hostname, m.cfg.Port, m.cfg.Steps)
+	}
 	return PingTCP(ctx, m.cfg.Hostname, m.cfg.Port)
 }
 
-func PingTCP(ctx context.Context, hostname string, port string) error {
+func PingTCP(ctx context.Context, hostname string, port string) (RunResult, error) {
+	var result RunResult
+	start := time.Now()
+
 	var d net.Dialer
 	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(hostname, port))
+	result.Latency = time.Since(start)
+	result.Phases.Connect = result.Latency
 	if err != nil {
-		return err
+		return result, err
+	}
+	defer conn.Close()
+
+	return result, nil
+}
+
+// Connects and runs the steps in order, the returned error names the step
+// that failed
+func ConverseTCP(ctx context.Context, hostname string, port string, steps []TCPStep) (RunResult, error) {
+	var result RunResult
+	start := time.Now()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(hostname, port))
+	result.Phases.Connect = time.Since(start)
+	if err != nil {
+		result.Latency = result.Phases.Connect
+		return result, err
 	}
 	defer conn.Close()
 
+	err = converseTCP(ctx, conn, steps)
+	result.Latency = time.Since(start)
+	return result, err
+}
+
+func converseTCP(ctx context.Context, conn net.Conn, steps []TCPStep) error {
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	var received []byte
+	buf := make([]byte, 4096)
+	for i, step := range steps {
+		deadline, hasDeadline := ctx.Deadline()
+		if step.Timeout > 0 {
+			stepDeadline := time.Now().Add(time.Duration(step.Timeout) * time.Second)
+			if !hasDeadline || stepDeadline.Before(deadline) {
+				deadline, hasDeadline = stepDeadline, true
+			}
+		}
+		if hasDeadline {
+			conn.SetDeadline(deadline)
+		}
+
+		payload, err := DecodePayload(step.Send, step.SendHex)
+		if err != nil {
+			return fmt.Errorf("step %d: %w", i, err)
+		}
+		if len(payload) > 0 {
+			_, err = conn.Write(payload)
+			if err != nil {
+				return fmt.Errorf("step %d: sending: %w", i, err)
+			}
+		}
+
+		if len(step.Expect) == 0 {
+			continue
+		}
+
+		expect := []byte(step.Expect)
+		for {
+			idx := bytes.Index(received, expect)
+			if idx >= 0 {
+				received = received[idx+len(expect):]
+				break
+			}
+
+			n, err := conn.Read(buf)
+			received = append(received, buf[:n]...)
+			if err != nil {
+				if ctx.Err() != nil {
+					err = ctx.Err()
+				}
+				return fmt.Errorf("step %d: expected %q, got %q: %w", i, step.Expect, truncate(received, 64), err)
+			}
+			if len(received) > maxTCPReceived {
+				return fmt.Errorf("step %d: expected %q, got %q", i, step.Expect, truncate(received, 64))
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -170,9 +402,8 @@ func (m *TCPMonitor) Configure(id utils.EntityID, rawCfg []byte) error {
 		return err
 	}
 
-	problems := cfg.Valid(context.TODO())
-	if len(problems) > 0 {
-		return NewValidationError(problems, id.Labels["name"])
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTCPTimeout
 	}
 
 	m.ID = id
@@ -181,11 +412,11 @@ func (m *TCPMonitor) Configure(id utils.EntityID, rawCfg []byte) error {
 }
 
 func (m *TCPMonitor) Eq(newRawCfg []byte) (bool, error) {
-	var newCfg TCPConfig
-	err := json.Unmarshal(newRawCfg, &newCfg)
+	var newMon TCPMonitor
+	err := newMon.Configure(m.ID, newRawCfg)
 	if err != nil {
 		return false, err
 	}
 
-	return m.cfg == newCfg, nil
+	return reflect.DeepEqual(m.cfg, newMon.cfg), nil
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Greets with a banner and answers PING with PONG. SLOW is never answered
+// and QUIT closes the connection
+func startTCPServer(t *testing.T) (string, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("220 meerkat ready\r\n"))
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					switch strings.TrimSpace(scanner.Text()) {
+					case "PING":
+						conn.Write([]byte("PONG\r\n"))
+					case "QUIT":
+						conn.Write([]byte("BYE\r\n"))
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, port
+}
+
+func TestTCPMonitor(t *testing.T) {
+	host, port := startTCPServer(t)
+
+	tests := []struct {
+		name  string
+		steps []map[string]any
+		err   string
+	}{
+		{
+			name: "connect only",
+		},
+		{
+			name:  "banner",
+			steps: []map[string]any{{"expect": "220 "}},
+		},
+		{
+			name: "send and expect",
+			steps: []map[string]any{
+				{"expect": "ready"},
+				{"send": "PING\r\n", "expect": "PONG"},
+				{"send_hex": "50494e470d0a", "expect": "PONG"},
+			},
+		},
+		{
+			name: "connection closed before the expected text",
+			steps: []map[string]any{
+				{"send": "QUIT\r\n", "expect": "PONG"},
+			},
+			err: `step 0: expected "PONG", got "220 meerkat ready\r\nBYE\r\n"`,
+		},
+		{
+			name: "step timeout",
+			steps: []map[string]any{
+				{"expect": "ready"},
+				{"send": "SLOW\r\n", "expect": "PONG", "timeout": 1},
+			},
+			err: "step 1: expected \"PONG\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := map[string]any{"hostname": host, "port": port}
+			if tt.steps != nil {
+				cfg["steps"] = tt.steps
+			}
+			rawCfg, err := json.Marshal(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var tcpCfg TCPConfig
+			err = json.Unmarshal(rawCfg, &tcpCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if problems := tcpCfg.Valid(context.Background()); len(problems) > 0 {
+				t.Fatalf("config is invalid: %v", problems)
+			}
+
+			var mon TCPMonitor
+			err = mon.Configure(NewMonitorID("test", "tcp", "tcp", "conn"), rawCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mon.cfg.Timeout != defaultTCPTimeout {
+				t.Fatalf("expected the default timeout, got %d", mon.cfg.Timeout)
+			}
+
+			start := time.Now()
+			_, err = mon.Run(context.Background())
+			// The step timeout is shorter than the monitor one
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("expected the run to finish before the monitor timeout, took %s", elapsed)
+			}
+			checkError(t, err, tt.err)
+		})
+	}
+}
+
+func TestTCPStepsValid(t *testing.T) {
+	tests := []struct {
+		name string
+		step TCPStep
+		// Expected problem of the step, empty when it's valid
+		problem string
+	}{
+		{name: "send", step: TCPStep{Send: "PING"}},
+		{name: "expect", step: TCPStep{Expect: "PONG"}},
+		{name: "empty", step: TCPStep{}, problem: "step should send or expect something"},
+		{name: "bad hex", step: TCPStep{SendHex: "zz"}, problem: "invalid hex"},
+		{name: "negative timeout", step: TCPStep{Expect: "PONG", Timeout: -1}, problem: "timeout cannot be less than zero"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := TCPConfig{Hostname: "localhost", Port: "25", Steps: []TCPStep{tt.step}}
+			problems := cfg.Valid(context.Background())
+			got := problems["steps[0]"]
+			if len(tt.problem) == 0 && len(got) > 0 || !strings.Contains(got, tt.problem) {
+				t.Errorf("expected problem %q, got %q", tt.problem, got)
+			}
+		})
+	}
+}
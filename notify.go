@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"text/template"
+	"time"
+
+	"meerkat-v0/db"
+	"meerkat-v0/utils"
+)
+
+const (
+	defaultNotifierRetries = 3
+	defaultNotifierBackoff = 1
+	defaultNotifierTimeout = 10
+)
+
+// Something worth telling people about, like a monitor going down
+type Event struct {
+	// Either monitor or alert
+	Kind      string            `json:"kind"`
+	EntityID  string            `json:"entity_id"`
+	Labels    map[string]string `json:"labels"`
+	Name      string            `json:"name"`
+	From      string            `json:"from"`
+	To        string            `json:"to"`
+	Message   string            `json:"message,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+func NewMonitorEvent(change StateChange) Event {
+	id := utils.ParseEntityID(change.MonitorID)
+
+	var message string
+	if change.Error != nil {
+		message = change.Error.Error()
+	}
+
+	return Event{
+		Kind:      "monitor",
+		EntityID:  change.MonitorID,
+		Labels:    id.Labels,
+		Name:      id.Labels["name"],
+		From:      string(change.From),
+		To:        string(change.To),
+		Message:   message,
+		Timestamp: change.Timestamp,
+	}
+}
+
+type NotifierConfig struct {
+	Name string `json:"name"`
+	// Only webhook is supported for now
+	Type    string            `json:"type"`
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	// text/template rendering the request body from an Event, the event is
+	// sent as JSON when empty
+	Template string `json:"template"`
+	// Defaults to application/json
+	ContentType string `json:"content_type"`
+	// Retries after the first attempt, defaults to 3
+	Retries *int `json:"retries"`
+	// Seconds before the first retry, doubled on every next one. Defaults to 1
+	Backoff int `json:"backoff"`
+	Timeout int `json:"timeout"`
+	// States that trigger the notifier, defaults to down, up, firing and
+	// resolved
+	On []string `json:"on"`
+}
+
+func (c *NotifierConfig) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string)
+
+	err := utils.CheckName(c.Name)
+	if err != nil {
+		problems["name"] = err.Error()
+	}
+
+	if c.Type != "webhook" {
+		problems["type"] = "should be webhook"
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		problems["url"] = fmt.Sprint("invalid url: ", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		problems["url"] = "scheme should be http or https"
+	}
+
+	if len(c.Template) > 0 {
+		_, err := parseNotifierTemplate(c.Template)
+		if err != nil {
+			problems["template"] = err.Error()
+		}
+	}
+
+	if c.Retries != nil && *c.Retries < 0 {
+		problems["retries"] = "cannot be less than zero"
+	}
+
+	if c.Backoff < 0 {
+		problems["backoff"] = "cannot be less than zero"
+	}
+
+	if c.Timeout < 0 {
+		problems["timeout"] = "cannot be less than zero"
+	}
+
+	return problems
+}
+
+func parseNotifierTemplate(text string) (*template.Template, error) {
+	return template.New("notifier").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+}
+
+type Notifier struct {
+	cfg      NotifierConfig
+	template *template.Template
+	client   *http.Client
+	// Resolved from references in the config, redacted from errors
+	secrets Secrets
+}
+
+func NewNotifier(rawCfg []byte, path ...string) (*Notifier, error) {
+	resolved, err := ResolveConfig(rawCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg NotifierConfig
+	err = json.Unmarshal(resolved.JSON, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := cfg.Valid(context.TODO())
+	if valErr := resolved.ValidationError(problems, append(path, cfg.Name)...); valErr != nil {
+		return nil, valErr
+	}
+
+	if len(cfg.Method) == 0 {
+		cfg.Method = http.MethodPost
+	}
+	if len(cfg.ContentType) == 0 {
+		cfg.ContentType = "application/json"
+	}
+	if cfg.Retries == nil {
+		retries := defaultNotifierRetries
+		cfg.Retries = &retries
+	}
+	if cfg.Backoff == 0 {
+		cfg.Backoff = defaultNotifierBackoff
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultNotifierTimeout
+	}
+	if len(cfg.On) == 0 {
+		cfg.On = []string{string(StateDown), string(StateUp), string(AlertFiring), string(AlertResolved)}
+	}
+
+	var tmpl *template.Template
+	if len(cfg.Template) > 0 {
+		tmpl, err = parseNotifierTemplate(cfg.Template)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Notifier{
+		cfg:      cfg,
+		template: tmpl,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.Timeout) * time.Second,
+		},
+		secrets: resolved.Secrets,
+	}, nil
+}
+
+func (n *Notifier) Wants(event Event) bool {
+	return slices.Contains(n.cfg.On, event.To)
+}
+
+func (n *Notifier) body(event Event) ([]byte, error) {
+	if n.template == nil {
+		return json.Marshal(event)
+	}
+
+	var b bytes.Buffer
+	err := n.template.Execute(&b, event)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Sends the event once, returns the response status code if there was one
+func (n *Notifier) Send(ctx context.Context, event Event) (int, error) {
+	body, err := n.body(event)
+	if err != nil {
+		return 0, fmt.Errorf("rendering template: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, n.cfg.Method, n.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", n.cfg.ContentType)
+	for k, v := range n.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxHTTPBodySize))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+type instanceNotifiers struct {
+	notifiers []*Notifier
+	// Service ID to the notifiers of the service
+	services map[string][]*Notifier
+}
+
+type NotificationService struct {
+	logger       *utils.Logger
+	deliveryRepo DeliveryRepo
+
+	mu sync.RWMutex
+	// Instance name to its notifiers
+	instances map[string]*instanceNotifiers
+
+	wg sync.WaitGroup
+	// Waits out the backoff between attempts
+	after func(time.Duration) <-chan time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewNotificationService(deliveryRepo DeliveryRepo) *NotificationService {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &NotificationService{
+		logger:       utils.DefaultLogger(),
+		deliveryRepo: deliveryRepo,
+		instances:    make(map[string]*instanceNotifiers),
+		after:        time.After,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+// Validates and builds the notifiers of an instance without using them yet,
+// service notifiers are keyed by the service name
+func (s *NotificationService) PrepareInstance(instance string, rawNotifiers []json.RawMessage, rawServiceNotifiers map[string][]json.RawMessage) (*instanceNotifiers, error) {
+	var errs []error
+	notifiers, err := buildNotifiers(rawNotifiers, instance, "notifiers")
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	services := make(map[string][]*Notifier, len(rawServiceNotifiers))
+	for service, raw := range rawServiceNotifiers {
+		serviceNotifiers, err := buildNotifiers(raw, instance, service, "notifiers")
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		services[NewServiceID(instance, service).Canonical()] = serviceNotifiers
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return &instanceNotifiers{
+		notifiers: notifiers,
+		services:  services,
+	}, nil
+}
+
+// Replaces the notifiers of the instance, deliveries already in flight finish
+// with the old ones
+func (s *NotificationService) ApplyInstance(instance string, notifiers *instanceNotifiers) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instances[instance] = notifiers
+}
+
+func (s *NotificationService) RemoveInstance(instance string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.instances, instance)
+}
+
+func buildNotifiers(rawNotifiers []json.RawMessage, path ...string) ([]*Notifier, error) {
+	var errs []error
+	notifiers := make([]*Notifier, 0, len(rawNotifiers))
+	names := make(map[string]struct{}, len(rawNotifiers))
+	for i, raw := range rawNotifiers {
+		n, err := NewNotifier(raw, path...)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if _, exists := names[n.cfg.Name]; exists {
+			err := NewDuplicateFoundError(path...)
+			err.SetIndex(i)
+			errs = append(errs, err)
+			continue
+		}
+		names[n.cfg.Name] = struct{}{}
+
+		notifiers = append(notifiers, n)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return notifiers, nil
+}
+
+func (s *NotificationService) notifiersFor(labels map[string]string) []*Notifier {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	inst, ok := s.instances[labels["instance"]]
+	if !ok {
+		return nil
+	}
+
+	serviceID := NewServiceID(labels["instance"], labels["service"]).Canonical()
+	notifiers := slices.Clone(inst.notifiers)
+	return append(notifiers, inst.services[serviceID]...)
+}
+
+// Delivers the event in the background to every notifier of the entity's
+// instance and service that wants it
+func (s *NotificationService) Notify(event Event) {
+	for _, n := range s.notifiersFor(event.Labels) {
+		if !n.Wants(event) {
+			continue
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.deliver(n, event)
+		}()
+	}
+}
+
+func (s *NotificationService) deliver(n *Notifier, event Event) {
+	retries := *n.cfg.Retries
+	backoff := time.Duration(n.cfg.Backoff) * time.Second
+
+	for attempt := 1; attempt <= retries+1; attempt++ {
+		status, err := n.Send(s.ctx, event)
+		err = n.secrets.RedactError(err)
+
+		logErr := s.deliveryRepo.InsertDelivery(s.ctx, Delivery{
+			EntityID:   event.EntityID,
+			Notifier:   n.cfg.Name,
+			Timestamp:  time.Now(),
+			Event:      event.To,
+			Attempt:    attempt,
+			StatusCode: status,
+			Error:      err,
+		})
+		if logErr != nil {
+			s.logger.Warn("Could not log notification delivery", "notifier", n.cfg.Name, "err", logErr)
+		}
+
+		if err == nil {
+			return
+		}
+		s.logger.Warn("Notification delivery failed", "notifier", n.cfg.Name, "attempt", attempt, "err", err)
+
+		if attempt > retries {
+			return
+		}
+
+		select {
+		case <-s.after(backoff):
+			backoff *= 2
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// Turns monitor state changes into notifications. Monitors coming up for the
+// first time aren't worth a notification, but ones that are down from the
+// start are
+func (s *NotificationService) Emit(ctx context.Context, change StateChange) error {
+	if change.From == StatePending && change.To == StateUp {
+		return nil
+	}
+	s.Notify(NewMonitorEvent(change))
+	return nil
+}
+
+func (s *NotificationService) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	// Let pending deliveries finish until the deadline
+	select {
+	case <-ctx.Done():
+		s.cancel()
+		return ctx.Err()
+	case <-done:
+		s.cancel()
+		return nil
+	}
+}
+
+type Delivery struct {
+	EntityID   string
+	Notifier   string
+	Timestamp  time.Time
+	Event      string
+	Attempt    int
+	StatusCode int
+	Error      error
+}
+
+type DeliveryRepo interface {
+	InsertDelivery(context.Context, Delivery) error
+}
+
+type SqliteDeliveryRepo struct {
+	readDB     *db.Queries
+	writeDB    *db.Queries
+	entityRepo EntityRepo
+}
+
+func NewSqliteDeliveryRepo(readDB *db.Queries, writeDB *db.Queries, entityRepo EntityRepo) *SqliteDeliveryRepo {
+	return &SqliteDeliveryRepo{
+		readDB:     readDB,
+		writeDB:    writeDB,
+		entityRepo: entityRepo,
+	}
+}
+
+func (r *SqliteDeliveryRepo) InsertDelivery(ctx context.Context, delivery Delivery) error {
+	eId, err := r.entityRepo.GetID(ctx, delivery.EntityID)
+	if err != nil {
+		return err
+	}
+
+	var statusCode sql.NullInt64
+	if delivery.StatusCode != 0 {
+		statusCode.Int64 = int64(delivery.StatusCode)
+		statusCode.Valid = true
+	}
+
+	var error sql.NullString
+	if delivery.Error != nil {
+		error.String = delivery.Error.Error()
+		error.Valid = true
+	}
+
+	_, err = r.writeDB.InsertDelivery(ctx, db.InsertDeliveryParams{
+		EntityID:   eId,
+		Notifier:   delivery.Notifier,
+		Ts:         delivery.Timestamp.UTC(),
+		Event:      delivery.Event,
+		Attempt:    int64(delivery.Attempt),
+		Successful: delivery.Error == nil,
+		StatusCode: statusCode,
+		Error:      error,
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type MultiStateChangeSink []StateChangeSink
+
+func (s MultiStateChangeSink) Emit(ctx context.Context, change StateChange) error {
+	var errs []error
+	for _, sink := range s {
+		err := sink.Emit(ctx, change)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"meerkat-v0/db"
+)
+
+var testMonitorID = NewMonitorID("home", "web", "http", "site").Canonical()
+
+// Answers with the next status of the list, the last one repeats
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []receivedRequest
+}
+
+type receivedRequest struct {
+	contentType string
+	body        string
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, receivedRequest{req.Header.Get("Content-Type"), string(body)})
+	status := r.statuses[min(len(r.requests), len(r.statuses))-1]
+	w.WriteHeader(status)
+}
+
+func (r *webhookReceiver) received() []receivedRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.requests)
+}
+
+type deliveryRow struct {
+	attempt    int
+	successful bool
+	statusCode sql.NullInt64
+	err        sql.NullString
+}
+
+// Returns a delivery repo on a fresh database that knows the test monitor,
+// and the connection to read the delivery log from
+func newTestDeliveryRepo(t *testing.T) (*SqliteDeliveryRepo, *sql.DB) {
+	t.Helper()
+	ctx := context.Background()
+	dbRead, dbWrite, err := openObservations(ctx, filepath.Join(t.TempDir(), "observations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dbRead.Close()
+		dbWrite.Close()
+	})
+
+	_, err = dbWrite.ExecContext(ctx, "insert into entities (canonical_id) values (?)", testMonitorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readDB, writeDB := db.New(dbRead), db.New(dbWrite)
+	return NewSqliteDeliveryRepo(readDB, writeDB, NewSqliteEntityRepo(readDB, dbWrite)), dbRead
+}
+
+func listDeliveries(t *testing.T, conn *sql.DB) []deliveryRow {
+	t.Helper()
+	rows, err := conn.Query("select attempt, successful, status_code, error from notification_deliveries order by id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var deliveries []deliveryRow
+	for rows.Next() {
+		var row deliveryRow
+		err := rows.Scan(&row.attempt, &row.successful, &row.statusCode, &row.err)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deliveries = append(deliveries, row)
+	}
+	return deliveries
+}
+
+// Starts a notification service with a single instance notifier. Backoffs
+// are recorded instead of waited out
+func newTestNotificationService(t *testing.T, repo DeliveryRepo, cfg map[string]any) (*NotificationService, *[]time.Duration) {
+	t.Helper()
+	rawCfg, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewNotificationService(repo)
+	var mu sync.Mutex
+	var backoffs []time.Duration
+	s.after = func(d time.Duration) <-chan time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		backoffs = append(backoffs, d)
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+
+	notifiers, err := s.PrepareInstance("home", []json.RawMessage{rawCfg}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ApplyInstance("home", notifiers)
+	return s, &backoffs
+}
+
+func stopNotifications(t *testing.T, s *NotificationService) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.Stop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotifierRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		retries  int
+		backoff  int
+		// Expected status code of every attempt
+		attempts []int64
+		backoffs []time.Duration
+	}{
+		{
+			name:     "first attempt succeeds",
+			statuses: []int{http.StatusOK},
+			retries:  3,
+			backoff:  1,
+			attempts: []int64{200},
+		},
+		{
+			name:     "succeeds after retries",
+			statuses: []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusNoContent},
+			retries:  3,
+			backoff:  2,
+			attempts: []int64{500, 502, 204},
+			backoffs: []time.Duration{2 * time.Second, 4 * time.Second},
+		},
+		{
+			name:     "gives up after the last retry",
+			statuses: []int{http.StatusServiceUnavailable},
+			retries:  2,
+			backoff:  1,
+			attempts: []int64{503, 503, 503},
+			backoffs: []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:     "no retries",
+			statuses: []int{http.StatusServiceUnavailable},
+			retries:  0,
+			backoff:  1,
+			attempts: []int64{503},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := &webhookReceiver{statuses: tt.statuses}
+			server := httptest.NewServer(receiver)
+			defer server.Close()
+
+			repo, conn := newTestDeliveryRepo(t)
+			s, backoffs := newTestNotificationService(t, repo, map[string]any{
+				"name":    "hook",
+				"type":    "webhook",
+				"url":     server.URL,
+				"retries": tt.retries,
+				"backoff": tt.backoff,
+			})
+			err := s.Emit(context.Background(), StateChange{
+				MonitorID: testMonitorID,
+				Timestamp: time.Now(),
+				From:      StateUp,
+				To:        StateDown,
+				Error:     errors.New("connection refused"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stopNotifications(t, s)
+
+			if got := len(receiver.received()); got != len(tt.attempts) {
+				t.Fatalf("expected %d requests, got %d", len(tt.attempts), got)
+			}
+			if !slices.Equal(*backoffs, tt.backoffs) {
+				t.Errorf("expected backoffs %v, got %v", tt.backoffs, *backoffs)
+			}
+
+			deliveries := listDeliveries(t, conn)
+			if len(deliveries) != len(tt.attempts) {
+				t.Fatalf("expected %d delivery rows, got %d", len(tt.attempts), len(deliveries))
+			}
+			for i, delivery := range deliveries {
+				successful := tt.attempts[i] < 300
+				if delivery.attempt != i+1 {
+					t.Errorf("row %d: expected attempt %d, got %d", i, i+1, delivery.attempt)
+				}
+				if delivery.successful != successful {
+					t.Errorf("row %d: expected successful %v, got %v", i, successful, delivery.successful)
+				}
+				if delivery.statusCode.Int64 != tt.attempts[i] {
+					t.Errorf("row %d: expected status %d, got %d", i, tt.attempts[i], delivery.statusCode.Int64)
+				}
+				if delivery.err.Valid == successful {
+					t.Errorf("row %d: expected an error only on failed attempts, got %q", i, delivery.err.String)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifierBody(t *testing.T) {
+	change := StateChange{
+		MonitorID: testMonitorID,
+		Timestamp: time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC),
+		From:      StateUp,
+		To:        StateDown,
+		Error:     errors.New("timeout"),
+	}
+
+	tests := []struct {
+		name        string
+		cfg         map[string]any
+		contentType string
+		body        string
+	}{
+		{
+			name:        "event as JSON",
+			cfg:         map[string]any{},
+			contentType: "application/json",
+			body:        `{"kind":"monitor","entity_id":"` + testMonitorID + `","labels":{"instance":"home","name":"site","service":"web","type":"http"},"name":"site","from":"up","to":"down","message":"timeout","timestamp":"2026-01-01T10:00:00Z"}`,
+		},
+		{
+			name:        "JSON template",
+			cfg:         map[string]any{"template": `{"text": {{ json (printf "%s is %s" .Name .To) }}}`},
+			contentType: "application/json",
+			body:        `{"text": "site is down"}`,
+		},
+		{
+			name:        "text template",
+			cfg:         map[string]any{"template": "{{ .Labels.service }}/{{ .Name }}: {{ .Message }}", "content_type": "text/plain; charset=utf-8"},
+			contentType: "text/plain; charset=utf-8",
+			body:        "web/site: timeout",
+		},
+		{
+			name:        "header overrides the content type",
+			cfg:         map[string]any{"template": "{{ .To }}", "headers": map[string]string{"Content-Type": "text/plain"}},
+			contentType: "text/plain",
+			body:        "down",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := &webhookReceiver{statuses: []int{http.StatusOK}}
+			server := httptest.NewServer(receiver)
+			defer server.Close()
+
+			cfg := map[string]any{"name": "hook", "type": "webhook", "url": server.URL}
+			for k, v := range tt.cfg {
+				cfg[k] = v
+			}
+			repo, _ := newTestDeliveryRepo(t)
+			s, _ := newTestNotificationService(t, repo, cfg)
+			err := s.Emit(context.Background(), change)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stopNotifications(t, s)
+
+			requests := receiver.received()
+			if len(requests) != 1 {
+				t.Fatalf("expected 1 request, got %d", len(requests))
+			}
+			if requests[0].contentType != tt.contentType {
+				t.Errorf("expected content type %q, got %q", tt.contentType, requests[0].contentType)
+			}
+			if requests[0].body != tt.body {
+				t.Errorf("expected body\n%s\ngot\n%s", tt.body, requests[0].body)
+			}
+		})
+	}
+}
+
+func TestNotificationServiceSkipsOnlyFirstUp(t *testing.T) {
+	tests := []struct {
+		from   MonitorState
+		to     MonitorState
+		notify bool
+	}{
+		{StatePending, StateUp, false},
+		{StatePending, StateDown, true},
+		{StateUp, StateDown, true},
+		{StateDown, StateUp, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.from)+"-"+string(tt.to), func(t *testing.T) {
+			receiver := &webhookReceiver{statuses: []int{http.StatusOK}}
+			server := httptest.NewServer(receiver)
+			defer server.Close()
+
+			repo, _ := newTestDeliveryRepo(t)
+			s, _ := newTestNotificationService(t, repo, map[string]any{"name": "hook", "type": "webhook", "url": server.URL})
+			err := s.Emit(context.Background(), StateChange{
+				MonitorID: testMonitorID,
+				Timestamp: time.Now(),
+				From:      tt.from,
+				To:        tt.to,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stopNotifications(t, s)
+
+			if notified := len(receiver.received()) > 0; notified != tt.notify {
+				t.Errorf("expected notified %v, got %v", tt.notify, notified)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Returns the text payload or the decoded hex one, only one can be set
+func DecodePayload(text string, hexText string) ([]byte, error) {
+	if len(text) > 0 && len(hexText) > 0 {
+		return nil, errors.New("only one of text and hex payload can be set")
+	}
+	if len(hexText) > 0 {
+		b, err := hex.DecodeString(hexText)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex: %w", err)
+		}
+		return b, nil
+	}
+	return []byte(text), nil
+}
+
+// Shortens received data quoted in errors
+func truncate(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[:n]
+	}
+	return b
+}
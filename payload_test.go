@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecodePayload(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		hex  string
+		want []byte
+		err  string
+	}{
+		{name: "empty", want: []byte{}},
+		{name: "text", text: "PING\r\n", want: []byte("PING\r\n")},
+		{name: "hex", hex: "00ff0d0a", want: []byte{0x00, 0xff, '\r', '\n'}},
+		{name: "upper case hex", hex: "DEADBEEF", want: []byte{0xde, 0xad, 0xbe, 0xef}},
+		{name: "both", text: "PING", hex: "00", err: "only one of text and hex payload can be set"},
+		{name: "odd hex", hex: "abc", err: "invalid hex: encoding/hex: odd length hex string"},
+		{name: "bad hex", hex: "zz", err: "invalid hex"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodePayload(tt.text, tt.hex)
+			if checkError(t, err, tt.err) {
+				return
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		n    int
+		want []byte
+	}{
+		{name: "shorter", b: []byte("PONG"), n: 8, want: []byte("PONG")},
+		{name: "exact", b: []byte("PONG"), n: 4, want: []byte("PONG")},
+		{name: "longer", b: []byte("PONG PONG"), n: 4, want: []byte("PONG")},
+		{name: "nil", n: 4, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncate(tt.b, tt.n)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
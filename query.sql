@@ -6,17 +6,116 @@ select id from entities
 select canonical_id from entities
  where id = ?;
 
+-- name: ListEntities :many
+select * from entities
+ order by id;
+
+-- name: DeleteEntityConfigs :exec
+delete from entity_configs
+ where kind = ?;
+
+-- name: InsertEntityConfig :exec
+insert into entity_configs(entity_id, kind, config)
+values (?, ?, ?);
+
+-- name: ListEntityConfigs :many
+select e.canonical_id, c.config
+  from entity_configs c
+  join entities e on e.id = c.entity_id
+ where c.kind = ?
+ order by e.id;
+
+-- name: ListHeartbeatsPage :many
+select * from heartbeat
+ where entity_id = sqlc.arg(entity_id)
+   and ts >= sqlc.arg(from_ts)
+   and ts < sqlc.arg(to_ts)
+   and id > sqlc.arg(after_id)
+ order by id
+ limit sqlc.arg(page_size);
+
 -- name: InsertEntity :one
 insert into entities(canonical_id)
 values (?)
 returning id;
 
 -- name: InsertHeartbeat :one
-insert into heartbeat(entity_id, ts, successful, error)
-values (?, ?, ?, ?)
+insert into heartbeat(entity_id, ts, successful, error, latency_us, dns_us, connect_us, tls_us, first_byte_us)
+values (?, ?, ?, ?, ?, ?, ?, ?, ?)
 returning id;
 
+-- name: ListHeartbeats :many
+select * from heartbeat
+ where entity_id = sqlc.arg(entity_id)
+   and ts >= sqlc.arg(from_ts)
+   and ts < sqlc.arg(to_ts)
+ order by ts;
+
+-- name: CountHeartbeats :one
+select count(*) as total, cast(coalesce(sum(successful), 0) as integer) as successful from heartbeat
+ where entity_id = sqlc.arg(entity_id)
+   and ts >= sqlc.arg(from_ts)
+   and ts < sqlc.arg(to_ts);
+
+-- name: CountHeartbeatsPerQuarterHour :many
+select cast(unixepoch(ts) / 900 as integer) as quarter_hour, count(*) as total, cast(coalesce(sum(successful), 0) as integer) as successful from heartbeat
+ where entity_id = sqlc.arg(entity_id)
+   and ts >= sqlc.arg(from_ts)
+   and ts < sqlc.arg(to_ts)
+ group by quarter_hour
+ order by quarter_hour;
+
 -- name: InsertMetrics :one
 insert into metrics(entity_id, ts, name, type, value, labels)
 values (?, ?, ?, ?, ?, ?)
 returning id;
+
+-- name: InsertStateChange :one
+insert into state_changes(entity_id, ts, from_state, to_state, error)
+values (?, ?, ?, ?, ?)
+returning id;
+
+-- name: GetLatestStateChange :one
+select * from state_changes
+ where entity_id = ?
+ order by ts desc
+ limit 1;
+
+-- name: ListStateChanges :many
+select * from state_changes
+ where entity_id = sqlc.arg(entity_id)
+   and ts >= sqlc.arg(from_ts)
+   and ts < sqlc.arg(to_ts)
+ order by ts;
+
+-- name: InsertDelivery :one
+insert into notification_deliveries(entity_id, notifier, ts, event, attempt, successful, status_code, error)
+values (?, ?, ?, ?, ?, ?, ?, ?)
+returning id;
+
+-- name: ListMetricSamples :many
+select m.id, m.entity_id, e.canonical_id, m.ts, m.name, m.type, m.value, m.labels
+  from metrics m
+  join entities e on e.id = m.entity_id
+ where m.name = sqlc.arg(name)
+   and m.ts >= sqlc.arg(from_ts)
+   and m.ts < sqlc.arg(to_ts)
+ order by m.ts;
+
+-- name: ListMetricSamplesPage :many
+select m.id, m.entity_id, e.canonical_id, m.ts, m.name, m.type, m.value, m.labels
+  from metrics m
+  join entities e on e.id = m.entity_id
+ where m.name = sqlc.arg(name)
+   and m.ts >= sqlc.arg(from_ts)
+   and m.ts < sqlc.arg(to_ts)
+   and m.id > sqlc.arg(after_id)
+   and not exists (
+     select 1 from json_each(sqlc.arg(selector)) s
+      where case
+              when m.labels ->> s.key is not null then m.labels ->> s.key != s.value
+              else s.key = 'kind' or instr('|' || e.canonical_id || '|', '|' || s.key || '=' || s.value || '|') = 0
+            end
+   )
+ order by m.id
+ limit sqlc.arg(page_size);
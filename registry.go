@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"meerkat-v0/utils"
+)
+
+type EntityFactory func() Entity
+
+type EntityType struct {
+	Name        string
+	Description string
+	// Returns an empty config for the type, used to validate the raw config
+	// before the entity is configured
+	Config func() Validator
+	New    EntityFactory
+}
+
+type Registry struct {
+	Kind string
+
+	mu    sync.RWMutex
+	types map[string]EntityType
+}
+
+func NewRegistry(kind string) *Registry {
+	return &Registry{
+		Kind:  kind,
+		types: make(map[string]EntityType),
+	}
+}
+
+func (r *Registry) Register(t EntityType) error {
+	if len(t.Name) == 0 {
+		return fmt.Errorf("%s type has no name", r.Kind)
+	}
+	if t.New == nil {
+		return fmt.Errorf("%s type '%s' has no factory", r.Kind, t.Name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.types[t.Name]; exists {
+		return fmt.Errorf("%s type '%s' is already registered", r.Kind, t.Name)
+	}
+	r.types[t.Name] = t
+	return nil
+}
+
+func (r *Registry) MustRegister(t EntityType) {
+	if err := r.Register(t); err != nil {
+		panic(err)
+	}
+}
+
+func (r *Registry) Lookup(name string) (EntityType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t, ok := r.types[name]
+	return t, ok
+}
+
+// Returns registered types sorted by name
+func (r *Registry) Types() []EntityType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	types := make([]EntityType, 0, len(r.types))
+	for _, t := range r.types {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].Name < types[j].Name
+	})
+	return types
+}
+
+func (r *Registry) typeNames() string {
+	types := r.Types()
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = t.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// Validates the type specific config and creates a configured entity
+func (r *Registry) Build(id utils.EntityID, rawCfg []byte) (Entity, error) {
+	t, ok := r.Lookup(id.Labels["type"])
+	if !ok {
+		return nil, NewValidationError(map[string]string{
+			"type": fmt.Sprintf("unknown %s type '%s', registered types: %s", r.Kind, id.Labels["type"], r.typeNames()),
+		}, id.Labels["service"], id.Labels["name"])
+	}
+
+	if t.Config != nil {
+		cfg := t.Config()
+		err := json.Unmarshal(rawCfg, cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		problems := cfg.Valid(context.TODO())
+		if len(problems) > 0 {
+			return nil, NewValidationError(problems, id.Labels["service"], id.Labels["name"])
+		}
+	}
+
+	entity := t.New()
+	err := entity.Configure(id, rawCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+	"time"
+)
+
+const configWatchInterval = 2 * time.Second
+
+// Everything built from a config, ready to replace what's running
+type ConfigPlan struct {
+	// Instance name to what's built from its config
+	Instances map[string]*InstancePlan
+	// Entity service name to the plan of its entities
+	Entities map[string]*EntityPlan
+}
+
+type InstancePlan struct {
+	Config InstanceConfig
+
+	notifiers   *instanceNotifiers
+	alerts      []*AlertRule
+	maintenance []MaintenanceWindow
+	statusPage  *StatusPageConfig
+}
+
+// Validates the config and compares it with what's running, without
+// starting or stopping anything. Every problem found is returned together
+// as ConfigErrors
+func (m *Meerkat) Plan(set *ConfigSet) (*ConfigPlan, error) {
+	var errs []error
+	plan := &ConfigPlan{
+		Instances: make(map[string]*InstancePlan, len(set.Instances)),
+		Entities:  make(map[string]*EntityPlan, len(m.services)),
+	}
+
+	// Entity service name to the services with its entities, of every instance
+	services := make(map[string][]ServiceEntities, len(m.services))
+	for _, cfg := range set.Instances {
+		if _, exists := plan.Instances[cfg.Name]; exists {
+			errs = append(errs, NewDuplicateFoundError(cfg.Name))
+			continue
+		}
+
+		cfg, err := ExpandInstance(cfg, slices.Sorted(maps.Keys(m.services)))
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		instPlan, instServices, err := m.planInstance(cfg)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		plan.Instances[cfg.Name] = instPlan
+		for name, entities := range instServices {
+			services[name] = append(services[name], entities...)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(m.services)) {
+		entPlan, err := m.services[name].DiffEntities(services[name])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		plan.Entities[name] = entPlan
+	}
+
+	if len(errs) > 0 {
+		return nil, NewConfigErrors(set, errs...)
+	}
+	return plan, nil
+}
+
+// Builds everything of the instance but its entities, which are returned by
+// entity service name to be diffed together with the other instances. The
+// entities are returned even when the instance has problems, so theirs are
+// found too
+func (m *Meerkat) planInstance(cfg InstanceConfig) (*InstancePlan, map[string][]ServiceEntities, error) {
+	var errs []error
+	problems := cfg.Valid(context.TODO())
+	if len(problems) > 0 {
+		errs = append(errs, NewValidationError(problems, cfg.Name))
+	}
+
+	plan := &InstancePlan{Config: cfg}
+
+	servCfgs := make([]map[string]json.RawMessage, 0, len(cfg.Services))
+	serviceNotifiers := make(map[string][]json.RawMessage)
+	serviceNames := make([]string, 0, len(cfg.Services))
+	for i, service := range cfg.Services {
+		var servCfg map[string]json.RawMessage
+		err := json.Unmarshal(service, &servCfg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s.services[%d]: %w", cfg.Name, i, err))
+			continue
+		}
+
+		var serviceCfg ServiceConfig
+		err = json.Unmarshal(service, &serviceCfg)
+		if err != nil || len(serviceCfg.Name) == 0 {
+			err := NewNoNameError(cfg.Name, "services")
+			err.SetIndex(i)
+			errs = append(errs, err)
+			continue
+		}
+
+		if _, exists := serviceNotifiers[serviceCfg.Name]; exists {
+			err := NewDuplicateFoundError(cfg.Name, "services")
+			err.SetIndex(i)
+			errs = append(errs, err)
+			continue
+		}
+
+		servCfgs = append(servCfgs, servCfg)
+		serviceNotifiers[serviceCfg.Name] = serviceCfg.Notifiers
+		serviceNames = append(serviceNames, serviceCfg.Name)
+	}
+
+	var err error
+	plan.notifiers, err = m.notifications.PrepareInstance(cfg.Name, cfg.Notifiers, serviceNotifiers)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	plan.maintenance, err = m.reports.PrepareInstance(cfg.Name, cfg.Maintenance)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	plan.statusPage, err = m.statusPages.PrepareInstance(cfg.Name, cfg.StatusPage, serviceNames)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	plan.alerts, err = m.alerts.PrepareInstance(cfg.Name, cfg.Alerts)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	services := make(map[string][]ServiceEntities, len(m.services))
+	for name := range m.services {
+		for i, servCfg := range servCfgs {
+			rawConfigs, exists := servCfg[name]
+			if !exists {
+				continue
+			}
+
+			var configs []json.RawMessage
+			err = json.Unmarshal(rawConfigs, &configs)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s.%s.%s: %w", cfg.Name, serviceNames[i], name, err))
+				continue
+			}
+
+			services[name] = append(services[name], ServiceEntities{
+				ID:      NewServiceID(cfg.Name, serviceNames[i]),
+				Configs: configs,
+			})
+		}
+	}
+
+	return plan, services, errors.Join(errs...)
+}
+
+// Loads the entities saved by the last applied config, see
+// EntityService.LoadSaved
+func (m *Meerkat) LoadSaved(ctx context.Context) error {
+	for _, service := range m.services {
+		err := service.LoadSaved(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Meerkat) apply(ctx context.Context, plan *ConfigPlan) error {
+	// The only step that can fail, done before anything is replaced
+	configs := make(map[string]map[string][]byte, len(plan.Entities))
+	for name, entPlan := range plan.Entities {
+		configs[name] = entPlan.Configs()
+	}
+	err := m.entityRepo.SaveEntityConfigs(ctx, configs)
+	if err != nil {
+		return err
+	}
+
+	for name := range m.instances {
+		if _, ok := plan.Instances[name]; ok {
+			continue
+		}
+		m.alerts.RemoveInstance(name)
+		m.statusPages.RemoveInstance(name)
+		m.reports.RemoveInstance(name)
+		m.notifications.RemoveInstance(name)
+	}
+
+	// Notifiers go first so state changes of new entities reach them
+	for name, inst := range plan.Instances {
+		m.notifications.ApplyInstance(name, inst.notifiers)
+		m.reports.ApplyInstance(name, inst.maintenance)
+		m.statusPages.ApplyInstance(name, inst.statusPage)
+		m.alerts.ApplyInstance(name, inst.alerts)
+	}
+
+	for name, entPlan := range plan.Entities {
+		m.services[name].ApplyEntities(entPlan)
+
+		diff := entPlan.Diff
+		if len(diff.Add) == 0 && len(diff.Update) == 0 && len(diff.Delete) == 0 {
+			continue
+		}
+		m.logger.Info("Entities loaded", "service", name,
+			"added", len(diff.Add), "updated", len(diff.Update),
+			"deleted", len(diff.Delete), "unchanged", len(diff.Unchanged))
+	}
+
+	m.instances = make(map[string]InstanceConfig, len(plan.Instances))
+	for name, inst := range plan.Instances {
+		m.instances[name] = inst.Config
+	}
+	return nil
+}
+
+// Polls the config files and signals when the modification time or size of
+// any of them changes, one is deleted or created, or the list of files does.
+// Files added to a directory change its modification time. Editors often
+// write in several steps, polling spreads them out enough to reload once
+func watchConfig(ctx context.Context, paths func() []string, interval time.Duration) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+
+	// Missing files are nil, so deleting one is a change like any other
+	stat := func() (map[string]os.FileInfo, error) {
+		infos := make(map[string]os.FileInfo)
+		for _, path := range paths() {
+			info, err := os.Stat(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				info = nil
+			} else if err != nil {
+				return nil, err
+			}
+			infos[path] = info
+		}
+		return infos, nil
+	}
+
+	go func() {
+		last, _ := stat()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				infos, err := stat()
+				if err != nil {
+					continue
+				}
+				if last != nil && sameFiles(last, infos) {
+					continue
+				}
+				last = infos
+
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return changed
+}
+
+func sameFiles(a, b map[string]os.FileInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, info := range a {
+		other, ok := b[path]
+		if !ok || (info == nil) != (other == nil) {
+			return false
+		}
+		if info != nil && (!info.ModTime().Equal(other.ModTime()) || info.Size() != other.Size()) {
+			return false
+		}
+	}
+	return true
+}
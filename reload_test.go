@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfigMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "home.json")
+	other := filepath.Join(dir, "other.json")
+	for _, p := range []string{path, other} {
+		err := os.WriteFile(p, []byte(`{"name": "home"}`), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := watchConfig(ctx, func() []string { return []string{path, other} }, 10*time.Millisecond)
+
+	expectChange := func(what string) {
+		t.Helper()
+		select {
+		case <-changed:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected a change after the file was %s", what)
+		}
+	}
+	expectNoChange := func() {
+		t.Helper()
+		select {
+		case <-changed:
+			t.Fatal("expected no change")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	expectNoChange()
+
+	err := os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChange("deleted")
+	// Later polls keep working while it's missing
+	expectNoChange()
+
+	err = os.WriteFile(other, []byte(`{"name": "other", "services": []}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChange("written")
+
+	err = os.WriteFile(path, []byte(`{"name": "home"}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChange("created again")
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+const defaultReportWindow = "30d"
+
+type MaintenanceConfig struct {
+	Name string `json:"name"`
+	// RFC 3339 timestamps, heartbeats in [start, end) are left out of reports
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Names of the services under maintenance, the whole instance when empty
+	Services []string `json:"services"`
+}
+
+func (c *MaintenanceConfig) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string)
+
+	err := utils.CheckName(c.Name)
+	if err != nil {
+		problems["name"] = err.Error()
+	}
+
+	start, err := time.Parse(time.RFC3339, c.Start)
+	if err != nil {
+		problems["start"] = fmt.Sprint("invalid timestamp: ", err)
+	}
+
+	end, err := time.Parse(time.RFC3339, c.End)
+	if err != nil {
+		problems["end"] = fmt.Sprint("invalid timestamp: ", err)
+	} else if _, ok := problems["start"]; !ok && !end.After(start) {
+		problems["end"] = "should be after start"
+	}
+
+	for i, service := range c.Services {
+		if err := utils.CheckName(service); err != nil {
+			problems[fmt.Sprintf("services[%d]", i)] = err.Error()
+		}
+	}
+
+	return problems
+}
+
+type MaintenanceWindow struct {
+	Name     string
+	Instance string
+	Services []string
+	Start    time.Time
+	End      time.Time
+}
+
+func (w MaintenanceWindow) Covers(id utils.EntityID) bool {
+	if id.Labels["instance"] != w.Instance {
+		return false
+	}
+	return len(w.Services) == 0 || slices.Contains(w.Services, id.Labels["service"])
+}
+
+// Splits [from, to) into the ranges that are not covered by any window
+func excludeWindows(from time.Time, to time.Time, windows []MaintenanceWindow) [][2]time.Time {
+	windows = slices.Clone(windows)
+	slices.SortFunc(windows, func(a, b MaintenanceWindow) int {
+		return a.Start.Compare(b.Start)
+	})
+
+	var ranges [][2]time.Time
+	cursor := from
+	for _, w := range windows {
+		if !w.End.After(cursor) || !w.Start.Before(to) {
+			continue
+		}
+		if w.Start.After(cursor) {
+			ranges = append(ranges, [2]time.Time{cursor, w.Start})
+		}
+		cursor = w.End
+	}
+	if cursor.Before(to) {
+		ranges = append(ranges, [2]time.Time{cursor, to})
+	}
+	return ranges
+}
+
+// Parses windows like "24h", "7d", "month" for the current calendar month or
+// "2006-01" for a specific one, and returns the range ending at now
+func ParseReportWindow(window string, now time.Time) (time.Time, time.Time, error) {
+	if window == "month" {
+		from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		return from, now, nil
+	}
+
+	if month, err := time.ParseInLocation("2006-01", window, now.Location()); err == nil {
+		return month, month.AddDate(0, 1, 0), nil
+	}
+
+	if days, ok := strings.CutSuffix(window, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid window '%s'", window)
+		}
+		return now.AddDate(0, 0, -n), now, nil
+	}
+
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid window '%s', should look like 24h, 7d, month or 2006-01", window)
+	}
+	return now.Add(-d), now, nil
+}
+
+type Uptime struct {
+	Total      int64 `json:"total"`
+	Successful int64 `json:"successful"`
+	// Null when there are no heartbeats
+	Percent *float64 `json:"uptime_percent"`
+}
+
+func (u *Uptime) add(other Uptime) {
+	u.Total += other.Total
+	u.Successful += other.Successful
+	u.computePercent()
+}
+
+func (u *Uptime) computePercent() {
+	if u.Total == 0 {
+		u.Percent = nil
+		return
+	}
+	percent := float64(u.Successful) / float64(u.Total) * 100
+	u.Percent = &percent
+}
+
+type MonitorUptime struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Uptime
+}
+
+type ServiceUptime struct {
+	Name string `json:"name"`
+	Uptime
+	Monitors []*MonitorUptime `json:"monitors"`
+}
+
+type InstanceUptime struct {
+	Name string `json:"name"`
+	Uptime
+	Services []*ServiceUptime `json:"services"`
+}
+
+// Services and instances are rolled up from the heartbeats of their
+// monitors, so a monitor that checks more often weighs more
+type UptimeReport struct {
+	From      time.Time         `json:"from"`
+	To        time.Time         `json:"to"`
+	Instances []*InstanceUptime `json:"instances"`
+}
+
+type UptimeReporter struct {
+	entityRepo    EntityRepo
+	heartbeatRepo HeartbeatRepo
+
+	mu sync.RWMutex
+	// Instance name to its maintenance windows
+	maintenance map[string][]MaintenanceWindow
+}
+
+func NewUptimeReporter(entityRepo EntityRepo, heartbeatRepo HeartbeatRepo) *UptimeReporter {
+	return &UptimeReporter{
+		entityRepo:    entityRepo,
+		heartbeatRepo: heartbeatRepo,
+		maintenance:   make(map[string][]MaintenanceWindow),
+	}
+}
+
+// Validates the maintenance windows of the instance without using them yet
+func (r *UptimeReporter) PrepareInstance(instance string, rawWindows []json.RawMessage) ([]MaintenanceWindow, error) {
+	var errs []error
+	windows := make([]MaintenanceWindow, 0, len(rawWindows))
+	names := make(map[string]struct{}, len(rawWindows))
+	for i, raw := range rawWindows {
+		resolved, err := ResolveConfig(raw)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		var cfg MaintenanceConfig
+		err = json.Unmarshal(resolved.JSON, &cfg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		problems := cfg.Valid(context.TODO())
+		if valErr := resolved.ValidationError(problems, instance, "maintenance"); valErr != nil {
+			valErr.SetIndex(i)
+			errs = append(errs, valErr)
+			continue
+		}
+
+		if _, exists := names[cfg.Name]; exists {
+			err := NewDuplicateFoundError(instance, "maintenance")
+			err.SetIndex(i)
+			errs = append(errs, err)
+			continue
+		}
+		names[cfg.Name] = struct{}{}
+
+		start, _ := time.Parse(time.RFC3339, cfg.Start)
+		end, _ := time.Parse(time.RFC3339, cfg.End)
+		windows = append(windows, MaintenanceWindow{
+			Name:     cfg.Name,
+			Instance: instance,
+			Services: cfg.Services,
+			Start:    start,
+			End:      end,
+		})
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return windows, nil
+}
+
+func (r *UptimeReporter) ApplyInstance(instance string, windows []MaintenanceWindow) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maintenance[instance] = windows
+}
+
+func (r *UptimeReporter) RemoveInstance(instance string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.maintenance, instance)
+}
+
+// Builds the report for every monitor with heartbeats in [from, to), only
+// for the given instance if it's not empty
+func (r *UptimeReporter) Report(ctx context.Context, from time.Time, to time.Time, instance string) (*UptimeReport, error) {
+	entities, err := r.entityRepo.ListEntities(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	maintenance := make(map[string][]MaintenanceWindow, len(r.maintenance))
+	for name, windows := range r.maintenance {
+		maintenance[name] = windows
+	}
+	r.mu.RUnlock()
+
+	report := &UptimeReport{
+		From: from,
+		To:   to,
+	}
+	instances := make(map[string]*InstanceUptime)
+	services := make(map[[2]string]*ServiceUptime)
+
+	for _, entity := range entities {
+		id := entity.EntityID
+		instName := id.Labels["instance"]
+		if id.Kind != "monitor" || (len(instance) > 0 && instName != instance) {
+			continue
+		}
+
+		var covering []MaintenanceWindow
+		for _, w := range maintenance[instName] {
+			if w.Covers(id) {
+				covering = append(covering, w)
+			}
+		}
+
+		monitor := &MonitorUptime{
+			ID:   id.Canonical(),
+			Name: id.Labels["name"],
+			Type: id.Labels["type"],
+		}
+		for _, rng := range excludeWindows(from, to, covering) {
+			count, err := r.heartbeatRepo.CountHeartbeats(ctx, monitor.ID, rng[0], rng[1])
+			if err != nil {
+				return nil, err
+			}
+			monitor.add(Uptime{Total: count.Total, Successful: count.Successful})
+		}
+		if monitor.Total == 0 {
+			continue
+		}
+
+		inst, ok := instances[instName]
+		if !ok {
+			inst = &InstanceUptime{Name: instName}
+			instances[instName] = inst
+			report.Instances = append(report.Instances, inst)
+		}
+
+		servName := id.Labels["service"]
+		serv, ok := services[[2]string{instName, servName}]
+		if !ok {
+			serv = &ServiceUptime{Name: servName}
+			services[[2]string{instName, servName}] = serv
+			inst.Services = append(inst.Services, serv)
+		}
+
+		serv.Monitors = append(serv.Monitors, monitor)
+		serv.add(monitor.Uptime)
+		inst.add(monitor.Uptime)
+	}
+
+	slices.SortFunc(report.Instances, func(a, b *InstanceUptime) int { return cmp.Compare(a.Name, b.Name) })
+	for _, inst := range report.Instances {
+		slices.SortFunc(inst.Services, func(a, b *ServiceUptime) int { return cmp.Compare(a.Name, b.Name) })
+		for _, serv := range inst.Services {
+			slices.SortFunc(serv.Monitors, func(a, b *MonitorUptime) int { return cmp.Compare(a.Name, b.Name) })
+		}
+	}
+
+	return report, nil
+}
+
+func WriteUptimeReport(w io.Writer, report *UptimeReport, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case "csv":
+		return writeUptimeCSV(w, report)
+	default:
+		return fmt.Errorf("unknown report format '%s', should be json or csv", format)
+	}
+}
+
+// Writes one row per instance, service and monitor
+func writeUptimeCSV(w io.Writer, report *UptimeReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"level", "instance", "service", "monitor", "type", "from", "to", "total", "successful", "uptime_percent"})
+
+	row := func(level string, instance string, service string, monitor string, typ string, uptime Uptime) {
+		var percent string
+		if uptime.Percent != nil {
+			percent = strconv.FormatFloat(*uptime.Percent, 'f', 3, 64)
+		}
+		cw.Write([]string{
+			level, instance, service, monitor, typ,
+			report.From.Format(time.RFC3339), report.To.Format(time.RFC3339),
+			strconv.FormatInt(uptime.Total, 10), strconv.FormatInt(uptime.Successful, 10),
+			percent,
+		})
+	}
+
+	for _, inst := range report.Instances {
+		row("instance", inst.Name, "", "", "", inst.Uptime)
+		for _, serv := range inst.Services {
+			row("service", inst.Name, serv.Name, "", "", serv.Uptime)
+			for _, mon := range serv.Monitors {
+				row("monitor", inst.Name, serv.Name, mon.Name, mon.Type, mon.Uptime)
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
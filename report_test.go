@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"meerkat-v0/db"
+)
+
+func TestExcludeWindows(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hour int) time.Time {
+		return base.Add(time.Duration(hour) * time.Hour)
+	}
+	window := func(start, end int) MaintenanceWindow {
+		return MaintenanceWindow{Start: at(start), End: at(end)}
+	}
+
+	tests := []struct {
+		name    string
+		windows []MaintenanceWindow
+		// Hours of the remaining ranges
+		want [][2]int
+	}{
+		{name: "no windows", want: [][2]int{{0, 10}}},
+		{name: "inside", windows: []MaintenanceWindow{window(2, 4)}, want: [][2]int{{0, 2}, {4, 10}}},
+		{name: "over the start", windows: []MaintenanceWindow{window(-2, 3)}, want: [][2]int{{3, 10}}},
+		{name: "over the end", windows: []MaintenanceWindow{window(8, 12)}, want: [][2]int{{0, 8}}},
+		{name: "everything", windows: []MaintenanceWindow{window(-1, 11)}},
+		{name: "outside", windows: []MaintenanceWindow{window(-5, 0), window(10, 12)}, want: [][2]int{{0, 10}}},
+		{name: "unsorted", windows: []MaintenanceWindow{window(6, 7), window(1, 2)}, want: [][2]int{{0, 1}, {2, 6}, {7, 10}}},
+		{name: "overlapping", windows: []MaintenanceWindow{window(1, 5), window(3, 4), window(4, 6)}, want: [][2]int{{0, 1}, {6, 10}}},
+		{name: "touching", windows: []MaintenanceWindow{window(1, 3), window(3, 5)}, want: [][2]int{{0, 1}, {5, 10}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges := excludeWindows(at(0), at(10), tt.windows)
+			var got [][2]int
+			for _, rng := range ranges {
+				got = append(got, [2]int{int(rng[0].Sub(base).Hours()), int(rng[1].Sub(base).Hours())})
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+// Records the entities heartbeats were counted for
+type countingHeartbeatRepo struct {
+	HeartbeatRepo
+	counted []string
+}
+
+func (r *countingHeartbeatRepo) CountHeartbeats(ctx context.Context, monitorID string, from time.Time, to time.Time) (HeartbeatCount, error) {
+	r.counted = append(r.counted, monitorID)
+	return r.HeartbeatRepo.CountHeartbeats(ctx, monitorID, from, to)
+}
+
+func TestUptimeReport(t *testing.T) {
+	ctx := context.Background()
+	dbRead, dbWrite, err := openObservations(ctx, filepath.Join(t.TempDir(), "observations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbRead.Close()
+	defer dbWrite.Close()
+
+	readDB, writeDB := db.New(dbRead), db.New(dbWrite)
+	entityRepo := NewSqliteEntityRepo(readDB, dbWrite)
+	heartbeatRepo := &countingHeartbeatRepo{HeartbeatRepo: NewSqliteHeartbeatRepo(readDB, writeDB, entityRepo)}
+
+	site := NewMonitorID("home", "web", "http", "site").Canonical()
+	api := NewMonitorID("home", "web", "tcp", "api").Canonical()
+	dns := NewMonitorID("home", "dns", "dns", "lookup").Canonical()
+	office := NewMonitorID("office", "web", "http", "site").Canonical()
+	idle := NewMonitorID("home", "web", "http", "idle").Canonical()
+	cpu := NewMetricsID("home", "host", "cpu", "cpu").Canonical()
+	for _, id := range []string{site, api, dns, office, idle, cpu} {
+		_, err := entityRepo.InsertEntity(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	beat := func(id string, hour int, ok bool) {
+		t.Helper()
+		var hbErr error
+		if !ok {
+			hbErr = errors.New("timeout")
+		}
+		err := heartbeatRepo.InsertHeartbeat(ctx, Heartbeat{MonitorID: id, Timestamp: from.Add(time.Duration(hour) * time.Hour), Error: hbErr})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The site is down during the maintenance of the web service
+	beat(site, 1, true)
+	beat(site, 2, false)
+	beat(site, 3, false)
+	beat(site, 5, true)
+	beat(api, 1, true)
+	beat(api, 5, false)
+	beat(dns, 2, false)
+	beat(dns, 3, true)
+	beat(office, 2, true)
+	beat(office, 30, false)
+
+	reports := NewUptimeReporter(entityRepo, heartbeatRepo)
+	reports.ApplyInstance("home", []MaintenanceWindow{{
+		Name:     "upgrade",
+		Instance: "home",
+		Services: []string{"web"},
+		Start:    from.Add(2 * time.Hour),
+		End:      from.Add(4 * time.Hour),
+	}})
+
+	report, err := reports.Report(ctx, from, from.Add(24*time.Hour), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slices.Contains(heartbeatRepo.counted, cpu) {
+		t.Errorf("expected heartbeats of the metrics entity not to be counted")
+	}
+
+	type uptime struct {
+		name       string
+		total      int64
+		successful int64
+	}
+	var got []uptime
+	for _, inst := range report.Instances {
+		got = append(got, uptime{inst.Name, inst.Total, inst.Successful})
+		for _, serv := range inst.Services {
+			got = append(got, uptime{inst.Name + "/" + serv.Name, serv.Total, serv.Successful})
+			for _, mon := range serv.Monitors {
+				got = append(got, uptime{inst.Name + "/" + serv.Name + "/" + mon.Name, mon.Total, mon.Successful})
+			}
+		}
+	}
+	want := []uptime{
+		{"home", 6, 4},
+		{"home/dns", 2, 1},
+		{"home/dns/lookup", 2, 1},
+		{"home/web", 4, 3},
+		{"home/web/api", 2, 1},
+		{"home/web/site", 2, 2},
+		{"office", 1, 1},
+		{"office/web", 1, 1},
+		{"office/web/site", 1, 1},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if percent := report.Instances[0].Percent; percent == nil || math.Abs(*percent-400.0/6) > 1e-9 {
+		t.Errorf("expected the home uptime to be rolled up from its monitors, got %v", report.Instances[0].Uptime)
+	}
+
+	report, err = reports.Report(ctx, from, from.Add(24*time.Hour), "office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Instances) != 1 || report.Instances[0].Name != "office" {
+		t.Errorf("expected only the office instance, got %d instances", len(report.Instances))
+	}
+}
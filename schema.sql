@@ -5,14 +5,27 @@ create table if not exists entities(
 
 create index if not exists entities_canonical_id_index on entities (canonical_id);
 
+create table if not exists entity_configs(
+  entity_id integer primary key references entities,
+  kind text not null,
+  config text not null
+);
+
 create table if not exists heartbeat(
   id integer primary key,
   entity_id integer references entities not null,
   ts timestamp not null,
   successful boolean not null,
-  error text
+  error text,
+  latency_us integer,
+  dns_us integer,
+  connect_us integer,
+  tls_us integer,
+  first_byte_us integer
 );
 
+create index if not exists heartbeat_entity_id_ts_index on heartbeat (entity_id, ts);
+
 create table if not exists metrics(
   id integer primary key,
   entity_id integer references entities not null,
@@ -22,3 +35,28 @@ create table if not exists metrics(
   value real not null,
   labels jsonb not null
 );
+
+create index if not exists metrics_name_ts_index on metrics (name, ts);
+
+create table if not exists state_changes(
+  id integer primary key,
+  entity_id integer references entities not null,
+  ts timestamp not null,
+  from_state text not null,
+  to_state text not null,
+  error text
+);
+
+create index if not exists state_changes_entity_id_ts_index on state_changes (entity_id, ts);
+
+create table if not exists notification_deliveries(
+  id integer primary key,
+  entity_id integer references entities not null,
+  notifier text not null,
+  ts timestamp not null,
+  event text not null,
+  attempt integer not null,
+  successful boolean not null,
+  status_code integer,
+  error text
+);
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"meerkat-v0/db"
+)
+
+type MonitorState string
+
+const (
+	StatePending  MonitorState = "pending"
+	StateUp       MonitorState = "up"
+	StateDown     MonitorState = "down"
+	StateFlapping MonitorState = "flapping"
+)
+
+type StateConfig struct {
+	// Consecutive failures before the monitor goes down, defaults to 1
+	FailuresBeforeDown int `json:"failures_before_down"`
+	// Consecutive successes before the monitor goes up, defaults to 1
+	SuccessesBeforeUp int `json:"successes_before_up"`
+	// Number of recent results checked for flapping, zero disables detection
+	FlapWindow int `json:"flap_window"`
+	// Changes between success and failure inside the window that make the
+	// monitor flapping
+	FlapThreshold int `json:"flap_threshold"`
+}
+
+func (c *StateConfig) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string, 4)
+
+	if c.FailuresBeforeDown < 0 {
+		problems["failures_before_down"] = "cannot be less than zero"
+	}
+
+	if c.SuccessesBeforeUp < 0 {
+		problems["successes_before_up"] = "cannot be less than zero"
+	}
+
+	if c.FlapWindow < 0 {
+		problems["flap_window"] = "cannot be less than zero"
+	}
+
+	if c.FlapWindow > 0 && (c.FlapThreshold <= 0 || c.FlapThreshold >= c.FlapWindow) {
+		problems["flap_threshold"] = "should be more than zero and less than flap_window"
+	}
+
+	return problems
+}
+
+func ParseStateConfig(rawCfg []byte) (StateConfig, error) {
+	var cfg StateConfig
+	err := json.Unmarshal(rawCfg, &cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.FailuresBeforeDown == 0 {
+		cfg.FailuresBeforeDown = 1
+	}
+	if cfg.SuccessesBeforeUp == 0 {
+		cfg.SuccessesBeforeUp = 1
+	}
+	return cfg, nil
+}
+
+type StateChange struct {
+	MonitorID string
+	Timestamp time.Time
+	From      MonitorState
+	To        MonitorState
+	// Error of the heartbeat that caused the change
+	Error error
+}
+
+// Turns heartbeats of a single monitor into state changes
+type StateTracker struct {
+	cfg   StateConfig
+	state MonitorState
+
+	failures  int
+	successes int
+	// Last FlapWindow results, oldest first
+	history []bool
+}
+
+func NewStateTracker(cfg StateConfig, initial MonitorState) *StateTracker {
+	return &StateTracker{
+		cfg:     cfg,
+		state:   initial,
+		history: make([]bool, 0, cfg.FlapWindow+1),
+	}
+}
+
+func (t *StateTracker) State() MonitorState {
+	return t.state
+}
+
+// Number of recent heartbeats that Resume needs to restore the counters
+// and the flap history
+func (t *StateTracker) ResumeWindow() int {
+	return max(t.cfg.FailuresBeforeDown, t.cfg.SuccessesBeforeUp, t.cfg.FlapWindow)
+}
+
+// Restores the counters and the flap history from heartbeats recorded
+// before a restart without changing the state, heartbeats are oldest first
+func (t *StateTracker) Resume(heartbeats []Heartbeat) {
+	for _, heartbeat := range heartbeats {
+		t.count(heartbeat.Error == nil)
+	}
+}
+
+func (t *StateTracker) Observe(heartbeat Heartbeat) (StateChange, bool) {
+	ok := heartbeat.Error == nil
+	t.count(ok)
+
+	next := t.state
+	switch {
+	case t.flapping():
+		next = StateFlapping
+	case !ok && t.failures >= t.cfg.FailuresBeforeDown:
+		next = StateDown
+	case ok && t.successes >= t.cfg.SuccessesBeforeUp:
+		next = StateUp
+	}
+
+	if next == t.state {
+		return StateChange{}, false
+	}
+
+	change := StateChange{
+		MonitorID: heartbeat.MonitorID,
+		Timestamp: heartbeat.Timestamp,
+		From:      t.state,
+		To:        next,
+		Error:     heartbeat.Error,
+	}
+	t.state = next
+	return change, true
+}
+
+func (t *StateTracker) count(ok bool) {
+	if ok {
+		t.successes++
+		t.failures = 0
+	} else {
+		t.failures++
+		t.successes = 0
+	}
+
+	if t.cfg.FlapWindow > 0 {
+		t.history = append(t.history, ok)
+		if len(t.history) > t.cfg.FlapWindow {
+			t.history = t.history[1:]
+		}
+	}
+}
+
+func (t *StateTracker) flapping() bool {
+	if t.cfg.FlapWindow == 0 {
+		return false
+	}
+
+	changes := 0
+	for i := 1; i < len(t.history); i++ {
+		if t.history[i] != t.history[i-1] {
+			changes++
+		}
+	}
+	return changes >= t.cfg.FlapThreshold
+}
+
+type StateChangeSink interface {
+	Emit(context.Context, StateChange) error
+}
+
+var ErrNoStateChange = errors.New("monitor has no recorded state changes")
+
+type StateChangeRepo interface {
+	InsertStateChange(context.Context, StateChange) error
+	// Returns ErrNoStateChange if the monitor never changed its state
+	LatestStateChange(ctx context.Context, monitorID string) (StateChange, error)
+	// Returns state changes in [from, to) ordered by time
+	ListStateChanges(ctx context.Context, monitorID string, from time.Time, to time.Time) ([]StateChange, error)
+}
+
+type DBStateChangeSink struct {
+	stateRepo StateChangeRepo
+}
+
+func NewDBStateChangeSink(stateRepo StateChangeRepo) *DBStateChangeSink {
+	return &DBStateChangeSink{
+		stateRepo: stateRepo,
+	}
+}
+
+func (s *DBStateChangeSink) Emit(ctx context.Context, change StateChange) error {
+	return s.stateRepo.InsertStateChange(ctx, change)
+}
+
+type SqliteStateChangeRepo struct {
+	readDB     *db.Queries
+	writeDB    *db.Queries
+	entityRepo EntityRepo
+}
+
+func NewSqliteStateChangeRepo(readDB *db.Queries, writeDB *db.Queries, entityRepo EntityRepo) *SqliteStateChangeRepo {
+	return &SqliteStateChangeRepo{
+		readDB:     readDB,
+		writeDB:    writeDB,
+		entityRepo: entityRepo,
+	}
+}
+
+func (r *SqliteStateChangeRepo) InsertStateChange(ctx context.Context, change StateChange) error {
+	eId, err := r.entityRepo.GetID(ctx, change.MonitorID)
+	if err != nil {
+		return err
+	}
+
+	var error sql.NullString
+	if change.Error != nil {
+		error.String = change.Error.Error()
+		error.Valid = true
+	}
+
+	_, err = r.writeDB.InsertStateChange(ctx, db.InsertStateChangeParams{
+		EntityID:  eId,
+		Ts:        change.Timestamp.UTC(),
+		FromState: string(change.From),
+		ToState:   string(change.To),
+		Error:     error,
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *SqliteStateChangeRepo) LatestStateChange(ctx context.Context, monitorID string) (StateChange, error) {
+	eId, err := r.entityRepo.GetID(ctx, monitorID)
+	if errors.Is(err, ErrIDNotFound) {
+		return StateChange{}, ErrNoStateChange
+	} else if err != nil {
+		return StateChange{}, err
+	}
+
+	row, err := r.readDB.GetLatestStateChange(ctx, eId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StateChange{}, ErrNoStateChange
+	} else if err != nil {
+		return StateChange{}, err
+	}
+
+	return stateChangeFromRow(monitorID, row), nil
+}
+
+func (r *SqliteStateChangeRepo) ListStateChanges(ctx context.Context, monitorID string, from time.Time, to time.Time) ([]StateChange, error) {
+	eId, err := r.entityRepo.GetID(ctx, monitorID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.readDB.ListStateChanges(ctx, db.ListStateChangesParams{
+		EntityID: eId,
+		FromTs:   from.UTC(),
+		ToTs:     to.UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]StateChange, len(rows))
+	for i, row := range rows {
+		changes[i] = stateChangeFromRow(monitorID, row)
+	}
+	return changes, nil
+}
+
+func stateChangeFromRow(monitorID string, row db.StateChange) StateChange {
+	var err error
+	if row.Error.Valid {
+		err = errors.New(row.Error.String)
+	}
+
+	return StateChange{
+		MonitorID: monitorID,
+		Timestamp: row.Ts,
+		From:      MonitorState(row.FromState),
+		To:        MonitorState(row.ToState),
+		Error:     err,
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Turns "+" into successful and "-" into failed heartbeats
+func testHeartbeats(results string) []Heartbeat {
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	heartbeats := make([]Heartbeat, len(results))
+	for i, result := range results {
+		heartbeats[i] = Heartbeat{
+			MonitorID: "monitor",
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+		}
+		if result == '-' {
+			heartbeats[i].Error = errors.New("probe failed")
+		}
+	}
+	return heartbeats
+}
+
+func TestStateTracker(t *testing.T) {
+	const (
+		p = StatePending
+		u = StateUp
+		d = StateDown
+		f = StateFlapping
+	)
+
+	tests := []struct {
+		name    string
+		cfg     StateConfig
+		initial MonitorState
+		results string
+		// State after each heartbeat
+		want []MonitorState
+	}{
+		{
+			name:    "defaults",
+			cfg:     StateConfig{FailuresBeforeDown: 1, SuccessesBeforeUp: 1},
+			initial: p,
+			results: "+-+",
+			want:    []MonitorState{u, d, u},
+		},
+		{
+			name:    "down after failures",
+			cfg:     StateConfig{FailuresBeforeDown: 3, SuccessesBeforeUp: 1},
+			initial: u,
+			results: "--+---",
+			want:    []MonitorState{u, u, u, u, u, d},
+		},
+		{
+			name:    "up after successes",
+			cfg:     StateConfig{FailuresBeforeDown: 1, SuccessesBeforeUp: 2},
+			initial: d,
+			results: "+-++",
+			want:    []MonitorState{d, d, d, u},
+		},
+		{
+			name:    "pending until a threshold is reached",
+			cfg:     StateConfig{FailuresBeforeDown: 2, SuccessesBeforeUp: 2},
+			initial: p,
+			results: "+-+-",
+			want:    []MonitorState{p, p, p, p},
+		},
+		{
+			name:    "flapping on and off",
+			cfg:     StateConfig{FailuresBeforeDown: 1, SuccessesBeforeUp: 1, FlapWindow: 4, FlapThreshold: 3},
+			initial: u,
+			results: "+-+-++++",
+			want:    []MonitorState{u, d, u, f, f, u, u, u},
+		},
+		{
+			name:    "flapping ends down",
+			cfg:     StateConfig{FailuresBeforeDown: 2, SuccessesBeforeUp: 1, FlapWindow: 3, FlapThreshold: 2},
+			initial: u,
+			results: "-+---",
+			want:    []MonitorState{u, u, f, d, d},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewStateTracker(tt.cfg, tt.initial)
+
+			got := make([]MonitorState, 0, len(tt.results))
+			for _, heartbeat := range testHeartbeats(tt.results) {
+				from := tracker.State()
+				change, changed := tracker.Observe(heartbeat)
+				if changed != (from != tracker.State()) {
+					t.Fatalf("changed = %v, state went from %q to %q", changed, from, tracker.State())
+				}
+				if changed && (change.From != from || change.To != tracker.State() || !change.Timestamp.Equal(heartbeat.Timestamp)) {
+					t.Fatalf("change = %+v for heartbeat at %s", change, heartbeat.Timestamp)
+				}
+				got = append(got, tracker.State())
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("states = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateTrackerResume(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     StateConfig
+		initial MonitorState
+		// Heartbeats recorded before the restart
+		before string
+		after  string
+		want   MonitorState
+	}{
+		{
+			name:    "failures count across a restart",
+			cfg:     StateConfig{FailuresBeforeDown: 3, SuccessesBeforeUp: 1},
+			initial: StateUp,
+			before:  "+--",
+			after:   "-",
+			want:    StateDown,
+		},
+		{
+			name:    "successes count across a restart",
+			cfg:     StateConfig{FailuresBeforeDown: 1, SuccessesBeforeUp: 3},
+			initial: StateDown,
+			before:  "-++",
+			after:   "+",
+			want:    StateUp,
+		},
+		{
+			name:    "flap history survives a restart",
+			cfg:     StateConfig{FailuresBeforeDown: 1, SuccessesBeforeUp: 1, FlapWindow: 4, FlapThreshold: 3},
+			initial: StateUp,
+			before:  "+-+",
+			after:   "-",
+			want:    StateFlapping,
+		},
+		{
+			name:    "resuming keeps the recorded state",
+			cfg:     StateConfig{FailuresBeforeDown: 1, SuccessesBeforeUp: 1},
+			initial: StateDown,
+			before:  "++",
+			after:   "",
+			want:    StateDown,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			heartbeats := testHeartbeats(tt.before + tt.after)
+
+			tracker := NewStateTracker(tt.cfg, tt.initial)
+			tracker.Resume(heartbeats[:len(tt.before)])
+			for _, heartbeat := range heartbeats[len(tt.before):] {
+				tracker.Observe(heartbeat)
+			}
+
+			if tracker.State() != tt.want {
+				t.Fatalf("state = %q, want %q", tracker.State(), tt.want)
+			}
+		})
+	}
+}
+
+func TestStateTrackerResumeWindow(t *testing.T) {
+	cfg := StateConfig{FailuresBeforeDown: 3, SuccessesBeforeUp: 2, FlapWindow: 5, FlapThreshold: 3}
+	if got := NewStateTracker(cfg, StatePending).ResumeWindow(); got != 5 {
+		t.Fatalf("ResumeWindow() = %d, want 5", got)
+	}
+
+	cfg.FlapWindow = 0
+	if got := NewStateTracker(cfg, StatePending).ResumeWindow(); got != 3 {
+		t.Fatalf("ResumeWindow() = %d, want 3", got)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"meerkat-v0/utils"
+)
+
+const (
+	statusPageDays = 90
+	// How far back state changes are turned into incidents
+	statusIncidentWindow = 14 * 24 * time.Hour
+	statusMaxIncidents   = 10
+	// Rendered pages are reused for this long, so public traffic doesn't hit
+	// the database on every request
+	statusPageCacheTTL = time.Minute
+)
+
+//go:embed status.html
+var statusPageHTML string
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"stateLabel": statusStateLabel,
+	"percent": func(p *float64) string {
+		if p == nil {
+			return "no data"
+		}
+		return fmt.Sprintf("%.2f%%", *p)
+	},
+	"barClass": func(p *float64) string {
+		switch {
+		case p == nil:
+			return "none"
+		case *p >= 99:
+			return "up"
+		case *p >= 95:
+			return "flapping"
+		default:
+			return "down"
+		}
+	},
+}).Parse(statusPageHTML))
+
+type StatusPageConfig struct {
+	// Defaults to the instance name
+	Title string `json:"title"`
+	// Services shown on the page, all of them when empty
+	Services []string `json:"services"`
+	// Shows the error that started each incident, off by default since
+	// errors can contain internal hostnames and addresses
+	ShowErrors bool `json:"show_errors"`
+}
+
+func (c *StatusPageConfig) Valid(ctx context.Context) map[string]string {
+	problems := make(map[string]string)
+
+	for i, service := range c.Services {
+		if err := utils.CheckName(service); err != nil {
+			problems[fmt.Sprintf("services[%d]", i)] = err.Error()
+		}
+	}
+
+	return problems
+}
+
+func statusStateLabel(state MonitorState) string {
+	switch state {
+	case StateUp:
+		return "Operational"
+	case StateDown:
+		return "Down"
+	case StateFlapping:
+		return "Degraded"
+	default:
+		return "Unknown"
+	}
+}
+
+// Higher is worse, used to pick the state of a service from its monitors
+var statusSeverity = map[MonitorState]int{
+	StateUp:       0,
+	StatePending:  1,
+	StateFlapping: 2,
+	StateDown:     3,
+}
+
+func worseState(a MonitorState, b MonitorState) MonitorState {
+	if statusSeverity[b] > statusSeverity[a] {
+		return b
+	}
+	return a
+}
+
+type statusDay struct {
+	Date    time.Time
+	Percent *float64
+}
+
+type statusMonitor struct {
+	Name  string
+	Type  string
+	State MonitorState
+}
+
+type statusService struct {
+	Name     string
+	State    MonitorState
+	Uptime   *float64
+	Days     []statusDay
+	Monitors []statusMonitor
+}
+
+type statusIncident struct {
+	Service string
+	Monitor string
+	State   MonitorState
+	Start   time.Time
+	// Nil while the incident is ongoing
+	End *time.Time
+	// Empty unless the page shows errors
+	Error string
+}
+
+type statusPageData struct {
+	Title     string
+	State     MonitorState
+	Updated   time.Time
+	Services  []statusService
+	Incidents []statusIncident
+}
+
+type cachedStatusPage struct {
+	body []byte
+	at   time.Time
+}
+
+// Renders public status pages for instances that have one configured
+type StatusPageService struct {
+	logger        *utils.Logger
+	monitors      *EntityService
+	heartbeatRepo HeartbeatRepo
+	stateRepo     StateChangeRepo
+
+	mu sync.Mutex
+	// Instance name to its status page config
+	pages map[string]StatusPageConfig
+	cache map[string]cachedStatusPage
+}
+
+func NewStatusPageService(monitors *EntityService, heartbeatRepo HeartbeatRepo, stateRepo StateChangeRepo) *StatusPageService {
+	return &StatusPageService{
+		logger:        utils.DefaultLogger(),
+		monitors:      monitors,
+		heartbeatRepo: heartbeatRepo,
+		stateRepo:     stateRepo,
+		pages:         make(map[string]StatusPageConfig),
+		cache:         make(map[string]cachedStatusPage),
+	}
+}
+
+// Validates the status page of the instance against its service names, nil
+// means the page is disabled
+func (s *StatusPageService) PrepareInstance(instance string, rawCfg json.RawMessage, services []string) (*StatusPageConfig, error) {
+	if len(rawCfg) == 0 {
+		return nil, nil
+	}
+
+	resolved, err := ResolveConfig(rawCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg StatusPageConfig
+	err = json.Unmarshal(resolved.JSON, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := cfg.Valid(context.TODO())
+	for i, service := range cfg.Services {
+		if _, ok := problems[fmt.Sprintf("services[%d]", i)]; !ok && !slices.Contains(services, service) {
+			problems[fmt.Sprintf("services[%d]", i)] = fmt.Sprintf("unknown service '%s'", service)
+		}
+	}
+	if valErr := resolved.ValidationError(problems, instance, "status_page"); valErr != nil {
+		return nil, valErr
+	}
+
+	if len(cfg.Title) == 0 {
+		cfg.Title = instance
+	}
+	return &cfg, nil
+}
+
+func (s *StatusPageService) ApplyInstance(instance string, cfg *StatusPageConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.cache, instance)
+	if cfg == nil {
+		delete(s.pages, instance)
+		return
+	}
+	s.pages[instance] = *cfg
+}
+
+func (s *StatusPageService) RemoveInstance(instance string) {
+	s.ApplyInstance(instance, nil)
+}
+
+func (s *StatusPageService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	instance := r.PathValue("instance")
+
+	s.mu.Lock()
+	cfg, ok := s.pages[instance]
+	cached, hit := s.cache[instance]
+	s.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	body := cached.body
+	if !hit || time.Since(cached.at) > statusPageCacheTTL {
+		var err error
+		body, err = s.render(r.Context(), instance, cfg)
+		if err != nil {
+			s.logger.Error("Could not render status page", "instance", instance, "err", err)
+			http.Error(w, "could not render status page", http.StatusInternalServerError)
+			return
+		}
+
+		s.mu.Lock()
+		s.cache[instance] = cachedStatusPage{body: body, at: time.Now()}
+		s.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(body)
+}
+
+func (s *StatusPageService) render(ctx context.Context, instance string, cfg StatusPageConfig) ([]byte, error) {
+	now := time.Now()
+	data := statusPageData{
+		Title:   cfg.Title,
+		State:   StateUp,
+		Updated: now,
+	}
+
+	byService := make(map[string][]utils.EntityID)
+	for _, id := range s.monitors.Entities() {
+		service := id.Labels["service"]
+		if id.Labels["instance"] != instance {
+			continue
+		}
+		if len(cfg.Services) > 0 && !slices.Contains(cfg.Services, service) {
+			continue
+		}
+		byService[service] = append(byService[service], id)
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	firstDay := today.AddDate(0, 0, -(statusPageDays - 1))
+
+	for name, ids := range byService {
+		slices.SortFunc(ids, func(a, b utils.EntityID) int {
+			return cmp.Compare(a.Labels["name"], b.Labels["name"])
+		})
+
+		service := statusService{
+			Name:  name,
+			State: StateUp,
+			Days:  make([]statusDay, statusPageDays),
+		}
+
+		counts := make([]Uptime, statusPageDays)
+		var total Uptime
+		for _, id := range ids {
+			canon := id.Canonical()
+
+			state := StatePending
+			change, err := s.stateRepo.LatestStateChange(ctx, canon)
+			if err == nil {
+				state = change.To
+			} else if !errors.Is(err, ErrNoStateChange) {
+				return nil, err
+			}
+			service.State = worseState(service.State, state)
+			service.Monitors = append(service.Monitors, statusMonitor{
+				Name:  id.Labels["name"],
+				Type:  id.Labels["type"],
+				State: state,
+			})
+
+			daily, err := s.heartbeatRepo.CountDailyHeartbeats(ctx, canon, firstDay, statusPageDays)
+			if err != nil && !errors.Is(err, ErrIDNotFound) {
+				return nil, err
+			}
+			for day, count := range daily {
+				uptime := Uptime{Total: count.Total, Successful: count.Successful}
+				counts[day].add(uptime)
+				total.add(uptime)
+			}
+
+			incidents, err := s.incidents(ctx, name, id, now, cfg.ShowErrors)
+			if err != nil {
+				return nil, err
+			}
+			data.Incidents = append(data.Incidents, incidents...)
+		}
+
+		for day := range statusPageDays {
+			service.Days[day] = statusDay{
+				Date:    firstDay.AddDate(0, 0, day),
+				Percent: counts[day].Percent,
+			}
+		}
+		service.Uptime = total.Percent
+
+		data.State = worseState(data.State, service.State)
+		data.Services = append(data.Services, service)
+	}
+
+	slices.SortFunc(data.Services, func(a, b statusService) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	slices.SortFunc(data.Incidents, func(a, b statusIncident) int {
+		return b.Start.Compare(a.Start)
+	})
+	if len(data.Incidents) > statusMaxIncidents {
+		data.Incidents = data.Incidents[:statusMaxIncidents]
+	}
+
+	var buf bytes.Buffer
+	err := statusPageTemplate.Execute(&buf, data)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Turns the recent state changes of a monitor into incidents, each one starts
+// when the monitor goes down or starts flapping and ends when it's up again
+func (s *StatusPageService) incidents(ctx context.Context, service string, id utils.EntityID, now time.Time, showErrors bool) ([]statusIncident, error) {
+	changes, err := s.stateRepo.ListStateChanges(ctx, id.Canonical(), now.Add(-statusIncidentWindow), now)
+	if errors.Is(err, ErrIDNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var incidents []statusIncident
+	var current *statusIncident
+	for _, change := range changes {
+		switch change.To {
+		case StateDown, StateFlapping:
+			if current != nil {
+				// Went from flapping to down or back, keep the worst one
+				current.State = worseState(current.State, change.To)
+				continue
+			}
+
+			var errText string
+			if showErrors && change.Error != nil {
+				errText = change.Error.Error()
+			}
+			current = &statusIncident{
+				Service: service,
+				Monitor: id.Labels["name"],
+				State:   change.To,
+				Start:   change.Timestamp,
+				Error:   errText,
+			}
+		case StateUp:
+			if current == nil {
+				continue
+			}
+			end := change.Timestamp
+			current.End = &end
+			incidents = append(incidents, *current)
+			current = nil
+		}
+	}
+	if current != nil {
+		incidents = append(incidents, *current)
+	}
+
+	return incidents, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"meerkat-v0/db"
+)
+
+// Returns heartbeat and state change repos on a fresh database that knows
+// the test monitor
+func newTestStatusRepos(t *testing.T) (*SqliteHeartbeatRepo, *SqliteStateChangeRepo) {
+	t.Helper()
+	ctx := context.Background()
+	dbRead, dbWrite, err := openObservations(ctx, filepath.Join(t.TempDir(), "observations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dbRead.Close()
+		dbWrite.Close()
+	})
+
+	_, err = dbWrite.ExecContext(ctx, "insert into entities (canonical_id) values (?)", testMonitorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readDB, writeDB := db.New(dbRead), db.New(dbWrite)
+	entityRepo := NewSqliteEntityRepo(readDB, dbWrite)
+	return NewSqliteHeartbeatRepo(readDB, writeDB, entityRepo), NewSqliteStateChangeRepo(readDB, writeDB, entityRepo)
+}
+
+func TestCountDailyHeartbeats(t *testing.T) {
+	ctx := context.Background()
+	heartbeats, _ := newTestStatusRepos(t)
+
+	// Days start at 23:30 UTC here
+	loc := time.FixedZone("+0030", 30*60)
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, loc)
+	stamps := []struct {
+		ts time.Time
+		ok bool
+	}{
+		{from.Add(-time.Minute), true},
+		{from, true},
+		{from.Add(23*time.Hour + 59*time.Minute), false},
+		{from.AddDate(0, 0, 1), true},
+		{from.AddDate(0, 0, 1).Add(10 * time.Hour), true},
+		{from.AddDate(0, 0, 2).Add(12 * time.Hour), false},
+		{from.AddDate(0, 0, 3), true},
+	}
+	for _, stamp := range stamps {
+		var err error
+		if !stamp.ok {
+			err = errors.New("timeout")
+		}
+		insertErr := heartbeats.InsertHeartbeat(ctx, Heartbeat{MonitorID: testMonitorID, Timestamp: stamp.ts, Error: err})
+		if insertErr != nil {
+			t.Fatal(insertErr)
+		}
+	}
+
+	counts, err := heartbeats.CountDailyHeartbeats(ctx, testMonitorID, from, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []HeartbeatCount{{2, 1}, {2, 2}, {1, 0}}
+	if len(counts) != len(expected) {
+		t.Fatalf("expected %d days, got %d", len(expected), len(counts))
+	}
+	for day := range expected {
+		if counts[day] != expected[day] {
+			t.Errorf("day %d: expected %+v, got %+v", day, expected[day], counts[day])
+		}
+	}
+}
+
+func TestStatusIncidentErrors(t *testing.T) {
+	ctx := context.Background()
+	_, stateRepo := newTestStatusRepos(t)
+
+	now := time.Now()
+	err := stateRepo.InsertStateChange(ctx, StateChange{
+		MonitorID: testMonitorID,
+		Timestamp: now.Add(-time.Hour),
+		From:      StateUp,
+		To:        StateDown,
+		Error:     errors.New("dial tcp 10.0.0.5:5432: connection refused"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &StatusPageService{stateRepo: stateRepo}
+	id := NewMonitorID("home", "web", "http", "site")
+	for _, showErrors := range []bool{false, true} {
+		incidents, err := s.incidents(ctx, "web", id, now, showErrors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(incidents) != 1 {
+			t.Fatalf("expected 1 incident, got %d", len(incidents))
+		}
+		if shown := len(incidents[0].Error) > 0; shown != showErrors {
+			t.Errorf("show_errors %v: got error %q", showErrors, incidents[0].Error)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Merges defaults and templates of the instance into its entities. Only the
+// entities under entityKeys are touched, notifiers, alerts and maintenance
+// windows never get defaults. Services are rewritten only when one of their
+// entities changes, so configs without defaults stay as written. Entities
+// that can't be expanded are left out of the returned config, which is
+// returned along with the error
+func ExpandInstance(cfg InstanceConfig, entityKeys []string) (InstanceConfig, error) {
+	var errs []error
+	defaults, err := decodeDefaults(cfg.Defaults, entityKeys)
+	if err != nil {
+		errs = append(errs, NewValidationError(map[string]string{"defaults": err.Error()}, cfg.Name))
+	}
+
+	templates := make(map[string]map[string]any, len(cfg.Templates))
+	for name, raw := range cfg.Templates {
+		template, err := decodeObject(raw)
+		if err != nil {
+			errs = append(errs, NewValidationError(map[string]string{"template": err.Error()}, cfg.Name, "templates", name))
+			continue
+		}
+		templates[name] = template
+	}
+
+	expanded := cfg
+	expanded.Defaults = nil
+	expanded.Templates = nil
+	expanded.Services = slices.Clone(cfg.Services)
+	for i, rawService := range cfg.Services {
+		var service map[string]json.RawMessage
+		err := json.Unmarshal(rawService, &service)
+		// Services that aren't objects are reported when planning
+		if err != nil {
+			continue
+		}
+		var serviceName string
+		json.Unmarshal(service["name"], &serviceName)
+
+		serviceDefaults, err := decodeDefaults(service["defaults"], entityKeys)
+		if err != nil {
+			errs = append(errs, NewValidationError(map[string]string{"defaults": err.Error()}, cfg.Name, serviceName))
+			continue
+		}
+
+		changed := false
+		for _, key := range entityKeys {
+			var rawEntities []json.RawMessage
+			if json.Unmarshal(service[key], &rawEntities) != nil {
+				continue
+			}
+			layers := make([]map[string]any, 0, 4)
+			for _, layer := range []map[string]any{defaults[""], defaults[key], serviceDefaults[""], serviceDefaults[key]} {
+				if len(layer) > 0 {
+					layers = append(layers, layer)
+				}
+			}
+			keyChanged := false
+			kept := make([]json.RawMessage, 0, len(rawEntities))
+			for j, rawEntity := range rawEntities {
+				entity, err := expandEntity(rawEntity, layers, templates)
+				// Left out, building it would only add problems caused by this one
+				if err != nil {
+					problems := map[string]string{"extends": err.Error()}
+					if name := entityName(rawEntity); len(name) > 0 {
+						errs = append(errs, NewValidationError(problems, cfg.Name, serviceName, name))
+					} else {
+						valErr := NewValidationError(problems, cfg.Name, serviceName)
+						valErr.SetIndex(j)
+						errs = append(errs, valErr)
+					}
+					keyChanged = true
+					continue
+				}
+				if entity != nil {
+					rawEntity = entity
+					keyChanged = true
+				}
+				kept = append(kept, rawEntity)
+			}
+			if keyChanged {
+				changed = true
+				service[key], err = json.Marshal(kept)
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+		if _, ok := service["defaults"]; ok {
+			delete(service, "defaults")
+			changed = true
+		}
+
+		if changed {
+			expanded.Services[i], err = json.Marshal(service)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return expanded, errors.Join(errs...)
+}
+
+// Decodes defaults split by the entity kind they go under. Keys named after
+// an entity kind, like monitor, hold defaults of that kind only, the rest go
+// under every entity and are keyed by ""
+func decodeDefaults(raw json.RawMessage, entityKeys []string) (map[string]map[string]any, error) {
+	common, err := decodeObject(raw)
+	if err != nil || common == nil {
+		return nil, err
+	}
+
+	scoped := map[string]map[string]any{"": common}
+	for _, key := range entityKeys {
+		value, ok := common[key]
+		if !ok {
+			continue
+		}
+		delete(common, key)
+		kindDefaults, ok := value.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("'%s' should be an object", key)
+		}
+		scoped[key] = kindDefaults
+	}
+	return scoped, nil
+}
+
+func entityName(raw json.RawMessage) string {
+	var named struct {
+		Name string `json:"name"`
+	}
+	json.Unmarshal(raw, &named)
+	return named.Name
+}
+
+// Returns the entity with the layers, then the templates it extends, merged
+// under it, or nil when there's nothing to merge
+func expandEntity(raw json.RawMessage, layers []map[string]any, templates map[string]map[string]any) (json.RawMessage, error) {
+	entity, err := decodeObject(raw)
+	// Entities that aren't objects are reported when building them
+	if err != nil || entity == nil {
+		return nil, nil
+	}
+
+	extends, hasExtends := entity["extends"]
+	if len(layers) == 0 && !hasExtends {
+		return nil, nil
+	}
+	delete(entity, "extends")
+
+	merged := make(map[string]any)
+	for _, layer := range layers {
+		merged = mergeJSON(merged, layer).(map[string]any)
+	}
+
+	if hasExtends {
+		name, ok := extends.(string)
+		if !ok {
+			return nil, fmt.Errorf("should be the name of a template")
+		}
+		template, err := resolveTemplate(name, templates, nil)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeJSON(merged, template).(map[string]any)
+	}
+
+	merged = mergeJSON(merged, entity).(map[string]any)
+	return json.Marshal(merged)
+}
+
+// Returns the template merged over every template it extends
+func resolveTemplate(name string, templates map[string]map[string]any, seen []string) (map[string]any, error) {
+	if slices.Contains(seen, name) {
+		return nil, fmt.Errorf("templates extend each other: %s", strings.Join(append(seen, name), " -> "))
+	}
+	template, ok := templates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown template '%s', defined templates: %s", name, strings.Join(slices.Sorted(maps.Keys(templates)), ", "))
+	}
+
+	own := maps.Clone(template)
+	extends, ok := own["extends"]
+	if !ok {
+		return own, nil
+	}
+	delete(own, "extends")
+
+	parentName, ok := extends.(string)
+	if !ok {
+		return nil, fmt.Errorf("extends of template '%s' should be the name of a template", name)
+	}
+	parent, err := resolveTemplate(parentName, templates, append(seen, name))
+	if err != nil {
+		return nil, err
+	}
+	return mergeJSON(parent, own).(map[string]any), nil
+}
+
+// Merges src over dst. Objects are merged key by key, anything else in src
+// replaces what's in dst. Neither is modified
+func mergeJSON(dst, src any) any {
+	srcObj, ok := src.(map[string]any)
+	if !ok {
+		return src
+	}
+	dstObj, ok := dst.(map[string]any)
+	if !ok {
+		return maps.Clone(srcObj)
+	}
+
+	merged := maps.Clone(dstObj)
+	for key, value := range srcObj {
+		merged[key] = mergeJSON(merged[key], value)
+	}
+	return merged
+}
+
+// Decodes a JSON object keeping numbers as written, nil when raw is empty
+func decodeObject(raw json.RawMessage) (map[string]any, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var obj map[string]any
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err := dec.Decode(&obj)
+	if err != nil {
+		return nil, fmt.Errorf("should be an object")
+	}
+	return obj, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var testEntityKeys = []string{"metrics", "monitor"}
+
+// Returns the entities under key of every service by "service.entity"
+func expandedEntities(t *testing.T, cfg InstanceConfig, key string) map[string]map[string]any {
+	t.Helper()
+	entities := make(map[string]map[string]any)
+	for _, rawService := range cfg.Services {
+		var service struct {
+			Name     string          `json:"name"`
+			Defaults json.RawMessage `json:"defaults"`
+		}
+		err := json.Unmarshal(rawService, &service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if service.Defaults != nil {
+			t.Errorf("expected the defaults of %s to be removed", service.Name)
+		}
+
+		var keys map[string]json.RawMessage
+		err = json.Unmarshal(rawService, &keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list []map[string]any
+		if raw, ok := keys[key]; ok {
+			err = json.Unmarshal(raw, &list)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, entity := range list {
+			name, _ := entity["name"].(string)
+			entities[service.Name+"."+name] = entity
+		}
+	}
+	return entities
+}
+
+func TestExpandInstance(t *testing.T) {
+	tests := []struct {
+		name      string
+		defaults  string
+		templates map[string]string
+		services  string
+		// Expanded entities under key by "service.entity"
+		key  string
+		want map[string]map[string]any
+		err  string
+	}{
+		{
+			name:     "entity over template over defaults",
+			defaults: `{"interval": 60, "timeout": 1, "port": "1", "headers": {"Accept": "text/html", "X-From": "defaults"}}`,
+			templates: map[string]string{
+				"web": `{"timeout": 2, "port": "2", "headers": {"X-From": "template"}}`,
+			},
+			services: `[{"name": "web", "monitor": [{"name": "site", "extends": "web", "port": "3"}]}]`,
+			key:      "monitor",
+			want: map[string]map[string]any{
+				"web.site": {
+					"name":     "site",
+					"interval": 60.0,
+					"timeout":  2.0,
+					"port":     "3",
+					"headers":  map[string]any{"Accept": "text/html", "X-From": "template"},
+				},
+			},
+		},
+		{
+			name:     "service defaults over instance defaults",
+			defaults: `{"interval": 60, "timeout": 1}`,
+			services: `[
+				{"name": "web", "defaults": {"timeout": 5}, "monitor": [{"name": "site"}]},
+				{"name": "db", "monitor": [{"name": "primary", "timeout": 9}]}
+			]`,
+			key: "monitor",
+			want: map[string]map[string]any{
+				"web.site":   {"name": "site", "interval": 60.0, "timeout": 5.0},
+				"db.primary": {"name": "primary", "interval": 60.0, "timeout": 9.0},
+			},
+		},
+		{
+			name: "templates extending templates",
+			templates: map[string]string{
+				"base": `{"type": "http", "interval": 30, "timeout": 1}`,
+				"web":  `{"extends": "base", "timeout": 2}`,
+			},
+			services: `[{"name": "web", "monitor": [{"name": "site", "extends": "web"}]}]`,
+			key:      "monitor",
+			want: map[string]map[string]any{
+				"web.site": {"name": "site", "type": "http", "interval": 30.0, "timeout": 2.0},
+			},
+		},
+		{
+			name:     "kind defaults stay with their kind",
+			defaults: `{"interval": 60, "monitor": {"timeout": 5}, "metrics": {"interval": 10}}`,
+			services: `[{
+				"name": "host",
+				"defaults": {"monitor": {"hostname": "localhost"}},
+				"monitor": [{"name": "ssh"}],
+				"metrics": [{"name": "cpu"}]
+			}]`,
+			key: "metrics",
+			want: map[string]map[string]any{
+				"host.cpu": {"name": "cpu", "interval": 10.0},
+			},
+		},
+		{
+			name:     "kind defaults of monitors",
+			defaults: `{"interval": 60, "monitor": {"timeout": 5}, "metrics": {"interval": 10}}`,
+			services: `[{
+				"name": "host",
+				"defaults": {"monitor": {"hostname": "localhost"}},
+				"monitor": [{"name": "ssh"}],
+				"metrics": [{"name": "cpu"}]
+			}]`,
+			key: "monitor",
+			want: map[string]map[string]any{
+				"host.ssh": {"name": "ssh", "interval": 60.0, "timeout": 5.0, "hostname": "localhost"},
+			},
+		},
+		{
+			name:     "kind defaults that aren't objects",
+			defaults: `{"monitor": 5}`,
+			services: `[{"name": "web", "monitor": [{"name": "site"}]}]`,
+			key:      "monitor",
+			want:     map[string]map[string]any{"web.site": {"name": "site"}},
+			err:      "'monitor' should be an object",
+		},
+		{
+			name: "extends cycle",
+			templates: map[string]string{
+				"a": `{"extends": "b"}`,
+				"b": `{"extends": "a"}`,
+			},
+			services: `[{"name": "web", "monitor": [{"name": "site", "extends": "a"}, {"name": "api"}]}]`,
+			key:      "monitor",
+			want:     map[string]map[string]any{"web.api": {"name": "api"}},
+			err:      "templates extend each other: a -> b -> a",
+		},
+		{
+			name:      "unknown template",
+			templates: map[string]string{"web": `{}`, "db": `{}`},
+			services:  `[{"name": "web", "monitor": [{"name": "site", "extends": "nope"}]}]`,
+			key:       "monitor",
+			want:      map[string]map[string]any{},
+			err:       "unknown template 'nope', defined templates: db, web",
+		},
+		{
+			name:     "extends that isn't a name",
+			services: `[{"name": "web", "monitor": [{"name": "site", "extends": 1}]}]`,
+			key:      "monitor",
+			want:     map[string]map[string]any{},
+			err:      "should be the name of a template",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := InstanceConfig{Name: "home"}
+			if len(tt.defaults) > 0 {
+				cfg.Defaults = json.RawMessage(tt.defaults)
+			}
+			if tt.templates != nil {
+				cfg.Templates = make(map[string]json.RawMessage, len(tt.templates))
+				for name, template := range tt.templates {
+					cfg.Templates[name] = json.RawMessage(template)
+				}
+			}
+			err := json.Unmarshal([]byte(tt.services), &cfg.Services)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expanded, err := ExpandInstance(cfg, testEntityKeys)
+			checkError(t, err, tt.err)
+			if expanded.Defaults != nil || expanded.Templates != nil {
+				t.Errorf("expected defaults and templates to be removed")
+			}
+
+			got := expandedEntities(t, expanded, tt.key)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestExpandInstanceLeavesTheRest(t *testing.T) {
+	notifiers := []json.RawMessage{json.RawMessage(`{"type": "webhook", "name": "ops"}`)}
+	maintenance := []json.RawMessage{json.RawMessage(`{"start": "2025-03-01T00:00:00Z", "end": "2025-03-01T02:00:00Z"}`)}
+	alerts := []json.RawMessage{json.RawMessage(`{"name": "high_load", "metric": "cpu"}`)}
+	services := []json.RawMessage{
+		json.RawMessage(`{"name": "web", "notifiers": [{"type": "webhook", "name": "web"}], "monitor": [{"name": "site"}]}`),
+		json.RawMessage(`{"name": "db", "monitor": [{"name": "primary"}]}`),
+	}
+
+	cfg := InstanceConfig{
+		Name:        "home",
+		Services:    services,
+		Notifiers:   notifiers,
+		Alerts:      alerts,
+		Maintenance: maintenance,
+		Defaults:    json.RawMessage(`{"interval": 60}`),
+	}
+	expanded, err := ExpandInstance(cfg, testEntityKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(expanded.Notifiers, notifiers) || !reflect.DeepEqual(expanded.Alerts, alerts) ||
+		!reflect.DeepEqual(expanded.Maintenance, maintenance) {
+		t.Errorf("expected notifiers, alerts and maintenance to stay as written, got %s, %s and %s",
+			expanded.Notifiers, expanded.Alerts, expanded.Maintenance)
+	}
+
+	var service struct {
+		Notifiers []map[string]any `json:"notifiers"`
+	}
+	err = json.Unmarshal(expanded.Services[0], &service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := service.Notifiers[0]["interval"]; ok {
+		t.Errorf("expected service notifiers to get no defaults, got %v", service.Notifiers)
+	}
+
+	// Without defaults or templates services aren't rewritten
+	cfg.Defaults = nil
+	expanded, err = ExpandInstance(cfg, testEntityKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expanded.Services, services) {
+		t.Errorf("expected services to stay as written, got %s", expanded.Services)
+	}
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
 	"strings"
 )
 
@@ -11,20 +16,79 @@ type ConfigError interface {
 	PrependPath(path string) ConfigError
 }
 
+// One step into the config, a name with an optional index like services[2]
+type PathSegment struct {
+	Name string
+	// -1 when the segment has no index
+	Index int
+}
+
+func (s PathSegment) String() string {
+	if s.Index < 0 {
+		return s.Name
+	}
+	return fmt.Sprintf("%s[%d]", s.Name, s.Index)
+}
+
+// Path to a part of the config. Segments are kept apart, so names with dots
+// or only digits are never mistaken for nesting or indices
+type ConfigPath []PathSegment
+
+func NewConfigPath(names ...string) ConfigPath {
+	path := make(ConfigPath, len(names))
+	for i, name := range names {
+		path[i] = PathSegment{name, -1}
+	}
+	return path
+}
+
+func (p ConfigPath) String() string {
+	segments := make([]string, len(p))
+	for i, segment := range p {
+		segments[i] = segment.String()
+	}
+	return strings.Join(segments, ".")
+}
+
+// Returns a copy of the path with name added at the end
+func (p ConfigPath) Child(name string) ConfigPath {
+	return append(slices.Clip(p), PathSegment{name, -1})
+}
+
+// Returns a copy of the path with the last segment indexed by i
+func (p ConfigPath) WithIndex(i int) ConfigPath {
+	if len(p) == 0 {
+		return p
+	}
+	path := slices.Clone(p)
+	path[len(path)-1].Index = i
+	return path
+}
+
+// Identifies the path in maps, unlike String it can't be the same for
+// different paths
+func (p ConfigPath) key() string {
+	segments := make([]string, len(p))
+	for i, segment := range p {
+		segments[i] = segment.Name + "\x00" + strconv.Itoa(segment.Index)
+	}
+	return strings.Join(segments, "\x00")
+}
+
 type ValidationError struct {
-	Path     string
+	Path     ConfigPath
 	Problems map[string]string
 }
 
 func NewValidationError(problems map[string]string, path ...string) *ValidationError {
-	return &ValidationError{strings.Join(path, "."), problems}
+	return &ValidationError{NewConfigPath(path...), problems}
 }
 
 func (e *ValidationError) Error() string {
 	var b strings.Builder
 	fmt.Fprintf(&b, "validation errors found in '%s':\n", e.Path)
-	for field, problem := range e.Problems {
-		fmt.Fprintf(&b, "  %s: %s\n", field, problem)
+	for _, field := range slices.Sorted(maps.Keys(e.Problems)) {
+		fmt.Fprintf(&b, "  %s: %s\n", field, e.Problems[field])
 	}
 	return b.String()
 }
@@ -35,57 +99,236 @@ func (e *ValidationError) Is(other error) bool {
 }
 
 func (e *ValidationError) PrependPath(path string) ConfigError {
-	e.Path = fmt.Sprint(path, ".", e.Path)
+	e.Path = append(NewConfigPath(path), e.Path...)
 	return e
 }
 
 func (e *ValidationError) AppendPath(path string) ConfigError {
-	e.Path = fmt.Sprint(e.Path, ".", path)
+	e.Path = e.Path.Child(path)
 	return e
 }
 
+// Points the error at the i-th item of the last segment of its path
+func (e *ValidationError) SetIndex(i int) {
+	e.Path = e.Path.WithIndex(i)
+}
+
 type Validator interface {
 	// Returns a map of field and human readable explanation of what's wrong
 	Valid(ctx context.Context) (problems map[string]string)
 }
 
 type DuplicateFoundError struct {
-	Path string
+	Path ConfigPath
+	// Files and lines of every definition, when they are in different files
+	Locations []string
 }
 
 func NewDuplicateFoundError(path ...string) *DuplicateFoundError {
-	return &DuplicateFoundError{strings.Join(path, ".")}
+	return &DuplicateFoundError{Path: NewConfigPath(path...)}
 }
 
 func (e *DuplicateFoundError) Error() string {
+	if len(e.Locations) > 0 {
+		return fmt.Sprintf("duplicate entity in '%s', defined at %s", e.Path, strings.Join(e.Locations, " and "))
+	}
 	return fmt.Sprintf("duplicate entity in '%s'", e.Path)
 }
 
+func (e *DuplicateFoundError) SetIndex(i int) {
+	e.Path = e.Path.WithIndex(i)
+}
+
+func (e *DuplicateFoundError) PrependPath(path string) ConfigError {
+	e.Path = append(NewConfigPath(path), e.Path...)
+	return e
+}
+
 type NoNameError struct {
-	Path  string
-	Index int
+	Path ConfigPath
 }
 
 func NewNoNameError(path ...string) *NoNameError {
-	return &NoNameError{strings.Join(path, "."), -1}
+	return &NoNameError{NewConfigPath(path...)}
 }
 
 func (e *NoNameError) Error() string {
-	var path string
-	if e.Index >= 0 {
-		path = fmt.Sprintf("%s[%d]", e.Path, e.Index)
-	} else {
-		path = e.Path
-	}
-
-	return fmt.Sprintf("entity in '%s' has no name", path)
+	return fmt.Sprintf("entity in '%s' has no name", e.Path)
 }
 
 func (e *NoNameError) SetIndex(i int) {
-	e.Index = i
+	e.Path = e.Path.WithIndex(i)
 }
 
 func (e *NoNameError) PrependPath(path string) ConfigError {
-	e.Path = fmt.Sprint(path, ".", e.Path)
+	e.Path = append(NewConfigPath(path), e.Path...)
 	return e
 }
+
+// Splits errors combined with errors.Join back into a flat list
+func FlattenErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, e := range joined.Unwrap() {
+		errs = append(errs, FlattenErrors(e)...)
+	}
+	return errs
+}
+
+// Every problem found in a config. The errors keep their own paths, Tree
+// groups them by it
+type ConfigErrors struct {
+	errs []error
+	// Where the config came from, used to point errors to lines
+	source ConfigLocator
+}
+
+// Finds where the part of the config a config error path points to is
+// defined
+type ConfigLocator interface {
+	// Returns the file and line, like "config.yaml:12"
+	Locate(path ConfigPath) (string, bool)
+}
+
+// Returns nil when errs has no errors, source can be nil
+func NewConfigErrors(source ConfigLocator, errs ...error) error {
+	flat := FlattenErrors(errors.Join(errs...))
+	if len(flat) == 0 {
+		return nil
+	}
+	return &ConfigErrors{flat, source}
+}
+
+func (e *ConfigErrors) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d problems found in config:\n", e.Len())
+	e.Tree().WriteText(&b, "  ")
+	return b.String()
+}
+
+func (e *ConfigErrors) Unwrap() []error {
+	return e.errs
+}
+
+// Number of problems, every field of a validation error counts as one
+func (e *ConfigErrors) Len() int {
+	return e.Tree().Len()
+}
+
+func (e *ConfigErrors) Tree() *ErrorTree {
+	tree := &ErrorTree{}
+	for _, err := range e.errs {
+		tree.Add(err)
+	}
+	if e.source != nil {
+		tree.locate(e.source, nil)
+	}
+	return tree
+}
+
+// Config problems grouped by the path they were found at, with path segments
+// as children
+type ErrorTree struct {
+	// File and line the node is defined at, when known
+	Location string `json:"location,omitempty"`
+	// Field name to what's wrong with it
+	Problems map[string]string `json:"problems,omitempty"`
+	// Problems of the node as a whole, and errors without a known path
+	Errors   []string              `json:"errors,omitempty"`
+	Children map[string]*ErrorTree `json:"children,omitempty"`
+
+	// Segment of the path the node is the child of its parent at
+	segment PathSegment
+}
+
+func (t *ErrorTree) Add(err error) {
+	var val *ValidationError
+	var dup *DuplicateFoundError
+	var nnerr *NoNameError
+	switch {
+	case errors.As(err, &val):
+		node := t.node(val.Path)
+		if node.Problems == nil {
+			node.Problems = make(map[string]string, len(val.Problems))
+		}
+		maps.Copy(node.Problems, val.Problems)
+	case errors.As(err, &dup):
+		node := t.node(dup.Path)
+		if len(dup.Locations) > 0 {
+			node.Errors = append(node.Errors, "defined more than once, at "+strings.Join(dup.Locations, " and "))
+		} else {
+			node.Errors = append(node.Errors, "duplicate entity")
+		}
+	case errors.As(err, &nnerr):
+		node := t.node(nnerr.Path)
+		node.Errors = append(node.Errors, "has no name")
+	default:
+		t.Errors = append(t.Errors, strings.TrimRight(err.Error(), "\n"))
+	}
+}
+
+func (t *ErrorTree) locate(source ConfigLocator, path ConfigPath) {
+	for _, child := range t.Children {
+		childPath := append(slices.Clip(path), child.segment)
+		if location, ok := source.Locate(childPath); ok {
+			child.Location = location
+		}
+		child.locate(source, childPath)
+	}
+}
+
+func (t *ErrorTree) node(path ConfigPath) *ErrorTree {
+	node := t
+	for _, segment := range path {
+		if node.Children == nil {
+			node.Children = make(map[string]*ErrorTree)
+		}
+		child, ok := node.Children[segment.String()]
+		if !ok {
+			child = &ErrorTree{segment: segment}
+			node.Children[segment.String()] = child
+		}
+		node = child
+	}
+	return node
+}
+
+func (t *ErrorTree) Len() int {
+	n := len(t.Problems) + len(t.Errors)
+	for _, child := range t.Children {
+		n += child.Len()
+	}
+	return n
+}
+
+// Writes the tree with every level indented one more time than its parent,
+// sorted so the output is stable
+func (t *ErrorTree) WriteText(w io.Writer, indent string) {
+	t.writeText(w, indent, "")
+}
+
+func (t *ErrorTree) writeText(w io.Writer, indent, prefix string) {
+	for _, err := range t.Errors {
+		fmt.Fprintf(w, "%s%s\n", prefix, err)
+	}
+	for _, field := range slices.Sorted(maps.Keys(t.Problems)) {
+		fmt.Fprintf(w, "%s%s: %s\n", prefix, field, t.Problems[field])
+	}
+	for _, segment := range slices.Sorted(maps.Keys(t.Children)) {
+		child := t.Children[segment]
+		if len(child.Location) > 0 {
+			fmt.Fprintf(w, "%s%s (%s):\n", prefix, segment, child.Location)
+		} else {
+			fmt.Fprintf(w, "%s%s:\n", prefix, segment)
+		}
+		child.writeText(w, indent, prefix+indent)
+	}
+}
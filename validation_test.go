@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestErrorTreePaths(t *testing.T) {
+	src, err := ParseConfig("home.json", ConfigJSON, []byte(`{
+  "name": "home",
+  "services": [
+    {
+      "name": "web.v2",
+      "monitor": [
+        {"name": "2024"},
+        {"name": "db.primary"},
+        {"type": "tcp"}
+      ]
+    }
+  ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unnamed := NewValidationError(map[string]string{"name": "'name' is required"}, "home", "web.v2", "")
+	// Done by buildAll for entities without a name
+	unnamed.Path = unnamed.Path[:len(unnamed.Path)-1].WithIndex(2)
+	noName := NewNoNameError("home", "services")
+	noName.SetIndex(3)
+	errs := NewConfigErrors(src,
+		NewValidationError(map[string]string{"interval": "bad"}, "home", "web.v2", "2024"),
+		NewValidationError(map[string]string{"port": "bad"}, "home", "web.v2", "db.primary"),
+		unnamed,
+		noName,
+		errors.New("not about a path"),
+	)
+	var cfgErrs *ConfigErrors
+	if !errors.As(errs, &cfgErrs) {
+		t.Fatalf("expected config errors, got %v", errs)
+	}
+	tree := cfgErrs.Tree()
+	home := tree.Children["home"]
+	if home == nil {
+		t.Fatalf("expected a home node, got %v", tree.Children)
+	}
+	service := home.Children["web.v2"]
+	if service == nil {
+		t.Fatalf("expected the service name to stay whole, got %v", home.Children)
+	}
+
+	tests := []struct {
+		node     *ErrorTree
+		location string
+		problem  string
+	}{
+		{service.Children["2024"], "home.json:7", "interval"},
+		{service.Children["db.primary"], "home.json:8", "port"},
+		{home.Children["web.v2[2]"], "home.json:9", "name"},
+	}
+	for _, tt := range tests {
+		if tt.node == nil {
+			t.Errorf("missing node for %s, got %v and %v", tt.problem, home.Children, service.Children)
+			continue
+		}
+		if tt.node.Location != tt.location {
+			t.Errorf("%s: expected location %s, got %s", tt.problem, tt.location, tt.node.Location)
+		}
+		if _, ok := tt.node.Problems[tt.problem]; !ok {
+			t.Errorf("expected a %s problem, got %v", tt.problem, tt.node.Problems)
+		}
+	}
+
+	if node := home.Children["services[3]"]; node == nil || len(node.Errors) != 1 {
+		t.Errorf("expected services[3] to have no name, got %v", home.Children)
+	}
+	if len(tree.Errors) != 1 {
+		t.Errorf("expected the error without a path at the root, got %v", tree.Errors)
+	}
+	if n := cfgErrs.Len(); n != 5 {
+		t.Errorf("expected 5 problems, got %d", n)
+	}
+
+	var b strings.Builder
+	tree.WriteText(&b, "  ")
+	if !strings.Contains(b.String(), "  web.v2 (home.json:4):\n    2024 (home.json:7):\n") {
+		t.Errorf("unexpected text output:\n%s", b.String())
+	}
+}